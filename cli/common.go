@@ -16,8 +16,12 @@ package cli
 
 import (
 	_ "crypto/sha512" // for go-digest
+	"encoding/json"
+	"fmt"
+	"os"
 	"os/exec"
 	"text/template"
+	"time"
 
 	"github.com/coreos/tectonic-torcx/internal"
 
@@ -30,7 +34,14 @@ import (
 var (
 	cfg                  = internal.Config{}
 	verbose              string
-	flagTorcxManifestURL string
+	flagTorcxManifestURL []string
+	flagURLRewrites      []string
+	flagBundleDir        string
+	flagAddonKeyrings    []string
+	flagManifestKeys     []string
+	flagAddonKeys        []string
+	flagPlanOutput       string
+	flagFallbackRange    string
 )
 
 // Init initializes the CLI environment for tectonic-torcx multicall
@@ -39,6 +50,12 @@ func Init() error {
 
 	multicall.AddCobra(BootstrapCmd.Use, BootstrapCmd)
 	multicall.AddCobra(HookPreCmd.Use, HookPreCmd)
+	multicall.AddCobra(StatusCmd.Use, StatusCmd)
+	multicall.AddCobra(VerifyCmd.Use, VerifyCmd)
+	multicall.AddCobra(BundleCmd.Use, BundleCmd)
+	multicall.AddCobra(MirrorCmd.Use, MirrorCmd)
+	multicall.AddCobra(MappingsCmd.Use, MappingsCmd)
+	multicall.AddCobra(CheckCmd.Use, CheckCmd)
 
 	return nil
 }
@@ -51,6 +68,12 @@ func MultiExecute() error {
 func init() {
 	bootstrapInit()
 	hookPreInit()
+	statusInit()
+	verifyInit()
+	bundleInit()
+	mirrorInit()
+	mappingsInit()
+	checkInit()
 }
 
 func commonFlags(f *pflag.FlagSet) {
@@ -58,15 +81,61 @@ func commonFlags(f *pflag.FlagSet) {
 
 	f.StringVar(&cfg.Kubeconfig, "kubeconfig", "/etc/kubernetes/kubeconfig", "path to kubeconfig")
 	f.StringVar(&cfg.TorcxBin, "torcx-bin", tb, "path to torcx")
-	f.StringVar(&flagTorcxManifestURL, "torcx-manifest-url", internal.ManifestURLTemplate, "URL (template) for torcx package manifest")
+	f.StringVar(&cfg.TorcxBackend, "torcx-backend", internal.TorcxBackendExec, "how to manage torcx profiles and stores, one of: exec (run torcx-bin), native (directly on disk)")
+	f.StringArrayVar(&flagTorcxManifestURL, "torcx-manifest-url", []string{internal.ManifestURLTemplate}, "URL (template) for torcx package manifest, can be repeated to try several in order")
+	f.StringArrayVar(&flagURLRewrites, "url-rewrite", nil, "rewrite remote URLs starting with a prefix to a mirror, as from=to; can be repeated, the original URL is tried last")
+	f.StringVar(&cfg.ManifestCacheDir, "manifest-cache-dir", internal.ManifestCacheDir, "directory to cache package manifests in across runs, empty to disable")
+	f.StringVar(&flagBundleDir, "bundle-dir", "", "directory of an imported bundle, to fetch manifests and addons from before remote URLs")
 	f.StringVar(&cfg.ProfileName, "torcx-profile", TectonicTorcxProfile, "torcx profile to create, if needed")
 	f.StringVar(&cfg.ForceKubeVersion, "force-kube-version", "", "force a kubernetes version, rather than determining from the apiserver")
 	f.BoolVar(&cfg.NoVerifySig, "no-verify-signatures", false, "don't gpg-verify remote assets")
-	f.StringVar(&cfg.GpgKeyringPath, "keyring", "/pubring.gpg", "path to the gpg keyring")
+	f.StringVar(&cfg.GpgKeyringPath, "keyring", "/pubring.gpg", "path to the gpg keyring, either an armored file or a directory of them")
+	f.StringArrayVar(&flagManifestKeys, "manifest-key", nil, "fingerprint of a key trusted to sign package manifests, can be repeated (default: any key in the keyring)")
+	f.StringArrayVar(&flagAddonKeys, "addon-key", nil, "fingerprint of a key trusted to sign addons, can be repeated (default: any key in the keyring)")
+	f.StringVar(&cfg.AddonSignaturePolicy, "addon-signature-policy", internal.AddonSignatureOff, "verification of detached signatures on addon archives, one of: required, if-present, off")
+	f.StringArrayVar(&flagAddonKeyrings, "addon-keyring", nil, "keyring for a package's addon signatures, as name=path; can be repeated (default: --keyring)")
 	f.StringVar(&cfg.VersionManifestPath, "version-manifest", "", "path to the runtime-mappings manifest file")
+	f.StringVar(&cfg.MappingsNamespace, "mappings-namespace", internal.ConfigMapNamespace, "namespace of the runtime-mappings ConfigMap(s)")
+	f.StringVar(&cfg.MappingsConfigMap, "mappings-configmap", internal.ConfigMapName, "name of the runtime-mappings ConfigMap, empty to only use --mappings-selector")
+	f.StringVar(&cfg.MappingsKey, "mappings-key", internal.ConfigMapKey, "key of the runtime mappings in ConfigMaps")
+	f.StringVar(&cfg.MappingsSelector, "mappings-selector", "", "label selector for more runtime-mappings ConfigMaps to merge, by descending "+internal.MappingsPriorityAnnotation+" annotation")
+	f.StringVar(&cfg.MappingsSource, "mappings-source", internal.MappingsSourceConfigMap, "where to read runtime mappings from on the api-server, one of: configmap, crd")
+	f.StringVar(&cfg.MappingsResource, "mappings-resource", internal.TorcxRuntimeMappingName, "name of the TorcxRuntimeMapping, with --mappings-source=crd")
+	f.BoolVar(&cfg.MappingsStatusInObject, "mappings-status-in-object", false, "write the TorcxRuntimeMapping status as part of the object if the api-server has no status subresource (requires nodes to be allowed to patch it)")
+	f.StringVar(&cfg.VersionFallback, "version-fallback", internal.FallbackFail, "what to install when no preferred version is available, one of: fail, os-default, newest")
+	f.StringVar(&flagFallbackRange, "version-fallback-range", "", "versions the newest fallback may pick from, e.g. \">=17.03 <17.10\" (default: any)")
+	f.BoolVar(&cfg.OmahaLookup, "omaha-lookup", false, "ask the update server for the next OS version, when update_engine has not staged an update yet")
+	f.StringVar(&cfg.OSUpdateStateFile, "os-update-state-file", internal.OSUpdateStateFile, "file where the progress of OS updates is written (empty to disable)")
+	f.DurationVar(&cfg.FetchTimeout, "fetch-timeout", 30*time.Minute, "overall deadline for downloading a single asset, including retries (0 for none)")
+	f.DurationVar(&cfg.FetchRequestTimeout, "fetch-request-timeout", 10*time.Minute, "deadline for a single HTTP request; interrupted downloads are resumed (0 for none)")
 	f.StringVar(&verbose, "verbose", "info", "verbosity level")
 }
 
+// dryRunFlags adds the options for commands supporting a dry-run mode
+func dryRunFlags(f *pflag.FlagSet) {
+	f.BoolVar(&cfg.DryRun, "dry-run", false, "only print the planned changes, without performing them")
+	f.StringVar(&flagPlanOutput, "plan-output", "text", "dry-run plan output format, one of: text, json")
+}
+
+// printPlan writes the dry-run plan recorded by the app to stdout.
+func printPlan(app *internal.App) error {
+	if !app.Conf.DryRun {
+		return nil
+	}
+
+	switch flagPlanOutput {
+	case "json":
+		out, err := json.MarshalIndent(app.Plan, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to encode plan")
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	default:
+		fmt.Fprint(os.Stdout, app.Plan.String())
+	}
+	return nil
+}
+
 // parseFlags parses CLI options, returning a populated configuration for
 // the bootstrap agent. It takes the path to the version manifest containing runtime
 // mappings (consumed by hook logic and used as fallback by the bootstrapper).
@@ -91,19 +160,72 @@ func parseFlags(defaultRuntimeMappingsPath string) (internal.Config, error) {
 		return zero, errors.New("keyring path required")
 	}
 
-	if flagTorcxManifestURL == "" {
-		flagTorcxManifestURL = internal.ManifestURLTemplate
+	if len(flagTorcxManifestURL) == 0 {
+		flagTorcxManifestURL = []string{internal.ManifestURLTemplate}
 	}
 
-	tmpl, err := template.New("TorcxManifestURL").Parse(flagTorcxManifestURL)
-	if err != nil {
-		return zero, errors.Wrap(err, "error parsing URL template")
+	cfg.TorcxManifestURLs = nil
+	cfg.URLRewrites = nil
+	manifestURLs := flagTorcxManifestURL
+	if flagBundleDir != "" {
+		index, err := internal.ReadBundleIndex(flagBundleDir)
+		if err != nil {
+			return zero, err
+		}
+		tmpl, err := internal.BundleManifestURLTemplate(flagBundleDir)
+		if err != nil {
+			return zero, err
+		}
+		manifestURLs = append([]string{tmpl}, manifestURLs...)
+		rws, err := index.URLRewrites(flagBundleDir)
+		if err != nil {
+			return zero, err
+		}
+		cfg.URLRewrites = append(cfg.URLRewrites, rws...)
+	}
+
+	for _, u := range manifestURLs {
+		tmpl, err := template.New("TorcxManifestURL").Parse(u)
+		if err != nil {
+			return zero, errors.Wrapf(err, "error parsing URL template %q", u)
+		}
+		cfg.TorcxManifestURLs = append(cfg.TorcxManifestURLs, tmpl)
+	}
+
+	for _, rule := range flagURLRewrites {
+		rw, err := internal.ParseURLRewrite(rule)
+		if err != nil {
+			return zero, err
+		}
+		cfg.URLRewrites = append(cfg.URLRewrites, rw)
+	}
+
+	cfg.TrustedKeys = map[string][]string{
+		internal.ArtifactManifest: flagManifestKeys,
+		internal.ArtifactAddon:    flagAddonKeys,
+	}
+
+	cfg.AddonKeyrings = map[string]string{}
+	for _, rule := range flagAddonKeyrings {
+		name, path, err := internal.ParseAddonKeyring(rule)
+		if err != nil {
+			return zero, err
+		}
+		cfg.AddonKeyrings[name] = path
 	}
-	cfg.TorcxManifestURL = tmpl
 
 	if cfg.VersionManifestPath == "" {
 		cfg.VersionManifestPath = defaultRuntimeMappingsPath
 	}
 
+	cfg.VersionFallbackRange, err = internal.ParseVersionRange(flagFallbackRange)
+	if err != nil {
+		return zero, err
+	}
+
+	if cfg.DryRun && flagPlanOutput != "text" && flagPlanOutput != "json" {
+		return zero, errors.Errorf("unknown plan output format %q", flagPlanOutput)
+	}
+
 	return cfg, nil
 }
@@ -15,6 +15,8 @@
 package cli
 
 import (
+	"time"
+
 	"github.com/coreos/tectonic-torcx/internal"
 	"github.com/spf13/cobra"
 )
@@ -35,11 +37,17 @@ var (
 
 func bootstrapInit() {
 	commonFlags(BootstrapCmd.Flags())
+	dryRunFlags(BootstrapCmd.Flags())
 
 	// We configure the bootstrap systemd unit to only start if this file doesn't exist
 	BootstrapCmd.Flags().StringVar(&cfg.KubeletEnvPath, "kubelet-env-path", "/etc/kubernetes/kubelet.env", "path to write kube.version file")
 	BootstrapCmd.Flags().BoolVar(&cfg.OSUpgrade, "upgrade-os", true, "trigger an OS upgrade on bootstrap")
+	BootstrapCmd.Flags().DurationVar(&cfg.OSUpdateTimeout, "os-update-timeout", time.Hour, "overall deadline for the OS upgrade (0 for none)")
+	BootstrapCmd.Flags().DurationVar(&cfg.OSUpdateStallTimeout, "os-update-stall-timeout", 15*time.Minute, "how long update_engine may stay in the same state without progress (0 for no limit)")
+	BootstrapCmd.Flags().IntVar(&cfg.OSUpdateRetries, "os-update-retries", 3, "how many times to retry the OS upgrade after an update_engine error")
+	BootstrapCmd.Flags().StringVar(&cfg.OSUpdateFailurePolicy, "os-update-failure-policy", internal.OSUpdateFail, "what to do when the OS upgrade fails, times out or stalls, one of: fail, continue")
 	BootstrapCmd.Flags().BoolVar(&cfg.SkipTorcxSetup, "torcx-skip-setup", false, "skip torcx addons fetching and profile setup")
+	BootstrapCmd.Flags().StringVar(&cfg.NodeName, "node-name", "", "our node name, to report OS update progress and selected versions with --mappings-source=crd")
 }
 
 func runBootstrap(cmd *cobra.Command, args []string) error {
@@ -53,5 +61,9 @@ func runBootstrap(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	return app.Bootstrap()
+	err = app.Bootstrap()
+	if perr := printPlan(app); perr != nil {
+		return perr
+	}
+	return err
 }
@@ -0,0 +1,127 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// BundleCmd is the top-level cobra command for `tectonic-torcx-bundle`
+	BundleCmd = &cobra.Command{
+		Use:          "tectonic-torcx-bundle",
+		SilenceUsage: true,
+	}
+	bundleExportCmd = &cobra.Command{
+		Use:          "export",
+		Short:        "Fetch manifests and addons into a bundle tarball",
+		RunE:         runBundleExport,
+		SilenceUsage: true,
+	}
+	bundleImportCmd = &cobra.Command{
+		Use:          "import",
+		Short:        "Unpack and verify a bundle tarball, to be used via --bundle-dir",
+		RunE:         runBundleImport,
+		SilenceUsage: true,
+	}
+	bundleBoard      string
+	bundleOSVersions []string
+	bundleFile       string
+	bundleImportDir  string
+)
+
+func bundleInit() {
+	commonFlags(bundleExportCmd.Flags())
+	bundleExportCmd.Flags().StringVar(&bundleBoard, "board", "amd64-usr", "board to export manifests for")
+	bundleExportCmd.Flags().StringArrayVar(&bundleOSVersions, "os-version", nil, "OS version to export manifests and addons for, can be repeated")
+	bundleExportCmd.Flags().StringVar(&bundleFile, "output", "tectonic-torcx-bundle.tgz", "path of the bundle tarball to write")
+
+	commonFlags(bundleImportCmd.Flags())
+	bundleImportCmd.Flags().StringVar(&bundleFile, "bundle", "tectonic-torcx-bundle.tgz", "path of the bundle tarball to import")
+	bundleImportCmd.Flags().StringVar(&bundleImportDir, "dir", internal.BundleDir, "directory to unpack the bundle into")
+
+	BundleCmd.AddCommand(bundleExportCmd, bundleImportCmd)
+}
+
+func runBundleExport(cmd *cobra.Command, args []string) error {
+	if len(bundleOSVersions) == 0 {
+		return errors.New("at least one OS version required")
+	}
+
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	conf.SkipTorcxSetup = true
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+	app.Board = bundleBoard
+
+	fp, err := os.Create(bundleFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to create bundle")
+	}
+	sink := internal.NewTarSink(fp)
+
+	index, err := app.Export(sink, bundleOSVersions)
+	if err == nil {
+		err = sink.Close()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(bundleFile)
+		return err
+	}
+
+	logrus.Infof("Wrote %d manifest(s) and %d addon(s) to %s", len(index.Manifests), len(index.Addons), bundleFile)
+	return nil
+}
+
+func runBundleImport(cmd *cobra.Command, args []string) error {
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	conf.SkipTorcxSetup = true
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(bundleFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to open bundle")
+	}
+	defer fp.Close()
+
+	index, err := app.ImportBundle(fp, bundleImportDir)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Imported %d manifest(s) and %d addon(s) for board %s into %s", len(index.Manifests), len(index.Addons), index.Board, bundleImportDir)
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// CheckCmd is the top-level cobra command for `tectonic-torcx-check`
+	CheckCmd = &cobra.Command{
+		Use:          "tectonic-torcx-check",
+		Short:        "Check that runtime versions are available for the next OS version",
+		RunE:         runCheck,
+		SilenceUsage: true,
+	}
+	checkOSVersion string
+	checkOutput    string
+)
+
+func checkInit() {
+	commonFlags(CheckCmd.Flags())
+
+	CheckCmd.Flags().StringVar(&checkOSVersion, "os-version", "", "OS version to check, instead of the one staged by update_engine")
+	CheckCmd.Flags().StringVar(&checkOutput, "output", "text", "output format, one of: text, json")
+	CheckCmd.Flags().BoolVar(&cfg.MappingsFromAPIServer, "mappings-from-api", false, "read runtime mappings from the api-server ConfigMap(s), falling back to --version-manifest")
+}
+
+func runCheck(cmd *cobra.Command, args []string) error {
+	if checkOutput != "text" && checkOutput != "json" {
+		return errors.Errorf("unknown output format %q", checkOutput)
+	}
+
+	conf, err := parseFlags(internal.CluoRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	// Nothing is changed on the node, not even the manifest cache
+	conf.SkipTorcxSetup = true
+	conf.ManifestCacheReadOnly = true
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+
+	report, err := app.CheckNextOS(checkOSVersion)
+	if err != nil {
+		return err
+	}
+
+	switch checkOutput {
+	case "json":
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to encode report")
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	default:
+		fmt.Fprint(os.Stdout, report.String())
+	}
+
+	if report.Blocked() {
+		return errors.Errorf("no compatible runtime for OS version %s", report.OSVersion)
+	}
+	return nil
+}
@@ -38,10 +38,14 @@ var (
 
 func hookPreInit() {
 	commonFlags(HookPreCmd.Flags())
+	dryRunFlags(HookPreCmd.Flags())
 
 	HookPreCmd.Flags().StringVar(&cfg.WriteNodeAnnotation, "node-annotation", "", "Node annotation to write after successful operation")
 	HookPreCmd.Flags().StringVar(&cfg.NodeName, "node-name", "", "Our node name")
 	HookPreCmd.Flags().IntVar(&sleep, "sleep", 0, "sleep N seconds after success")
+	HookPreCmd.Flags().BoolVar(&cfg.MappingsFromAPIServer, "mappings-from-api", false, "read runtime mappings from the api-server ConfigMap(s), falling back to --version-manifest")
+	HookPreCmd.Flags().BoolVar(&cfg.GateOSUpdate, "gate-os-update", false, "block the staged OS update if no runtime version is available for it")
+	HookPreCmd.Flags().BoolVar(&cfg.GateResetUpdate, "gate-reset-update", false, "with --gate-os-update, also reset a blocked OS update in update_engine")
 }
 
 func runHookPre(cmd *cobra.Command, args []string) error {
@@ -71,11 +75,14 @@ func runHookPre(cmd *cobra.Command, args []string) error {
 	}
 
 	err = app.UpdateHook()
+	if perr := printPlan(app); perr != nil {
+		return perr
+	}
 	if err != nil {
 		return err
 	}
 
-	if sleep > 0 {
+	if sleep > 0 && !conf.DryRun {
 		logrus.Info("Pre-reboot hook complete, sleeping forever")
 		for {
 			time.Sleep(time.Duration(sleep) * time.Second)
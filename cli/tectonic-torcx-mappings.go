@@ -0,0 +1,119 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// MappingsCmd is the top-level cobra command for `tectonic-torcx-mappings`
+	MappingsCmd = &cobra.Command{
+		Use:          "tectonic-torcx-mappings",
+		SilenceUsage: true,
+	}
+	mappingsLintCmd = &cobra.Command{
+		Use:          "lint",
+		Short:        "Check runtime mappings against published package manifests",
+		RunE:         runMappingsLint,
+		SilenceUsage: true,
+	}
+	mappingsBoard          string
+	mappingsOSVersions     []string
+	mappingsOSVersionRange string
+	mappingsMirrorDir      string
+	mappingsOutput         string
+)
+
+func mappingsInit() {
+	commonFlags(mappingsLintCmd.Flags())
+	mappingsLintCmd.Flags().StringVar(&mappingsBoard, "board", "amd64-usr", "board to check")
+	mappingsLintCmd.Flags().StringArrayVar(&mappingsOSVersions, "os-version", nil, "OS version to check, can be repeated")
+	mappingsLintCmd.Flags().StringVar(&mappingsOSVersionRange, "os-version-range", "", "check all OS versions in --mirror-dir within a range, e.g. \">=1520.0.0 <1600.0.0\"")
+	mappingsLintCmd.Flags().StringVar(&mappingsMirrorDir, "mirror-dir", "", "local mirror directory to list OS versions from, for --os-version-range")
+	mappingsLintCmd.Flags().StringVar(&mappingsOutput, "output", "text", "output format, one of: text, json")
+
+	MappingsCmd.AddCommand(mappingsLintCmd)
+}
+
+func runMappingsLint(cmd *cobra.Command, args []string) error {
+	if mappingsOutput != "text" && mappingsOutput != "json" {
+		return errors.Errorf("unknown output format %q", mappingsOutput)
+	}
+
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	conf.SkipTorcxSetup = true
+	// Linting is read-only, e.g. in a release pipeline
+	conf.ManifestCacheReadOnly = true
+
+	osVersions := mappingsOSVersions
+	if mappingsOSVersionRange != "" {
+		if mappingsMirrorDir == "" {
+			return errors.New("--os-version-range requires --mirror-dir")
+		}
+		r, err := internal.ParseVersionRange(mappingsOSVersionRange)
+		if err != nil {
+			return err
+		}
+		available, err := internal.MirrorOSVersions(mappingsMirrorDir, mappingsBoard)
+		if err != nil {
+			return err
+		}
+		for _, v := range available {
+			if r.Contains(v) {
+				osVersions = append(osVersions, v)
+			}
+		}
+	}
+	if len(osVersions) == 0 {
+		return errors.New("at least one OS version required")
+	}
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+	app.Board = mappingsBoard
+
+	report, err := app.LintMappings(osVersions)
+	if err != nil {
+		return err
+	}
+
+	switch mappingsOutput {
+	case "json":
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to encode report")
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	default:
+		fmt.Fprint(os.Stdout, report.String())
+	}
+
+	if n := report.Problems(); n > 0 {
+		return errors.Errorf("runtime mappings have %d problem(s)", n)
+	}
+	return nil
+}
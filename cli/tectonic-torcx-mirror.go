@@ -0,0 +1,97 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// MirrorCmd is the top-level cobra command for `tectonic-torcx-mirror`
+	MirrorCmd = &cobra.Command{
+		Use:          "tectonic-torcx-mirror",
+		SilenceUsage: true,
+	}
+	mirrorServeCmd = &cobra.Command{
+		Use:          "serve",
+		Short:        "Serve a mirror directory with the upstream URL layout",
+		RunE:         runMirrorServe,
+		SilenceUsage: true,
+	}
+	mirrorSyncCmd = &cobra.Command{
+		Use:          "sync",
+		Short:        "Populate a mirror directory from upstream",
+		RunE:         runMirrorSync,
+		SilenceUsage: true,
+	}
+	mirrorDir        string
+	mirrorListen     string
+	mirrorBoards     []string
+	mirrorOSVersions []string
+)
+
+func mirrorInit() {
+	mirrorServeCmd.Flags().StringVar(&mirrorDir, "dir", "/srv/tectonic-torcx", "mirror directory")
+	mirrorServeCmd.Flags().StringVar(&mirrorListen, "listen", ":8080", "address to listen on")
+	mirrorServeCmd.Flags().StringVar(&verbose, "verbose", "info", "verbosity level")
+
+	commonFlags(mirrorSyncCmd.Flags())
+	mirrorSyncCmd.Flags().StringVar(&mirrorDir, "dir", "/srv/tectonic-torcx", "mirror directory")
+	mirrorSyncCmd.Flags().StringArrayVar(&mirrorBoards, "board", []string{"amd64-usr"}, "board to sync, can be repeated")
+	mirrorSyncCmd.Flags().StringArrayVar(&mirrorOSVersions, "os-version", nil, "OS version to sync, can be repeated")
+
+	MirrorCmd.AddCommand(mirrorServeCmd, mirrorSyncCmd)
+}
+
+func runMirrorServe(cmd *cobra.Command, args []string) error {
+	lvl, err := logrus.ParseLevel(verbose)
+	if err != nil {
+		return errors.Wrap(err, "invalid verbosity level")
+	}
+	logrus.SetLevel(lvl)
+
+	logrus.Infof("Serving %s on %s", mirrorDir, mirrorListen)
+	return http.ListenAndServe(mirrorListen, internal.MirrorHandler(mirrorDir))
+}
+
+func runMirrorSync(cmd *cobra.Command, args []string) error {
+	if len(mirrorOSVersions) == 0 {
+		return errors.New("at least one OS version required")
+	}
+
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	conf.SkipTorcxSetup = true
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+
+	index, err := app.SyncMirror(mirrorDir, mirrorBoards, mirrorOSVersions)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Synced %d manifest(s) and %d addon(s) into %s", len(index.Manifests), len(index.Addons), mirrorDir)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// StatusCmd is the top-level cobra command for `tectonic-torcx-status`
+	StatusCmd = &cobra.Command{
+		Use:          "tectonic-torcx-status",
+		RunE:         runStatus,
+		SilenceUsage: true,
+	}
+	statusOutput    string
+	statusLocalOnly bool
+)
+
+func statusInit() {
+	commonFlags(StatusCmd.Flags())
+
+	StatusCmd.Flags().StringVar(&statusOutput, "output", "json", "output format, one of: json, yaml")
+	StatusCmd.Flags().BoolVar(&statusLocalOnly, "local-only", false, "only use node-local sources, as the pre-reboot hook does")
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	if statusOutput != "json" && statusOutput != "yaml" {
+		return errors.Errorf("unknown output format %q", statusOutput)
+	}
+
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+	// Nothing is changed on the node, not even the manifest cache
+	conf.ManifestCacheReadOnly = true
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+
+	st := app.Status(statusLocalOnly)
+
+	var out []byte
+	switch statusOutput {
+	case "yaml":
+		out, err = yaml.Marshal(st)
+	default:
+		out, err = json.MarshalIndent(st, "", "  ")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to encode status")
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/coreos/tectonic-torcx/internal"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// VerifyCmd is the top-level cobra command for `tectonic-torcx-verify`
+	VerifyCmd = &cobra.Command{
+		Use:          "tectonic-torcx-verify",
+		RunE:         runVerify,
+		SilenceUsage: true,
+	}
+	verifyRepair bool
+)
+
+func verifyInit() {
+	commonFlags(VerifyCmd.Flags())
+
+	VerifyCmd.Flags().BoolVar(&verifyRepair, "repair", false, "fetch again corrupted or missing store entries")
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	conf, err := parseFlags(internal.InstallerRuntimeMappings)
+	if err != nil {
+		return err
+	}
+
+	app, err := internal.NewApp(conf)
+	if err != nil {
+		return err
+	}
+
+	report, err := app.Verify(verifyRepair)
+	if report != nil {
+		out, merr := json.MarshalIndent(report, "", "  ")
+		if merr != nil {
+			return errors.Wrap(merr, "failed to encode report")
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	}
+	return err
+}
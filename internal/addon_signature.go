@@ -0,0 +1,90 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Policies for detached signatures on addon archives
+const (
+	// AddonSignatureRequired rejects addons without a valid signature
+	AddonSignatureRequired = "required"
+	// AddonSignatureIfPresent verifies signatures when published
+	AddonSignatureIfPresent = "if-present"
+	// AddonSignatureOff only relies on the manifest hash
+	AddonSignatureOff = "off"
+)
+
+// ParseAddonKeyring parses a per-package keyring in the "name=path" form
+func ParseAddonKeyring(rule string) (string, string, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid addon keyring %q, expected name=path", rule)
+	}
+	return parts[0], parts[1], nil
+}
+
+// validAddonSignaturePolicy returns true if policy is known; empty
+// means AddonSignatureOff.
+func validAddonSignaturePolicy(policy string) bool {
+	switch policy {
+	case AddonSignatureRequired, AddonSignatureIfPresent, AddonSignatureOff, "":
+		return true
+	}
+	return false
+}
+
+// addonKeyring returns the keyring to verify a package's addons with
+func (a *App) addonKeyring(name string) string {
+	if path, ok := a.Conf.AddonKeyrings[name]; ok {
+		return path
+	}
+	return a.Conf.GpgKeyringPath
+}
+
+// verifyAddonSignature checks the detached signature published at
+// "$url.asc" for the addon downloaded to fp, according to the addon
+// signature policy. This is independent of manifest verification.
+func (a *App) verifyAddonSignature(url string, v *PackageVersion, fp *os.File) error {
+	policy := a.Conf.AddonSignaturePolicy
+	if policy == "" || policy == AddonSignatureOff {
+		return nil
+	}
+
+	sig, err := a.fetchURL(url + ".asc")
+	if err != nil {
+		if policy == AddonSignatureIfPresent && isNotFound(err) {
+			logrus.Warnf("No signature published for %s, relying on manifest hash only", url)
+			return nil
+		}
+		return errors.Wrapf(err, "could not fetch addon signature at %s.asc", url)
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to seek addon")
+	}
+	name := v.Package.Name
+	if err := a.checkSignature(a.addonKeyring(name), ArtifactAddon, url, fp, bytes.NewReader(sig)); err != nil {
+		return errors.Wrapf(err, "invalid signature for %s", url)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddonSignaturePolicy(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defaultKeyring := filepath.Join(tmpDir, "pubring.gpg")
+	dockerKeyring := filepath.Join(tmpDir, "docker.gpg")
+	defaultSigner := newTestSigner(t, defaultKeyring)
+	dockerSigner := newTestSigner(t, dockerKeyring)
+
+	content := []byte("docker addon\n")
+	var sig []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docker:17.03.torcx.tgz":
+			w.Write(content)
+		case "/docker:17.03.torcx.tgz.asc":
+			if sig == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	m := makeRemoteManifest("17.03", ts.URL+"/docker:17.03.torcx.tgz", content)
+	loc, err := m.LocationFor("docker", "17.03")
+	assert.Nil(err)
+
+	fetch := func(policy string, keyrings map[string]string) error {
+		a := App{Conf: Config{
+			// Manifest verification does not affect addon signatures
+			NoVerifySig:          true,
+			GpgKeyringPath:       defaultKeyring,
+			AddonSignaturePolicy: policy,
+			AddonKeyrings:        keyrings,
+			torcxStoreDir:        filepath.Join(tmpDir, "store"),
+		}}
+		path, err := a.FetchAddon(loc)
+		if err == nil {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	// No signature published
+	assert.Nil(fetch(AddonSignatureOff, nil))
+	assert.Nil(fetch(AddonSignatureIfPresent, nil))
+	assert.NotNil(fetch(AddonSignatureRequired, nil))
+
+	// Valid signature
+	sig = testSign(t, defaultSigner, content)
+	assert.Nil(fetch(AddonSignatureIfPresent, nil))
+	assert.Nil(fetch(AddonSignatureRequired, nil))
+
+	// Signature of something else
+	sig = testSign(t, defaultSigner, []byte("tampered"))
+	assert.Nil(fetch(AddonSignatureOff, nil))
+	assert.NotNil(fetch(AddonSignatureIfPresent, nil))
+	assert.NotNil(fetch(AddonSignatureRequired, nil))
+
+	// Per-package keyrings
+	sig = testSign(t, dockerSigner, content)
+	assert.NotNil(fetch(AddonSignatureRequired, nil))
+	assert.Nil(fetch(AddonSignatureRequired, map[string]string{"docker": dockerKeyring}))
+	assert.NotNil(fetch(AddonSignatureRequired, map[string]string{"docker": defaultKeyring}))
+	assert.NotNil(fetch(AddonSignatureRequired, map[string]string{"other": dockerKeyring}))
+}
+
+func TestParseAddonKeyring(t *testing.T) {
+	assert := assert.New(t)
+
+	name, path, err := ParseAddonKeyring("docker=/etc/torcx/docker.gpg")
+	assert.Nil(err)
+	assert.Equal("docker", name)
+	assert.Equal("/etc/torcx/docker.gpg", path)
+
+	_, _, err = ParseAddonKeyring("docker")
+	assert.NotNil(err)
+	_, _, err = ParseAddonKeyring("=path")
+	assert.NotNil(err)
+}
@@ -16,6 +16,7 @@ package internal
 
 import (
 	"text/template"
+	"time"
 
 	"github.com/coreos/go-systemd/dbus"
 	"github.com/pkg/errors"
@@ -31,26 +32,56 @@ type App struct {
 
 	CurrentOSVersion string
 	NextOSVersion    string
+	// Where the next OS version was determined from, one of
+	// NextOSVersionUpdateEngine or NextOSVersionOmaha
+	NextOSVersionSource string
 
 	K8sVersion string
+	// Where the kubernetes version was determined from
+	K8sVersionSource string
 
-	// Preferred docker versions
-	DockerVersions []string
+	// Preferred versions of each runtime component, from runtime mappings
+	RuntimeVersions map[string][]string
 
-	// Whether a node reboot is required to finalize a docker upgrade.
-	DockerRequiresReboot bool
+	// Fallback versions picked for packages, when none of the preferred
+	// versions was available
+	Fallbacks map[string]VersionFallback
+
+	// Runtime components whose change requires a node reboot to finalize.
+	RebootRequiredBy []string
 	// Whether a node reboot is required to finalize an OS upgrade.
 	OSRequiresReboot bool
 
+	// Side effects recorded in dry-run mode
+	Plan Plan
+
 	packageManifestCache map[string]*PackageManifest
+
+	// Health of remote mirrors, to try failing ones last
+	mirrors *mirrorHealth
+
+	torcx TorcxClient
 }
 
 type Config struct {
 	// Path to the torcx binary
 	TorcxBin string
 
-	// Templated URL to torcx package manifest
-	TorcxManifestURL *template.Template
+	// How to drive torcx, either TorcxBackendExec or TorcxBackendNative
+	TorcxBackend string
+
+	// Templated URLs to torcx package manifest, tried in order
+	TorcxManifestURLs []*template.Template
+
+	// Where to cache package manifests across runs (empty to disable)
+	ManifestCacheDir string
+	// If true, cached manifests are used but the cache is not written,
+	// for commands without side effects
+	ManifestCacheReadOnly bool
+
+	// Prefix rewrites for remote manifest and addon URLs, e.g. to use
+	// a local mirror. The original URL is tried last.
+	URLRewrites []URLRewrite
 
 	// The torcx profile name to create (if no others exist)
 	ProfileName string
@@ -67,12 +98,55 @@ type Config struct {
 	// If true, do an OS upgrade before proceeding
 	OSUpgrade bool
 
+	// If true, ask the update server for the next OS version when
+	// update_engine has not staged one yet
+	OmahaLookup bool
+
+	// Overall deadline for an OS update (0 for none)
+	OSUpdateTimeout time.Duration
+	// How long update_engine may stay in the same state without progress
+	// (0 for no limit)
+	OSUpdateStallTimeout time.Duration
+	// How many times to trigger an OS update again after an error
+	OSUpdateRetries int
+	// What to do when an OS update fails, times out or stalls, one of
+	// OSUpdateFail, OSUpdateContinue
+	OSUpdateFailurePolicy string
+	// Where to write the progress of OS updates (empty to disable)
+	OSUpdateStateFile string
+
+	// If true, the pre-reboot hook blocks a staged OS update for which
+	// no version of a runtime component is available
+	GateOSUpdate bool
+	// If true, a blocked OS update is also reset in update_engine
+	GateResetUpdate bool
+
 	// If false (default), gpg-verify all fetched images
 	NoVerifySig bool
 
 	// The path to the gpg keyring to validate
 	GpgKeyringPath string
 
+	// Whether to verify detached signatures on addon archives, one of
+	// AddonSignatureRequired, AddonSignatureIfPresent, AddonSignatureOff.
+	// This is independent of NoVerifySig.
+	AddonSignaturePolicy string
+
+	// Per-package keyrings for addon signatures, defaulting to GpgKeyringPath
+	AddonKeyrings map[string]string
+
+	// Fingerprints of the keys trusted to sign each type of artifact
+	// (ArtifactManifest, ArtifactAddon). Any key in the keyring is trusted
+	// for a type without fingerprints.
+	TrustedKeys map[string][]string
+
+	// What to do when none of the preferred package versions is
+	// available, one of FallbackFail, FallbackOSDefault, FallbackNewest
+	VersionFallback string
+
+	// Versions FallbackNewest may pick from (empty for any)
+	VersionFallbackRange VersionRange
+
 	// The node annotation to set to indicate completion
 	// This also causes the process to never exit
 	WriteNodeAnnotation string
@@ -83,28 +157,101 @@ type Config struct {
 	// The torcx store path - this is only used for testing
 	torcxStoreDir string
 
+	// The torcx client - this is only used for testing
+	torcxClient TorcxClient
+
+	// The update_engine client - this is only used for testing
+	updateEngine UpdateEngine
+
 	// The path to the version manifest
 	VersionManifestPath string
 
+	// The runtime-mappings ConfigMap on the api-server: namespace, name and
+	// key, plus an optional label selector for more ConfigMaps to merge
+	MappingsNamespace string
+	MappingsConfigMap string
+	MappingsKey       string
+	MappingsSelector  string
+
+	// If true, the pre-reboot hook also reads runtime mappings from the
+	// api-server, before the local file
+	MappingsFromAPIServer bool
+
+	// Where to read runtime mappings from on the api-server, either
+	// MappingsSourceConfigMap or MappingsSourceCRD
+	MappingsSource string
+
+	// The TorcxRuntimeMapping to use with MappingsSourceCRD
+	MappingsResource string
+
+	// If true, write the TorcxRuntimeMapping status as part of the object
+	// when the api-server has no status subresource (before Kubernetes 1.10)
+	MappingsStatusInObject bool
+
 	// Whether to skip torcx setup entirely
 	SkipTorcxSetup bool
+
+	// Overall deadline for a single download, including retries (0 for none)
+	FetchTimeout time.Duration
+	// Deadline for a single HTTP request (0 for none)
+	FetchRequestTimeout time.Duration
+
+	// If true, record side effects in the App plan instead of performing them
+	DryRun bool
 }
 
 func NewApp(c Config) (*App, error) {
 	if c.torcxStoreDir == "" {
 		c.torcxStoreDir = TORCX_STORE
 	}
+	if c.MappingsNamespace == "" {
+		c.MappingsNamespace = ConfigMapNamespace
+	}
+	if c.MappingsKey == "" {
+		c.MappingsKey = ConfigMapKey
+	}
+	if c.MappingsConfigMap == "" && c.MappingsSelector == "" {
+		c.MappingsConfigMap = ConfigMapName
+	}
+	if c.MappingsResource == "" {
+		c.MappingsResource = TorcxRuntimeMappingName
+	}
 
 	a := App{
 		Conf:                 c,
 		packageManifestCache: map[string]*PackageManifest{},
+		torcx:                c.torcxClient,
 	}
 
-	// Test that torcx exists
-	if !a.Conf.SkipTorcxSetup {
-		err := a.torcxCmd(nil, []string{"help"})
-		if err != nil {
-			return nil, errors.Wrap(err, "could not execute torcx")
+	if !validAddonSignaturePolicy(a.Conf.AddonSignaturePolicy) {
+		return nil, errors.Errorf("unknown addon signature policy %q", a.Conf.AddonSignaturePolicy)
+	}
+
+	if !validVersionFallback(a.Conf.VersionFallback) {
+		return nil, errors.Errorf("unknown version fallback policy %q", a.Conf.VersionFallback)
+	}
+
+	if !validOSUpdateFailurePolicy(a.Conf.OSUpdateFailurePolicy) {
+		return nil, errors.Errorf("unknown OS update failure policy %q", a.Conf.OSUpdateFailurePolicy)
+	}
+
+	if !validMappingsSource(a.Conf.MappingsSource) {
+		return nil, errors.Errorf("unknown runtime mappings source %q", a.Conf.MappingsSource)
+	}
+
+	if !a.Conf.SkipTorcxSetup && a.torcx == nil {
+		switch a.Conf.TorcxBackend {
+		case TorcxBackendNative:
+			a.torcx = newTorcxNative(a.Conf.torcxStoreDir)
+		case TorcxBackendExec, "":
+			// Test that torcx exists
+			tc, err := newTorcxExec(a.Conf.TorcxBin)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not execute torcx")
+			}
+			a.torcx = tc
+		default:
+			return nil, errors.Errorf("unknown torcx backend %q", a.Conf.TorcxBackend)
 		}
 	}
 
@@ -127,11 +274,13 @@ func (a *App) GatherState(localOnly bool, envPath string) error {
 	}
 	logrus.Infof("Detected Kubernetes version %s", a.K8sVersion)
 
-	a.DockerVersions, err = a.VersionFor(localOnly, "docker", a.K8sVersion)
+	a.RuntimeVersions, err = a.RuntimeVersionsFor(localOnly, a.K8sVersion)
 	if err != nil {
 		return err
 	}
-	logrus.Infof("Kubernetes needs Docker version(s) %v", a.DockerVersions)
+	for _, name := range a.componentNames() {
+		logrus.Infof("Kubernetes needs %s version(s) %v", name, a.RuntimeVersions[name])
+	}
 
 	return nil
 }
@@ -142,11 +291,15 @@ func (a *App) GatherState(localOnly bool, envPath string) error {
 // - write kubelet.env
 // - (if required) reboot the system
 func (a *App) Bootstrap() error {
-	dbusConn, err := dbus.New()
-	if err != nil {
-		return errors.Wrap(err, "failed to connect to login1 dbus")
+	var dbusConn *dbus.Conn
+	var err error
+	if !a.Conf.DryRun {
+		dbusConn, err = dbus.New()
+		if err != nil {
+			return errors.Wrap(err, "failed to connect to login1 dbus")
+		}
+		defer dbusConn.Close()
 	}
-	defer dbusConn.Close()
 
 	if err := a.GatherState(false, installerEnvPath); err != nil {
 		return err
@@ -165,14 +318,19 @@ func (a *App) Bootstrap() error {
 	if a.Conf.SkipTorcxSetup {
 		logrus.Warnf("Skipping torcx setup!")
 	} else {
-		dockerVersion, osVersions, err := a.PickVersion("docker", a.DockerVersions)
+		if err := a.RepairStore(a.CurrentOSVersion, a.NextOSVersion); err != nil {
+			return err
+		}
+
+		sels, err := a.SelectAddons()
 		if err != nil {
 			return err
 		}
-		if len(osVersions) > 0 {
-			if err := a.InstallAddon("docker", dockerVersion, osVersions); err != nil {
-				return err
-			}
+		if err := a.InstallAddons(sels); err != nil {
+			return err
+		}
+		if err := a.WriteMappingStatus(sels); err != nil {
+			logrus.Warn("Failed to report runtime mappings status: ", err)
 		}
 	}
 
@@ -183,16 +341,22 @@ func (a *App) Bootstrap() error {
 		}
 	}
 
-	if a.DockerRequiresReboot || a.OSRequiresReboot {
-		// Docker does not support version downgrades, so we need to
-		// clean its datadir before reboot.
-		if a.DockerRequiresReboot {
-			logrus.Debug("docker change detected, cleaning datadir before reboot")
-			if err := a.EnableDockerCleanupUnit(dbusConn); err != nil {
-				logrus.Infof("unable to install docker cleanup unit: %s", err)
+	if len(a.RebootRequiredBy) > 0 || a.OSRequiresReboot {
+		for _, name := range a.RebootRequiredBy {
+			cleanup := policyFor(name).cleanup
+			if cleanup == nil {
+				continue
+			}
+			logrus.Debugf("%s change detected, cleaning up before reboot", name)
+			if err := cleanup(a, dbusConn); err != nil {
+				logrus.Infof("unable to clean up %s: %s", name, err)
 			}
 		}
 
+		if a.dryRun(ActionReboot, "reboot.target", "isolate") {
+			return nil
+		}
+
 		// We trigger a reboot and block here, waiting for init to kill us.
 		c := make(chan string)
 		logrus.Info("node updated, triggering reboot to apply changes")
@@ -207,7 +371,8 @@ func (a *App) Bootstrap() error {
 }
 
 // UpdateHook runs the steps expected for a pre-reboot hook
-// - Install torcx package
+// - Install torcx packages
+// - verify (and repair) store entries used by profiles
 // - gc if possible
 // - write "hook successful" annotation
 func (a *App) UpdateHook() error {
@@ -219,12 +384,30 @@ func (a *App) UpdateHook() error {
 		return err
 	}
 
-	dockerVersion, osVersions, err := a.PickVersion("docker", a.DockerVersions)
+	if a.Conf.GateOSUpdate {
+		if err := a.GateOSUpdate(); err != nil {
+			return err
+		}
+	}
+
+	if err := a.RepairStore(a.CurrentOSVersion, a.NextOSVersion); err != nil {
+		return err
+	}
+
+	sels, err := a.SelectAddons()
 	if err != nil {
 		return err
 	}
-	if len(osVersions) > 0 {
-		if err := a.InstallAddon("docker", dockerVersion, osVersions); err != nil {
+	if err := a.InstallAddons(sels); err != nil {
+		return err
+	}
+	if err := a.WriteMappingStatus(sels); err != nil {
+		logrus.Warn("Failed to report runtime mappings status: ", err)
+	}
+
+	// Nothing was installed in dry-run mode, so there is nothing to verify
+	if !a.Conf.DryRun {
+		if _, err := a.VerifyStore(true); err != nil {
 			return err
 		}
 	}
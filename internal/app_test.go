@@ -0,0 +1,123 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the pre-reboot hook end to end, with fake torcx and update_engine
+func TestUpdateHook(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	osRelease, envPath := osReleasePath, kubeletEnvPath
+	osReleasePath = write("os-release", "VERSION_ID=9998.0.0\nCOREOS_BOARD=amd64-usr\n")
+	kubeletEnvPath = write("kubelet.env", "KUBELET_IMAGE_TAG=v1.8.4_coreos.0\n")
+	defer func() { osReleasePath, kubeletEnvPath = osRelease, envPath }()
+	mappings := write("runtime-mappings.yaml", `kind: VersionManifestV2
+versions:
+  k8s:
+    - range: ">=1.8.0 <1.9.0"
+      docker: ["17.03"]
+`)
+
+	docker := []byte("docker addon\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/docker:17.03.torcx.tgz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(docker)
+	}))
+	defer ts.Close()
+
+	storeDir := filepath.Join(tmpDir, "store")
+	if err := os.MkdirAll(filepath.Join(storeDir, "9997.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	updated := ueStatus(updateengine.UpdateStatusUpdatedNeedReboot)
+	updated.NewVersion = "9999.0.0"
+
+	newApp := func(gate bool) (*App, *fakeTorcx) {
+		ft := newFakeTorcx(storeDir, "9998.0.0")
+		ue := newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil)
+		ue.current = updated
+		a, err := NewApp(Config{
+			VersionManifestPath: mappings,
+			ProfileName:         "tectonic",
+			GateOSUpdate:        gate,
+			torcxStoreDir:       storeDir,
+			torcxClient:         ft,
+			updateEngine:        ue,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := makeRemoteManifest("17.03", ts.URL+"/docker:17.03.torcx.tgz", docker)
+		a.packageManifestCache["9998.0.0"] = m
+		a.packageManifestCache["9999.0.0"] = m
+		return a, ft
+	}
+
+	a, ft := newApp(true)
+	assert.Nil(a.UpdateHook())
+	assert.Equal("9998.0.0", a.CurrentOSVersion)
+	assert.Equal("9999.0.0", a.NextOSVersion)
+	assert.Equal("v1.8.4+coreos.0", a.K8sVersion)
+	assert.Equal([]string{"docker"}, a.RebootRequiredBy)
+	assert.Equal("tectonic", ft.nextProfile)
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "17.03"}}, ft.profileImages("tectonic"))
+	for _, osVersion := range []string{"9998.0.0", "9999.0.0"} {
+		assert.Equal([]string{"docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, osVersion)))
+	}
+	// Stores older than the current OS version are removed
+	assert.Equal([]string{"9998.0.0/", "9999.0.0/"}, listDir(t, storeDir))
+
+	// No docker 17.03 for the next OS version
+	a, ft = newApp(true)
+	a.packageManifestCache["9999.0.0"] = makeManifest([]string{"17.09"})
+	err = a.UpdateHook()
+	assert.Equal(ErrOSUpdateBlocked, errors.Cause(err))
+	assert.Empty(ft.profileImages("tectonic"))
+
+	// Without the gate, selection fails later on
+	a, _ = newApp(false)
+	a.packageManifestCache["9999.0.0"] = makeManifest([]string{"17.09"})
+	err = a.UpdateHook()
+	assert.NotNil(err)
+	assert.NotEqual(ErrOSUpdateBlocked, errors.Cause(err))
+}
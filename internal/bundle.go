@@ -0,0 +1,563 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// BundleDir is the default directory to import bundles into
+	BundleDir = "/var/lib/torcx/tectonic-bundle"
+	// bundleIndexKind is the current type for the bundle index
+	bundleIndexKind = "tectonic-torcx-bundle-v0"
+	// bundleIndexFile is the path of the index within a bundle
+	bundleIndexFile = "index.json"
+)
+
+// ArtifactSink receives the files of an exported bundle. Paths are
+// relative and follow the upstream URL layout, so that a sink content
+// can be served as-is in place of the upstream bucket.
+type ArtifactSink interface {
+	// Add stores size bytes read from r at a relative path
+	Add(path string, r io.Reader, size int64) error
+	// Close finalizes the sink
+	Close() error
+}
+
+// artifactChecker is implemented by sinks which may already hold some
+// addons, so that they are not fetched again.
+type artifactChecker interface {
+	// Has returns true if the addon at path matches the package version
+	Has(path string, v *PackageVersion) bool
+}
+
+// BundleIndex describes the content of a bundle
+type BundleIndex struct {
+	Kind    string `json:"kind"`
+	Board   string `json:"board"`
+	Created string `json:"created"`
+	// URL prefixes of the upstream servers that addons were fetched from
+	Origins   []string         `json:"origins"`
+	Manifests []BundleManifest `json:"manifests"`
+	Addons    []BundleAddon    `json:"addons"`
+}
+
+// BundleManifest is a package manifest in a bundle
+type BundleManifest struct {
+	OSVersion string `json:"osVersion"`
+	Path      string `json:"path"`
+	// Empty if exported with signature verification disabled
+	SignaturePath string `json:"signaturePath,omitempty"`
+}
+
+// BundleAddon is an addon image in a bundle
+type BundleAddon struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+	URL     string `json:"url"`
+	Path    string `json:"path"`
+	// Empty if no detached signature is published for this addon
+	SignaturePath string `json:"signaturePath,omitempty"`
+}
+
+// Export fetches and verifies the package manifests for the given OS
+// versions, and every addon they provide for the docker versions in the
+// runtime mappings, into sink. The bundle index is written last.
+func (a *App) Export(sink ArtifactSink, osVersions []string) (*BundleIndex, error) {
+	index := BundleIndex{
+		Kind:      bundleIndexKind,
+		Board:     a.Board,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Origins:   []string{},
+		Manifests: []BundleManifest{},
+		Addons:    []BundleAddon{},
+	}
+	if err := a.exportArtifacts(sink, osVersions, &index); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode bundle index")
+	}
+	if err := sink.Add(bundleIndexFile, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// exportArtifacts adds the manifests and addons for the current board and
+// the given OS versions to sink, recording them in index.
+func (a *App) exportArtifacts(sink ArtifactSink, osVersions []string, index *BundleIndex) error {
+	if a.Board == "" {
+		return errors.New("missing board")
+	}
+	mapped, err := a.mappedVersions()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range mapped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logrus.Infof("Exporting %v for board %s, OS version(s) %v", mapped, a.Board, osVersions)
+
+	origins := map[string]bool{}
+	for _, o := range index.Origins {
+		origins[o] = true
+	}
+	exported := map[string]bool{}
+	for _, ba := range index.Addons {
+		exported[ba.Hash] = true
+	}
+
+	for _, osVersion := range osVersions {
+		manif, mb, sig, err := a.fetchPackageManifest(osVersion)
+		if err != nil {
+			return errors.Wrapf(err, "could not get package manifest for %s", osVersion)
+		}
+
+		bm := BundleManifest{
+			OSVersion: osVersion,
+			Path:      path.Join("manifests", a.Board, osVersion, "torcx_manifest.json"),
+		}
+		if err := sink.Add(bm.Path, bytes.NewReader(mb), int64(len(mb))); err != nil {
+			return err
+		}
+		if sig != nil {
+			bm.SignaturePath = bm.Path + ".asc"
+			if err := sink.Add(bm.SignaturePath, bytes.NewReader(sig), int64(len(sig))); err != nil {
+				return err
+			}
+		}
+		index.Manifests = append(index.Manifests, bm)
+
+		for _, name := range names {
+			for _, pref := range mapped[name] {
+				version := manif.resolveVersion(name, pref)
+				loc, err := manif.LocationFor(name, version)
+				if err != nil {
+					logrus.Debugf("Skipping %s %s for OS version %s: %s", name, pref, osVersion, err)
+					continue
+				}
+				if loc.isTorcxStore() || exported[loc.Version.Hash] {
+					continue
+				}
+
+				ba, err := a.exportAddon(sink, loc)
+				if err != nil {
+					return errors.Wrapf(err, "failed to export %s %s for OS version %s", name, version, osVersion)
+				}
+				exported[loc.Version.Hash] = true
+				index.Addons = append(index.Addons, *ba)
+
+				origin := mirrorKey(loc.URL) + "/"
+				if !origins[origin] {
+					origins[origin] = true
+					index.Origins = append(index.Origins, origin)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// exportAddon fetches and verifies an addon, then adds it to sink
+func (a *App) exportAddon(sink ArtifactSink, loc *Location) (*BundleAddon, error) {
+	bundlePath, err := addonBundlePath(loc.URL)
+	if err != nil {
+		return nil, err
+	}
+	ba := BundleAddon{
+		Name:    loc.Version.Package.Name,
+		Version: loc.Version.Version,
+		Hash:    loc.Version.Hash,
+		URL:     loc.URL,
+		Path:    bundlePath,
+	}
+
+	// Signatures are carried along, for nodes enforcing them
+	sig, err := a.fetchAddonSignature(loc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if sig != nil {
+		ba.SignaturePath = bundlePath + ".asc"
+		if err := sink.Add(ba.SignaturePath, bytes.NewReader(sig), int64(len(sig))); err != nil {
+			return nil, err
+		}
+	}
+
+	if c, ok := sink.(artifactChecker); ok && c.Has(bundlePath, loc.Version) {
+		logrus.Infof("%s is up to date", bundlePath)
+		return &ba, nil
+	}
+
+	fetched, err := a.FetchAddon(loc)
+	if err != nil {
+		return nil, err
+	}
+	// Only remove temporary downloads, not other stores' entries
+	if filepath.Dir(fetched) == filepath.Clean(os.TempDir()) {
+		defer os.Remove(fetched)
+	}
+
+	fp, err := os.Open(fetched)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Adding %s to bundle", bundlePath)
+	if err := sink.Add(bundlePath, fp, info.Size()); err != nil {
+		return nil, err
+	}
+	return &ba, nil
+}
+
+// fetchAddonSignature fetches the detached signature of the addon at
+// rawURL, if any. Nil is returned if none is published.
+func (a *App) fetchAddonSignature(rawURL string) ([]byte, error) {
+	var lastErr error
+	for _, url := range a.candidateURLs(rawURL + ".asc") {
+		sig, err := a.fetchURL(url)
+		if err == nil {
+			return sig, nil
+		}
+		if !isNotFound(err) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// mappedVersions returns all versions of each runtime component listed in
+// the local runtime mappings, for any kubernetes version. These may be
+// version constraints, see resolveVersion.
+func (a *App) mappedVersions() (map[string][]string, error) {
+	m, err := a.GetVersionManifest(true)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := allVersions(m, "k8s")
+	if len(versions) == 0 {
+		return nil, errors.New("runtime mappings do not list any component version")
+	}
+	return versions, nil
+}
+
+// addonBundlePath returns the path of an addon within a bundle, which is
+// the path of its upstream URL.
+func addonBundlePath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid addon URL %q", rawURL)
+	}
+	p, err := cleanBundlePath(u.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid addon URL %q", rawURL)
+	}
+	return p, nil
+}
+
+// cleanBundlePath checks that p is a relative path staying within the bundle
+func cleanBundlePath(p string) (string, error) {
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") || p == bundleIndexFile {
+		return "", errors.Errorf("invalid bundle path %q", p)
+	}
+	return p, nil
+}
+
+// ImportBundle unpacks a bundle tarball into dir, replacing any previous
+// bundle there. It is unpacked and verified (manifest signatures and addon
+// hashes listed in its index) in a temporary directory next to dir first,
+// so that a bad bundle leaves dir untouched.
+func (a *App) ImportBundle(r io.Reader, dir string) (*BundleIndex, error) {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".import-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary directory")
+	}
+	// This is a no-op once moved into place
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := unpackBundle(r, tmpDir); err != nil {
+		return nil, err
+	}
+	index, err := ReadBundleIndex(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verifyBundle(tmpDir, index); err != nil {
+		return nil, err
+	}
+
+	if err := replaceDir(tmpDir, dir); err != nil {
+		return nil, errors.Wrapf(err, "failed to move bundle into %s", dir)
+	}
+	return index, nil
+}
+
+// unpackBundle writes the files of a bundle tarball into dir
+func unpackBundle(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to read bundle")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read bundle")
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return errors.Errorf("unexpected entry %q in bundle", hdr.Name)
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name != bundleIndexFile {
+			if name, err = cleanBundlePath(name); err != nil {
+				return err
+			}
+		}
+		if err := writeBundleFile(filepath.Join(dir, filepath.FromSlash(name)), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// replaceDir renames src to dest, replacing dest if it exists. The previous
+// dest is restored if src cannot be moved.
+func replaceDir(src, dest string) error {
+	old := src + ".old"
+	if err := os.Rename(dest, old); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(src, dest)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		if rerr := os.Rename(old, dest); rerr != nil {
+			logrus.Warnf("Failed to restore %s from %s: %s", dest, old, rerr)
+		}
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		logrus.Warnf("Failed to remove previous bundle %s: %s", old, err)
+	}
+	return nil
+}
+
+// writeBundleFile writes the content of r to dest, creating parent
+// directories as needed.
+func writeBundleFile(dest string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	fp, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fp, r); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "failed to write %s", dest)
+	}
+	return fp.Close()
+}
+
+// verifyBundle checks manifest signatures and addon hashes in an
+// unpacked bundle.
+func (a *App) verifyBundle(dir string, index *BundleIndex) error {
+	for _, m := range index.Manifests {
+		if a.Conf.NoVerifySig {
+			break
+		}
+		if m.SignaturePath == "" {
+			return errors.Errorf("bundle has no signature for manifest %s", m.Path)
+		}
+		mb, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(m.Path)))
+		if err != nil {
+			return errors.Wrap(err, "failed to read bundle manifest")
+		}
+		sig, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(m.SignaturePath)))
+		if err != nil {
+			return errors.Wrap(err, "failed to read bundle manifest signature")
+		}
+		if err := a.gpgVerify(m.Path, bytes.NewReader(mb), bytes.NewReader(sig)); err != nil {
+			return errors.Wrapf(err, "invalid signature for %s", m.Path)
+		}
+	}
+
+	for _, addon := range index.Addons {
+		v := PackageVersion{Hash: addon.Hash}
+		addonPath := filepath.Join(dir, filepath.FromSlash(addon.Path))
+		ok, err := v.validateFile(addonPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to verify %s", addon.Path)
+		}
+		if !ok {
+			return errors.Errorf("hash mismatch for %s", addon.Path)
+		}
+		if err := a.verifyBundleAddonSignature(dir, addon); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBundleAddonSignature checks the signature of an addon in an
+// unpacked bundle, according to the addon signature policy.
+func (a *App) verifyBundleAddonSignature(dir string, addon BundleAddon) error {
+	policy := a.Conf.AddonSignaturePolicy
+	if policy == "" || policy == AddonSignatureOff {
+		return nil
+	}
+	if addon.SignaturePath == "" {
+		if policy == AddonSignatureRequired {
+			return errors.Errorf("bundle has no signature for addon %s", addon.Path)
+		}
+		return nil
+	}
+
+	fp, err := os.Open(filepath.Join(dir, filepath.FromSlash(addon.Path)))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	sig, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(addon.SignaturePath)))
+	if err != nil {
+		return errors.Wrap(err, "failed to read addon signature")
+	}
+	if err := a.checkSignature(a.addonKeyring(addon.Name), ArtifactAddon, addon.Path, fp, bytes.NewReader(sig)); err != nil {
+		return errors.Wrapf(err, "invalid signature for %s", addon.Path)
+	}
+	return nil
+}
+
+// ReadBundleIndex reads the index of a bundle unpacked in dir
+func ReadBundleIndex(dir string) (*BundleIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleIndexFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read bundle index")
+	}
+	index := BundleIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "failed to parse bundle index")
+	}
+	if index.Kind != bundleIndexKind {
+		return nil, errors.Errorf("unexpected bundle index kind %q", index.Kind)
+	}
+	return &index, nil
+}
+
+// BundleManifestURLTemplate returns the package manifest URL template for a
+// bundle unpacked in dir.
+func BundleManifestURLTemplate(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(abs) + "/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json", nil
+}
+
+// URLRewrites returns the rewrites redirecting upstream addon URLs to
+// a bundle unpacked in dir.
+func (idx *BundleIndex) URLRewrites(dir string) ([]URLRewrite, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	rws := []URLRewrite{}
+	for _, origin := range idx.Origins {
+		rws = append(rws, URLRewrite{From: origin, To: "file://" + filepath.ToSlash(abs) + "/"})
+	}
+	return rws, nil
+}
+
+// tarSink writes artifacts to a gzip-compressed tarball
+type tarSink struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+// NewTarSink returns a sink writing a gzip-compressed tarball to w.
+// Closing the sink does not close w.
+func NewTarSink(w io.Writer) ArtifactSink {
+	gz := gzip.NewWriter(w)
+	return &tarSink{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (s *tarSink) Add(path string, r io.Reader, size int64) error {
+	hdr := tar.Header{
+		Name:     path,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := s.tw.WriteHeader(&hdr); err != nil {
+		return errors.Wrapf(err, "failed to add %s", path)
+	}
+	if _, err := io.CopyN(s.tw, r, size); err != nil {
+		return errors.Wrapf(err, "failed to add %s", path)
+	}
+	return nil
+}
+
+func (s *tarSink) Close() error {
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+	return s.gz.Close()
+}
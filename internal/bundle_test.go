@@ -0,0 +1,218 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMappings = `kind: VersionManifestV1
+versions:
+  k8s:
+    "1.7":
+      docker: ["17.03", "1.12"]
+    "1.8":
+      docker: ["17.06", "17.03"]
+`
+
+// testUpstream serves a package manifest for amd64-usr 9999.0.0 with a
+// docker 17.03 addon, as the upstream bucket would. Addon downloads are
+// counted in addonHits.
+func testUpstream(content []byte, addonHits *int) *httptest.Server {
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+
+	manifest := fmt.Sprintf(`{"kind": "torcx-package-list-v0", "value": {"packages": [{"name": "docker", "versions": [
+		{"version": "1.12", "hash": "sha512-00", "locations": [{"path": "/usr/share/torcx/store/docker:1.12.torcx.tgz"}]},
+		{"version": "17.03", "hash": "sha512-%x", "locations": [{"url": "%s/pkgs/amd64-usr/docker/abc/docker:17.03.torcx.tgz"}]}
+	]}]}}`, sha512.Sum512(content), ts.URL)
+
+	mux.HandleFunc("/manifests/amd64-usr/9999.0.0/torcx_manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manifest))
+	})
+	mux.HandleFunc("/pkgs/amd64-usr/docker/abc/docker:17.03.torcx.tgz", func(w http.ResponseWriter, r *http.Request) {
+		*addonHits++
+		w.Write(content)
+	})
+	return ts
+}
+
+func TestBundleExportImport(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mappingsPath := filepath.Join(tmpDir, "runtime-mappings.yaml")
+	if err := ioutil.WriteFile(mappingsPath, []byte(testMappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("docker addon\n")
+	var hits int
+	ts := testUpstream(content, &hits)
+	upstream := ts.URL
+
+	a := App{
+		Board: "amd64-usr",
+		Conf: Config{
+			NoVerifySig:         true,
+			VersionManifestPath: mappingsPath,
+			torcxStoreDir:       filepath.Join(tmpDir, "store"),
+			TorcxManifestURLs: []*template.Template{
+				template.Must(template.New("").Parse(upstream + "/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	sink := NewTarSink(&buf)
+	index, err := a.Export(sink, []string{"9999.0.0"})
+	assert.Nil(err)
+	assert.Nil(sink.Close())
+	assert.Equal([]string{upstream + "/"}, index.Origins)
+	assert.Equal([]BundleManifest{{OSVersion: "9999.0.0", Path: "manifests/amd64-usr/9999.0.0/torcx_manifest.json"}}, index.Manifests)
+	assert.Equal(1, len(index.Addons))
+	assert.Equal("pkgs/amd64-usr/docker/abc/docker:17.03.torcx.tgz", index.Addons[0].Path)
+
+	// The upstream is now unreachable
+	ts.Close()
+
+	bundleDir := filepath.Join(tmpDir, "bundle")
+	imported, err := a.ImportBundle(bytes.NewReader(buf.Bytes()), bundleDir)
+	assert.Nil(err)
+	assert.Equal(index, imported)
+
+	tmpl, err := BundleManifestURLTemplate(bundleDir)
+	assert.Nil(err)
+	rws, err := imported.URLRewrites(bundleDir)
+	assert.Nil(err)
+	b := App{
+		Board: "amd64-usr",
+		Conf: Config{
+			NoVerifySig:   true,
+			torcxStoreDir: filepath.Join(tmpDir, "store"),
+			TorcxManifestURLs: []*template.Template{
+				template.Must(template.New("").Parse(tmpl)),
+				template.Must(template.New("").Parse(upstream + "/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+			},
+			URLRewrites: rws,
+		},
+		packageManifestCache: map[string]*PackageManifest{},
+	}
+
+	m, err := b.GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	loc, err := m.LocationFor("docker", "17.03")
+	assert.Nil(err)
+	path, err := b.FetchAddon(loc)
+	assert.Nil(err)
+	defer os.Remove(path)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(content, data)
+}
+
+func TestImportBundleRejects(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	makeBundle := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		sink := NewTarSink(&buf)
+		for p, c := range files {
+			if err := sink.Add(p, bytes.NewReader([]byte(c)), int64(len(c))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sink.Close()
+		return &buf
+	}
+	a := App{Conf: Config{NoVerifySig: true}}
+
+	// A previous bundle, left untouched by failed imports
+	bundleDir := filepath.Join(tmpDir, "bundle")
+	good := `{"kind": "tectonic-torcx-bundle-v0", "board": "amd64-usr"}`
+	_, err = a.ImportBundle(makeBundle(map[string]string{"index.json": good, "pkgs/previous": "ok"}), bundleDir)
+	assert.Nil(err)
+
+	// Escaping the destination directory
+	_, err = a.ImportBundle(makeBundle(map[string]string{"../evil": "x"}), bundleDir)
+	assert.NotNil(err)
+	_, err = os.Stat(filepath.Join(tmpDir, "evil"))
+	assert.True(os.IsNotExist(err))
+
+	// Symlinks
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "pkgs/link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	_, err = a.ImportBundle(&buf, bundleDir)
+	assert.NotNil(err)
+
+	// Corrupted addon
+	index := `{"kind": "tectonic-torcx-bundle-v0", "board": "amd64-usr", "addons": [{"name": "docker", "version": "17.03", "hash": "sha512-00", "path": "pkgs/docker.tgz"}]}`
+	_, err = a.ImportBundle(makeBundle(map[string]string{"index.json": index, "pkgs/docker.tgz": "tampered"}), bundleDir)
+	assert.NotNil(err)
+
+	// Missing signature
+	a.Conf.NoVerifySig = false
+	index = `{"kind": "tectonic-torcx-bundle-v0", "board": "amd64-usr", "manifests": [{"osVersion": "9999.0.0", "path": "manifests/m.json"}]}`
+	_, err = a.ImportBundle(makeBundle(map[string]string{"index.json": index, "manifests/m.json": "{}"}), bundleDir)
+	assert.NotNil(err)
+
+	data, err := ioutil.ReadFile(filepath.Join(bundleDir, "pkgs", "previous"))
+	assert.Nil(err)
+	assert.Equal("ok", string(data))
+	_, err = os.Stat(filepath.Join(bundleDir, "pkgs", "docker.tgz"))
+	assert.True(os.IsNotExist(err))
+	entries, err := ioutil.ReadDir(tmpDir)
+	assert.Nil(err)
+	assert.Equal(1, len(entries), "leftover temporary directories")
+
+	// A good bundle replaces the previous one
+	a.Conf.NoVerifySig = true
+	_, err = a.ImportBundle(makeBundle(map[string]string{"index.json": good, "pkgs/next": "ok"}), bundleDir)
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(bundleDir, "pkgs", "previous"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(bundleDir, "pkgs", "next"))
+	assert.Nil(err)
+	entries, err = ioutil.ReadDir(tmpDir)
+	assert.Nil(err)
+	assert.Equal(1, len(entries), "leftover temporary directories")
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sort"
+
+	"github.com/coreos/go-systemd/dbus"
+	"github.com/pkg/errors"
+)
+
+// AddonSelection is the version of a runtime component picked for install,
+// with the OS versions to install it for.
+type AddonSelection struct {
+	Name       string
+	Version    string
+	OSVersions []string
+}
+
+// componentPolicy describes how a change to a runtime component is applied
+type componentPolicy struct {
+	// Whether a reboot is needed for the change to take effect
+	reboot bool
+	// Optional step to run before rebooting, e.g. cleaning a datadir
+	cleanup func(a *App, conn *dbus.Conn) error
+}
+
+// componentPolicies lists the components with specific requirements
+var componentPolicies = map[string]componentPolicy{
+	// Docker does not support version downgrades, so its datadir
+	// is cleaned before reboot.
+	"docker": {reboot: true, cleanup: (*App).EnableDockerCleanupUnit},
+}
+
+// policyFor returns the policy for a runtime component. Torcx only applies
+// profile changes at boot, so a reboot is needed by default.
+func policyFor(name string) componentPolicy {
+	if p, ok := componentPolicies[name]; ok {
+		return p
+	}
+	return componentPolicy{reboot: true}
+}
+
+// componentNames returns the names of the runtime components to install,
+// sorted.
+func (a *App) componentNames() []string {
+	names := []string{}
+	for name := range a.RuntimeVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SelectAddons picks the version of each runtime component to install.
+// Components with nothing to install (e.g. on OS versions too old for
+// torcx) are left out.
+func (a *App) SelectAddons() ([]AddonSelection, error) {
+	sels := []AddonSelection{}
+	for _, name := range a.componentNames() {
+		version, osVersions, err := a.PickVersion(name, a.RuntimeVersions[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to pick %s version", name)
+		}
+		if len(osVersions) == 0 {
+			continue
+		}
+		sels = append(sels, AddonSelection{
+			Name:       name,
+			Version:    version,
+			OSVersions: osVersions,
+		})
+	}
+	return sels, nil
+}
@@ -27,12 +27,15 @@ RequiredBy=umount.target
 // EnableDockerCleanupUnit install a systemd service which
 // purges docker datadir before reboot.
 func (a *App) EnableDockerCleanupUnit(conn *dbus.Conn) error {
+	unitName := "torcx-docker-cleanup.service"
+	unitPath := filepath.Join("/run/systemd/system/", unitName)
+	if a.dryRun(ActionEnableDockerCleanup, unitPath, "purges /var/lib/docker before reboot") {
+		return nil
+	}
+
 	if conn == nil {
 		return fmt.Errorf("got nil connection")
 	}
-
-	unitName := "torcx-docker-cleanup.service"
-	unitPath := filepath.Join("/run/systemd/system/", unitName)
 	if err := ioutil.WriteFile(unitPath, []byte(cleanupUnit), 0755); err != nil {
 		errors.Wrapf(err, "failed to write %s", unitPath)
 	}
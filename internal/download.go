@@ -0,0 +1,380 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Download tuning knobs, variables so that tests can shorten them
+var (
+	// fetchAttempts is the number of attempts for a single download
+	fetchAttempts = 6
+	// fetchBackoffBase is the pause after the first failed attempt,
+	// doubling after each subsequent failure
+	fetchBackoffBase = 2 * time.Second
+	// fetchBackoffMax is the longest pause between attempts
+	fetchBackoffMax = 60 * time.Second
+	// fetchProgressInterval is how often download progress is logged
+	fetchProgressInterval = 10 * time.Second
+)
+
+// fileClient serves file:// URLs from the local filesystem, e.g. an
+// unpacked bundle, with the same semantics (and range support) as HTTP.
+var fileClient = &http.Client{Transport: http.NewFileTransport(http.Dir("/"))}
+
+// permanentError is a download failure which retrying cannot fix
+type permanentError struct {
+	error
+}
+
+// fetchURL fetches a (small) remote asset in memory, retrying on
+// connection errors, server errors and truncated bodies.
+func (a *App) fetchURL(url string) ([]byte, error) {
+	data, _, _, err := a.fetchURLIf(url, nil)
+	return data, err
+}
+
+// cacheValidators are the HTTP validators of a cached remote asset
+type cacheValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// fetchURLIf is fetchURL with a conditional request: if cached is not nil
+// and the remote asset still matches it, notModified is true and no data
+// is returned. The validators of the fetched asset are returned as well.
+func (a *App) fetchURLIf(url string, cached *cacheValidators) (data []byte, validators cacheValidators, notModified bool, err error) {
+	ctx, cancel := a.fetchContext()
+	defer cancel()
+
+	header := http.Header{}
+	if cached != nil {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = a.retryFetch(ctx, url, func(ctx context.Context) error {
+		buf.Reset()
+		resp, err := a.doGet(ctx, url, 0, header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotModified && cached != nil {
+			notModified = true
+			validators = *cached
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return statusError(url, resp)
+		}
+
+		n, err := io.Copy(&buf, resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength >= 0 && n != resp.ContentLength {
+			return errors.Errorf("truncated body: got %d of %d bytes", n, resp.ContentLength)
+		}
+		validators = cacheValidators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		return nil
+	})
+	if err != nil || notModified {
+		return nil, validators, notModified, err
+	}
+	return buf.Bytes(), validators, false, nil
+}
+
+// fetchToFile downloads url to f. After a failure, the download is
+// resumed from the current end of f via an HTTP range request if the
+// server supports it, otherwise it restarts from scratch.
+func (a *App) fetchToFile(url string, f *os.File) error {
+	ctx, cancel := a.fetchContext()
+	defer cancel()
+
+	return a.retryFetch(ctx, url, func(ctx context.Context) error {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return permanentError{err}
+		}
+
+		resp, err := a.doGet(ctx, url, offset, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		total := resp.ContentLength
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+			if err != nil || start != offset {
+				// Do not trust a mismatching range, start over
+				if terr := truncate(f); terr != nil {
+					return permanentError{terr}
+				}
+				return errors.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+			}
+			total = size
+			logrus.Infof("Resuming download of %s at byte %d", url, offset)
+		case http.StatusOK:
+			if offset > 0 {
+				logrus.Infof("Server does not support resuming %s, restarting download", url)
+			}
+			if err := truncate(f); err != nil {
+				return permanentError{err}
+			}
+			offset = 0
+		case http.StatusRequestedRangeNotSatisfiable:
+			if err := truncate(f); err != nil {
+				return permanentError{err}
+			}
+			return statusError(url, resp)
+		default:
+			return statusError(url, resp)
+		}
+
+		pw := newProgressWriter(f, url, offset, total)
+		n, err := io.Copy(pw, resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength >= 0 && n != resp.ContentLength {
+			return errors.Errorf("truncated body: got %d of %d bytes", n, resp.ContentLength)
+		}
+		pw.done()
+		return nil
+	})
+}
+
+// retryFetch runs a download attempt until it succeeds, fails permanently,
+// runs out of attempts or the overall deadline expires. Pauses between
+// attempts increase exponentially.
+func (a *App) retryFetch(ctx context.Context, url string, attempt func(context.Context) error) error {
+	var err error
+	pause := fetchBackoffBase
+	for i := 1; i <= fetchAttempts; i++ {
+		reqCtx, cancel := ctx, context.CancelFunc(func() {})
+		if a.Conf.FetchRequestTimeout > 0 {
+			reqCtx, cancel = context.WithTimeout(ctx, a.Conf.FetchRequestTimeout)
+		}
+		err = attempt(reqCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if perm, ok := err.(permanentError); ok {
+			return perm.error
+		}
+		if ctx.Err() != nil {
+			return errors.Wrapf(err, "download of %s timed out", url)
+		}
+		if i == fetchAttempts {
+			break
+		}
+
+		logrus.Warnf("Download of %s failed (attempt %d/%d), retrying in %s: %s", url, i, fetchAttempts, pause, err)
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return errors.Wrapf(err, "download of %s timed out", url)
+		}
+		pause *= 2
+		if pause > fetchBackoffMax {
+			pause = fetchBackoffMax
+		}
+	}
+	return errors.Wrapf(err, "failed to download %s after %d attempts", url, fetchAttempts)
+}
+
+// fetchContext returns the context bounding a whole download
+func (a *App) fetchContext() (context.Context, context.CancelFunc) {
+	if a.Conf.FetchTimeout > 0 {
+		return context.WithTimeout(context.Background(), a.Conf.FetchTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// doGet performs a single GET request with optional extra headers,
+// starting at offset if non-zero
+func (a *App) doGet(ctx context.Context, url string, offset int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	logrus.Debugf("GET %s (offset %d)", url, offset)
+	client := http.DefaultClient
+	if req.URL.Scheme == "file" {
+		client = fileClient
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// httpStatusError is an unexpected HTTP response status
+type httpStatusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("failed to download %q: %s", e.url, e.status)
+}
+
+// isNotFound returns true if err is caused by a missing remote asset
+func isNotFound(err error) bool {
+	se, ok := errors.Cause(err).(*httpStatusError)
+	return ok && se.code == http.StatusNotFound
+}
+
+// statusError converts an unexpected HTTP status to an error; only
+// server-side errors are worth retrying.
+func statusError(url string, resp *http.Response) error {
+	err := &httpStatusError{url: url, code: resp.StatusCode, status: resp.Status}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return permanentError{err}
+}
+
+// parseContentRange parses a "bytes start-end/size" header value,
+// returning the start offset and the total size (-1 if unknown).
+func parseContentRange(value string) (int64, int64, error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid Content-Range %q", value)
+	}
+
+	size := int64(-1)
+	if parts[1] != "*" {
+		size, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid Content-Range %q", value)
+		}
+	}
+	return start, size, nil
+}
+
+func truncate(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// progressWriter periodically logs the progress of a download
+type progressWriter struct {
+	w       io.Writer
+	url     string
+	start   time.Time
+	last    time.Time
+	initial int64
+	written int64
+	total   int64
+}
+
+func newProgressWriter(w io.Writer, url string, offset, total int64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{
+		w:       w,
+		url:     url,
+		start:   now,
+		last:    now,
+		initial: offset,
+		total:   total,
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if time.Since(p.last) >= fetchProgressInterval {
+		p.last = time.Now()
+		p.log()
+	}
+	return n, err
+}
+
+// done logs the final progress, for downloads long enough to have
+// reported some progress already.
+func (p *progressWriter) done() {
+	if p.last != p.start {
+		p.log()
+	}
+}
+
+func (p *progressWriter) log() {
+	elapsed := time.Since(p.start)
+	rate := float64(p.written) / elapsed.Seconds()
+	have := p.initial + p.written
+
+	if p.total <= 0 {
+		logrus.Infof("Downloading %s: %d bytes, %s/s", p.url, have, formatBytes(rate))
+		return
+	}
+
+	eta := "unknown"
+	if rate > 0 {
+		eta = (time.Duration(float64(p.total-have)/rate) * time.Second).String()
+	}
+	logrus.Infof("Downloading %s: %d of %d bytes (%.1f%%), %s/s, ETA %s",
+		p.url, have, p.total, 100*float64(have)/float64(p.total), formatBytes(rate), eta)
+}
+
+// formatBytes renders a byte count in a human-friendly unit
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", b, units[i])
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer serves content with range support, but drops the
+// connection mid-body for the first `drops` requests.
+type flakyServer struct {
+	sync.Mutex
+	content  []byte
+	drops    int
+	failures int // 503 responses before serving anything
+	requests []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	if r.URL.Path == "/missing" {
+		s.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	drop := !fail && s.drops > 0
+	if drop {
+		s.drops--
+	}
+	s.Unlock()
+
+	if fail {
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	if !drop {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+		return
+	}
+
+	// Announce the remaining length, send a third of the content,
+	// then hang up
+	var start int
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	if start > 0 {
+		fmt.Fprintf(buf, "HTTP/1.1 206 Partial Content\r\nContent-Range: bytes %d-%d/%d\r\n", start, len(s.content)-1, len(s.content))
+	} else {
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\n")
+	}
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", len(s.content)-start)
+	buf.Write(s.content[start : start+len(s.content)/3])
+	buf.Flush()
+}
+
+func withFastRetries(t *testing.T) func() {
+	base, attempts := fetchBackoffBase, fetchAttempts
+	fetchBackoffBase = time.Millisecond
+	fetchAttempts = 4
+	return func() {
+		fetchBackoffBase, fetchAttempts = base, attempts
+	}
+}
+
+func TestFetchToFileResume(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := &flakyServer{content: content, drops: 2}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "fetch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	a := App{}
+	err = a.fetchToFile(ts.URL, f)
+	assert.Nil(err)
+
+	data, err := ioutil.ReadFile(f.Name())
+	assert.Nil(err)
+	assert.Equal(content, data)
+	// Each resumed request starts where the previous one stopped
+	third := len(content) / 3
+	assert.Equal([]string{"", fmt.Sprintf("bytes=%d-", third), fmt.Sprintf("bytes=%d-", 2*third)}, srv.requests)
+}
+
+func TestFetchURLRetries(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+
+	content := []byte("manifest")
+	srv := &flakyServer{content: content, failures: 1, drops: 1}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	a := App{}
+	data, err := a.fetchURL(ts.URL)
+	assert.Nil(err)
+	assert.Equal(content, data)
+	assert.Equal(3, len(srv.requests))
+
+	// Permanent errors are not retried
+	srv.requests = nil
+	_, err = a.fetchURL(ts.URL + "/missing")
+	assert.NotNil(err)
+	assert.Equal(1, len(srv.requests))
+
+	// Neither are exhausted attempts
+	srv.failures = 10
+	srv.requests = nil
+	_, err = a.fetchURL(ts.URL)
+	assert.NotNil(err)
+	assert.Equal(fetchAttempts, len(srv.requests))
+}
+
+func TestFetchTimeout(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	a := App{Conf: Config{
+		FetchTimeout:        200 * time.Millisecond,
+		FetchRequestTimeout: 50 * time.Millisecond,
+	}}
+	start := time.Now()
+	_, err := a.fetchURL(ts.URL)
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestParseContentRange(t *testing.T) {
+	assert := assert.New(t)
+
+	start, size, err := parseContentRange("bytes 100-199/200")
+	assert.Nil(err)
+	assert.Equal(int64(100), start)
+	assert.Equal(int64(200), size)
+
+	start, size, err = parseContentRange("bytes 100-199/*")
+	assert.Nil(err)
+	assert.Equal(int64(100), start)
+	assert.Equal(int64(-1), size)
+
+	_, _, err = parseContentRange("items 1-2/3")
+	assert.NotNil(err)
+}
@@ -15,16 +15,13 @@
 package internal
 
 import (
-	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/openpgp"
 )
 
 // FetchAddon fetches and verifies a torcx addon. It returns
@@ -35,104 +32,101 @@ func (a *App) FetchAddon(loc *Location) (string, error) {
 		return existing, nil
 	}
 
-	logrus.Infof("fetching addon at %s", loc.URL)
+	urls := a.addonURLs(loc)
+	if len(urls) > 0 && a.dryRun(ActionFetchAddon, urls[0], loc.Version.Hash) {
+		return "", nil
+	}
+
 	tmpfile, err := ioutil.TempFile("", loc.Version.filename())
 	if err != nil {
 		return "", errors.Wrapf(err, "could not create temporary addon")
 	}
 	defer tmpfile.Close()
 
-	logrus.Debugf("GET %s > %s", loc.URL, tmpfile.Name())
-
-	err = fetchURL(loc.URL, tmpfile)
+	err = a.tryMirrors(urls, func(url string) error {
+		logrus.Infof("fetching addon at %s", url)
+		logrus.Debugf("GET %s > %s", url, tmpfile.Name())
+		if err := truncate(tmpfile); err != nil {
+			return err
+		}
+		if err := a.fetchAddonFile(url, loc.Version, tmpfile); err != nil {
+			return err
+		}
+		return a.verifyAddonSignature(url, loc.Version, tmpfile)
+	})
 	if err != nil {
 		os.Remove(tmpfile.Name())
 		return "", errors.Wrapf(err, "failed to fetch addon")
 	}
 
+	return tmpfile.Name(), nil
+}
+
+// fetchAddonFile downloads an addon from a single URL to tmpfile,
+// then validates its size, if known, and hash.
+func (a *App) fetchAddonFile(url string, v *PackageVersion, tmpfile *os.File) error {
+	if err := a.fetchToFile(url, tmpfile); err != nil {
+		return err
+	}
+
 	if err := tmpfile.Sync(); err != nil {
-		os.Remove(tmpfile.Name())
-		return "", errors.Wrapf(err, "failed to write addon")
+		return errors.Wrapf(err, "failed to write addon")
+	}
+
+	if size := v.size(); size > 0 {
+		info, err := tmpfile.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat tmpfile")
+		}
+		if info.Size() != size {
+			return errors.Errorf("Size validation failed: expected %d bytes, got %d", size, info.Size())
+		}
 	}
 
 	// Seek the fp back to 0 and validate the downloaded file
 	if _, err := tmpfile.Seek(0, 0); err != nil {
-		os.Remove(tmpfile.Name())
-		return "", errors.Wrapf(err, "failed to seek tmpfile")
+		return errors.Wrapf(err, "failed to seek tmpfile")
 	}
-	ok, err := loc.Version.ValidateHash(tmpfile)
+	ok, err := v.ValidateHash(tmpfile)
 	if err != nil {
-		os.Remove(tmpfile.Name())
-		return "", errors.Wrapf(err, "failure during download hash validation")
+		return errors.Wrapf(err, "failure during download hash validation")
 	}
 	if !ok {
-		os.Remove(tmpfile.Name())
-		return "", errors.New("Hash validation failed")
+		return errors.New("Hash validation failed")
 	}
-
-	return tmpfile.Name(), nil
+	return nil
 }
 
-// fetchURL fetches a URL to a given destination
-func fetchURL(url string, dst io.Writer) error {
-	var resp *http.Response
-	var err error
-	err = retry(5, 60, func() error {
-		var e error
-		resp, e = http.Get(url)
-		return e
-	})
-	if err != nil {
-		return err
+// addonURLs returns the URLs an addon can be fetched from: the chosen
+// location first, then the other remote locations for the same version,
+// each preceded by its rewritten mirrors.
+func (a *App) addonURLs(loc *Location) []string {
+	locURLs := []string{}
+	if loc.URL != "" {
+		locURLs = append(locURLs, loc.URL)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return errors.Errorf("failed to download %q: %s", url, resp.Status)
+	for _, l := range loc.Version.Locations {
+		if l.URL != "" && l.URL != loc.URL {
+			locURLs = append(locURLs, l.URL)
+		}
 	}
 
-	_, err = io.Copy(dst, resp.Body)
-	if err != nil {
-		return err
+	urls := []string{}
+	for _, u := range locURLs {
+		urls = append(urls, a.candidateURLs(u)...)
 	}
-	return nil
+	return urls
 }
 
-// verify will make sure a downloaded addon is signed by a key in the keyring.
-// It assumes the signature is available at "$url.asc".
-func (a *App) gpgVerify(data, sig io.Reader) error {
+// gpgVerify will make sure a package manifest is signed by a trusted key
+// in the keyring. name is used for logging.
+func (a *App) gpgVerify(name string, data io.ReadSeeker, sig io.Reader) error {
 	if a.Conf.NoVerifySig {
 		logrus.Warn("signature verification disabled, skipping")
 		return nil
 	}
 
-	// Get the keyring
-	keyring, err := a.openKeyring()
-	if err != nil {
-		return errors.Wrap(err, "failed to open keyring")
-	}
-	logrus.Debugf("Opened keyring with %d keys", len(keyring))
-
-	// Validate
-	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, data, sig)
-	if err != nil {
-		return errors.Wrap(err, "failed to validate signature")
-	}
-	logrus.Debugf("good signature from %s", signer.PrimaryKey.KeyIdString())
-	return nil
-}
-
-// openKeying returns the parsed keyring file.
-func (a *App) openKeyring() (openpgp.EntityList, error) {
-	if a.Conf.GpgKeyringPath == "" {
-		return nil, fmt.Errorf("no gpg keyring specified")
-	}
-	fp, err := os.Open(a.Conf.GpgKeyringPath)
-	if err != nil {
-		return nil, err
-	}
-	defer fp.Close()
-
-	return openpgp.ReadArmoredKeyRing(fp)
+	return a.checkSignature(a.Conf.GpgKeyringPath, ArtifactManifest, name, data, sig)
 }
 
 // findOnDisk is a simple shortcut that can find packages already downloaded.
@@ -161,12 +155,7 @@ func (a *App) tryFindExisting(v *PackageVersion) string {
 				return nil
 			}
 
-			fp, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-
-			ok, _ := v.ValidateHash(fp)
+			ok, _ := v.validateFile(path)
 			if ok {
 				foundPath = path
 				return filepath.SkipDir
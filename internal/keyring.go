@@ -0,0 +1,269 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Artifact types, each with its own set of trusted key fingerprints
+const (
+	ArtifactManifest = "manifest"
+	ArtifactAddon    = "addon"
+)
+
+// NormalizeFingerprint returns a key fingerprint in upper-case hex,
+// without spaces nor "0x" prefix.
+func NormalizeFingerprint(fpr string) string {
+	fpr = strings.Replace(strings.TrimSpace(fpr), " ", "", -1)
+	fpr = strings.TrimPrefix(strings.TrimPrefix(fpr, "0x"), "0X")
+	return strings.ToUpper(fpr)
+}
+
+// keyFingerprint returns the normalized fingerprint of an entity's primary key
+func keyFingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// checkSignature verifies that sig is a valid detached signature of data
+// by a key in the keyring at keyringPath, which must be trusted for this
+// type of artifact. name is used for logging.
+func (a *App) checkSignature(keyringPath, artifact, name string, data io.ReadSeeker, sig io.Reader) error {
+	// Get the keyring
+	keyring, err := a.openKeyring(keyringPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open keyring")
+	}
+	logrus.Debugf("Opened keyring %s with %d keys", keyringPath, len(keyring))
+
+	fpr, err := verifySignature(keyring, a.Conf.TrustedKeys[artifact], data, sig, time.Now())
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Good signature on %s %s from key %s", artifact, name, fpr)
+	return nil
+}
+
+// verifySignature checks an armored detached signature against keyring at
+// a given time, returning the fingerprint of the signing (primary) key.
+// Revoked and expired keys are rejected, as well as keys not in trusted
+// if not empty. The same key may be in the keyring several times, e.g. an
+// expired copy next to a renewed one: a key is revoked as soon as one of
+// its copies is, while an expired copy falls back to the next one.
+func verifySignature(keyring openpgp.EntityList, trusted []string, data io.ReadSeeker, sig io.Reader, now time.Time) (string, error) {
+	sigData, err := ioutil.ReadAll(sig)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read signature")
+	}
+	issuer, err := signatureIssuer(sigData)
+	if err != nil {
+		return "", err
+	}
+
+	keys := keyring.KeysById(issuer)
+	if len(keys) == 0 {
+		return "", errors.Errorf("signed by unknown key %016X", issuer)
+	}
+
+	for _, copies := range groupKeys(keys) {
+		fpr := keyFingerprint(copies[0].Entity)
+		if err = checkKeyRevoked(copies); err != nil {
+			err = errors.Wrapf(err, "signing key %s", fpr)
+			continue
+		}
+		if !isTrustedKey(trusted, fpr) {
+			err = errors.Errorf("signing key %s is not trusted", fpr)
+			continue
+		}
+
+		for _, key := range copies {
+			if err = checkKeyExpired(key, now); err != nil {
+				err = errors.Wrapf(err, "signing key %s", fpr)
+				continue
+			}
+			if _, serr := data.Seek(0, io.SeekStart); serr != nil {
+				return "", errors.Wrap(serr, "failed to seek signed data")
+			}
+			if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{key.Entity}, data, bytes.NewReader(sigData)); err != nil {
+				err = errors.Wrapf(err, "failed to validate signature from key %s", fpr)
+				continue
+			}
+			return fpr, nil
+		}
+	}
+	if len(keys) > 1 {
+		logrus.Debugf("None of the %d copies of key %016X in the keyring is valid", len(keys), issuer)
+	}
+	return "", err
+}
+
+// groupKeys groups copies of the same (sub)key by fingerprint, keeping
+// the keyring order.
+func groupKeys(keys []openpgp.Key) [][]openpgp.Key {
+	groups := [][]openpgp.Key{}
+	index := map[string]int{}
+	for _, key := range keys {
+		fpr := fmt.Sprintf("%X", key.PublicKey.Fingerprint)
+		i, ok := index[fpr]
+		if !ok {
+			i = len(groups)
+			index[fpr] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+// isTrustedKey returns true if fpr is in trusted, or if trusted is empty
+func isTrustedKey(trusted []string, fpr string) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+	for _, t := range trusted {
+		if NormalizeFingerprint(t) == fpr {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureIssuer returns the key ID which made an armored signature
+func signatureIssuer(sigData []byte) (uint64, error) {
+	block, err := armor.Decode(bytes.NewReader(sigData))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to decode signature")
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse signature")
+	}
+	switch sig := p.(type) {
+	case *packet.Signature:
+		if sig.IssuerKeyId == nil {
+			return 0, errors.New("signature doesn't have an issuer")
+		}
+		return *sig.IssuerKeyId, nil
+	case *packet.SignatureV3:
+		return sig.IssuerKeyId, nil
+	}
+	return 0, errors.New("not a signature")
+}
+
+// checkKeyRevoked returns an error if any copy of a (sub)key, or of its
+// primary key, is revoked.
+func checkKeyRevoked(copies []openpgp.Key) error {
+	for _, key := range copies {
+		if len(key.Entity.Revocations) > 0 {
+			return errors.New("is revoked")
+		}
+		if key.SelfSignature != nil && (key.SelfSignature.SigType == packet.SigTypeSubkeyRevocation || key.SelfSignature.RevocationReason != nil) {
+			return errors.New("is revoked")
+		}
+	}
+	return nil
+}
+
+// checkKeyExpired returns an error if a (sub)key, or its primary key, is
+// expired at a given time.
+func checkKeyExpired(key openpgp.Key, now time.Time) error {
+	if keyExpired(key.PublicKey, key.SelfSignature, now) {
+		return errors.New("is expired")
+	}
+	for _, ident := range key.Entity.Identities {
+		if keyExpired(key.Entity.PrimaryKey, ident.SelfSignature, now) {
+			return errors.New("is expired")
+		}
+	}
+	return nil
+}
+
+// keyExpired returns true if the lifetime set by a self-signature on pub
+// is over at a given time. Unlike openpgp's Signature.KeyExpired, the
+// lifetime counts from the key creation time (RFC 4880, 5.2.3.6), so that
+// a later self-signature does not extend it. A zero lifetime never expires.
+func keyExpired(pub *packet.PublicKey, sig *packet.Signature, now time.Time) bool {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return false
+	}
+	expiry := pub.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+	return now.After(expiry)
+}
+
+// openKeyring returns the parsed keyring at path, which is either a single
+// armored file or a directory of them. In the latter case, files which
+// cannot be parsed are skipped, so that a bad key cannot block rotation.
+func (a *App) openKeyring(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no gpg keyring specified")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return readKeyringFile(path)
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	keyring := openpgp.EntityList{}
+	for _, n := range names {
+		el, err := readKeyringFile(filepath.Join(path, n))
+		if err != nil {
+			logrus.Warnf("Skipping keyring file %s: %s", n, err)
+			continue
+		}
+		keyring = append(keyring, el...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.Errorf("no keys found in %s", path)
+	}
+	return keyring, nil
+}
+
+func readKeyringFile(path string) (openpgp.EntityList, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return openpgp.ReadArmoredKeyRing(fp)
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestKeyringDirectory(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Old and new signing keys, during a rotation
+	oldKey := newTestSigner(t, filepath.Join(tmpDir, "10-old.asc"))
+	newKey := newTestSigner(t, filepath.Join(tmpDir, "20-new.asc"))
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "30-garbage.asc"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestSigner(t, filepath.Join(tmpDir, ".hidden.asc"))
+
+	a := App{}
+	keyring, err := a.openKeyring(tmpDir)
+	assert.Nil(err)
+	assert.Equal(2, len(keyring))
+
+	data := []byte("manifest")
+	check := func(e *openpgp.Entity) error {
+		return a.checkSignature(tmpDir, ArtifactManifest, "test", bytes.NewReader(data), bytes.NewReader(testSign(t, e, data)))
+	}
+	assert.Nil(check(oldKey))
+	assert.Nil(check(newKey))
+	assert.NotNil(check(other))
+
+	// Restricting manifests to the new key
+	a.Conf.TrustedKeys = map[string][]string{ArtifactManifest: {strings.ToLower(keyFingerprint(newKey))}}
+	assert.NotNil(check(oldKey))
+	assert.Nil(check(newKey))
+	// Addons are not restricted
+	assert.Nil(a.checkSignature(tmpDir, ArtifactAddon, "test", bytes.NewReader(data), bytes.NewReader(testSign(t, oldKey, data))))
+
+	_, err = a.openKeyring(filepath.Join(tmpDir, "missing"))
+	assert.NotNil(err)
+	empty := filepath.Join(tmpDir, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.openKeyring(empty)
+	assert.NotNil(err)
+}
+
+func TestVerifySignatureKeyState(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("addon")
+	sig := testSign(t, e, data)
+	keyring := openpgp.EntityList{e}
+	now := time.Now()
+
+	verify := func(trusted []string, at time.Time) (string, error) {
+		return verifySignature(keyring, trusted, bytes.NewReader(data), bytes.NewReader(sig), at)
+	}
+
+	fpr, err := verify(nil, now)
+	assert.Nil(err)
+	assert.Equal(keyFingerprint(e), fpr)
+	_, err = verify([]string{"0x" + fpr}, now)
+	assert.Nil(err)
+	_, err = verify([]string{"0000"}, now)
+	assert.NotNil(err)
+
+	// Tampered data
+	_, err = verifySignature(keyring, nil, bytes.NewReader([]byte("other")), bytes.NewReader(sig), now)
+	assert.NotNil(err)
+
+	// Expired key
+	for _, ident := range e.Identities {
+		lifetime := uint32(3600)
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	_, err = verify(nil, now.Add(2*time.Hour))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "expired")
+	_, err = verify(nil, now)
+	assert.Nil(err)
+
+	// A recent self-signature doesn't extend the lifetime of an old key
+	created := e.PrimaryKey.CreationTime
+	e.PrimaryKey.CreationTime = now.Add(-2 * time.Hour)
+	for _, ident := range e.Identities {
+		ident.SelfSignature.CreationTime = now
+	}
+	_, err = verify(nil, now)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "expired")
+	e.PrimaryKey.CreationTime = created
+
+	// Revoked key
+	e.Revocations = []*packet.Signature{{SigType: packet.SigTypeKeyRevocation}}
+	_, err = verify(nil, now)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "revoked")
+}
+
+func TestVerifySignatureKeyCopies(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The same key exported twice, sorting the stale copy first
+	e := newTestSigner(t, filepath.Join(tmpDir, "20-current.asc"))
+	exported, err := ioutil.ReadFile(filepath.Join(tmpDir, "20-current.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "10-stale.asc"), exported, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := App{}
+	keyring, err := a.openKeyring(tmpDir)
+	assert.Nil(err)
+	assert.Equal(2, len(keyring))
+
+	data := []byte("manifest")
+	sig := testSign(t, e, data)
+	later := time.Now().Add(time.Hour)
+	verify := func(trusted []string) (string, error) {
+		return verifySignature(keyring, trusted, bytes.NewReader(data), bytes.NewReader(sig), later)
+	}
+
+	fpr, err := verify(nil)
+	assert.Nil(err)
+	assert.Equal(keyFingerprint(e), fpr)
+
+	// An expired copy falls back to the renewed one
+	expired, renewed := uint32(60), uint32(0)
+	for _, ident := range keyring[0].Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &expired
+	}
+	for _, ident := range keyring[1].Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &renewed
+	}
+	_, err = verifySignature(keyring[:1], nil, bytes.NewReader(data), bytes.NewReader(sig), later)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "expired")
+	fpr, err = verify(nil)
+	assert.Nil(err)
+	assert.Equal(keyFingerprint(e), fpr)
+	_, err = verify([]string{fpr})
+	assert.Nil(err)
+	_, err = verify([]string{"0000"})
+	assert.NotNil(err)
+
+	// A revoked copy revokes the key, even next to an unrevoked one
+	keyring[0].Revocations = []*packet.Signature{{SigType: packet.SigTypeKeyRevocation}}
+	_, err = verify(nil)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "revoked")
+}
+
+func TestNormalizeFingerprint(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("07FA9ED31CB5FA26", NormalizeFingerprint(" 0x07fa 9ed3 1cb5 fa26 "))
+	assert.Equal("07FA9ED31CB5FA26", NormalizeFingerprint("07FA9ED31CB5FA26"))
+}
@@ -33,17 +33,26 @@ import (
 const (
 	// installerEnvPath is the env file written by tectonic-installer
 	installerEnvPath = "/etc/kubernetes/installer/kubelet.env"
-	// kubeletEnvPath is the env file sourced by kubelet.service
-	kubeletEnvPath = "/etc/kubernetes/kubelet.env"
 	// envVersionKey is the key for the version flag
 	envVersionKey = "KUBELET_IMAGE_TAG"
+	// FallbackAnnotation is the node annotation listing fallback versions
+	// picked instead of preferred ones, empty if none
+	FallbackAnnotation = "tectonic-torcx.coreos.com/version-fallback"
 )
 
+// kubeletEnvPath is the env file sourced by kubelet.service, overridden in
+// tests
+var kubeletEnvPath = "/etc/kubernetes/kubelet.env"
+
 // WriteKubeletEnv writes the `kubelet.env` file
 func (a *App) WriteKubeletEnv(destPath string, k8sVersion string) error {
 	// This reverse charset constraints in docker tags (for the hyperkube image)
 	kubeletVersion := strings.Replace(k8sVersion, "+", "_", -1)
 
+	if a.dryRun(ActionWriteKubeletEnv, destPath, envVersionKey+"="+kubeletVersion) {
+		return nil
+	}
+
 	flags, err := readEnvFile(installerEnvPath)
 	if err != nil {
 		return errors.Wrapf(err, "unable to read template environment file %s", installerEnvPath)
@@ -70,14 +79,18 @@ func (a *App) WriteKubeletEnv(destPath string, k8sVersion string) error {
 //  1. a custom/forced version string
 //  2. GitVersion of the remote API-server `/version` (if localOnly is false)
 //  3. hyperkube version (container tag) from envPath
+//
+// The source which provided the version is recorded in a.K8sVersionSource.
 func (a *App) GetKubeVersion(localOnly bool, envPath string) (string, error) {
 	if a.Conf.ForceKubeVersion != "" {
+		a.K8sVersionSource = "force-kube-version"
 		return a.Conf.ForceKubeVersion, nil
 	}
 
 	if !localOnly {
 		apiVersion, apiErr := a.versionFromAPIServer()
 		if apiErr == nil {
+			a.K8sVersionSource = "api-server"
 			return apiVersion, nil
 		}
 		logrus.Warn("failed attempt to determine kubernetes api-server version: ", apiErr)
@@ -92,6 +105,7 @@ func (a *App) GetKubeVersion(localOnly bool, envPath string) (string, error) {
 		logrus.Infof("using local file %s to determine kubernetes version", envPath)
 		// This accomodates for charset constraints in docker tags (for the hyperkube image)
 		version := strings.Replace(pathVersion, "_", "+", -1)
+		a.K8sVersionSource = envPath
 		return version, nil
 	}
 	logrus.Warn("failed attempt to determine Kubernetes installer version: ", pathErr)
@@ -165,8 +179,13 @@ func readEnvFile(envPath string) (map[string]string, error) {
 }
 
 // WriteNodeAnnotation writes the special annotation that indicates completion
-// of the tool.
+// of the tool, along with the fallback versions picked, if any.
 func (a *App) WriteNodeAnnotation() error {
+	fallbacks := a.fallbackSummary()
+	if a.dryRun(ActionNodeAnnotation, a.Conf.NodeName, fmt.Sprintf("%s=true %s=%q", a.Conf.WriteNodeAnnotation, FallbackAnnotation, fallbacks)) {
+		return nil
+	}
+
 	logrus.Infof("Writing node annotation %s", a.Conf.WriteNodeAnnotation)
 
 	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
@@ -183,6 +202,7 @@ func (a *App) WriteNodeAnnotation() error {
 
 	annotations := map[string]string{
 		a.Conf.WriteNodeAnnotation: "true",
+		FallbackAnnotation:         fallbacks,
 	}
 
 	err = retry(5, 60, func() error { return k8sutil.SetNodeAnnotations(node, a.Conf.NodeName, annotations) })
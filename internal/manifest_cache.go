@@ -0,0 +1,141 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ManifestCacheDir is the default directory for cached package manifests
+	ManifestCacheDir = "/var/lib/torcx/tectonic-cache"
+
+	manifestCacheFile     = "torcx_manifest.json"
+	manifestCacheSigFile  = "torcx_manifest.json.asc"
+	manifestCacheMetaFile = "meta.json"
+)
+
+// manifestCacheMeta describes where and when a cached manifest was fetched
+type manifestCacheMeta struct {
+	URL string `json:"url"`
+	cacheValidators
+	Fetched string `json:"fetched"`
+}
+
+// cachedManifest is a raw package manifest and its signature (nil if
+// signature verification was disabled when fetching it). Its content is
+// untrusted until verified.
+type cachedManifest struct {
+	meta manifestCacheMeta
+	data []byte
+	sig  []byte
+}
+
+// manifestCachePath returns the cache directory for the current board and
+// osVersion, or an empty string if caching is disabled.
+func (a *App) manifestCachePath(osVersion string) string {
+	if a.Conf.ManifestCacheDir == "" || a.Board == "" || osVersion == "" {
+		return ""
+	}
+	return filepath.Join(a.Conf.ManifestCacheDir, a.Board, osVersion)
+}
+
+// loadCachedManifest returns the cached manifest for osVersion, or nil
+// if there is none.
+func (a *App) loadCachedManifest(osVersion string) *cachedManifest {
+	dir := a.manifestCachePath(osVersion)
+	if dir == "" {
+		return nil
+	}
+
+	c := cachedManifest{}
+	mb, err := ioutil.ReadFile(filepath.Join(dir, manifestCacheMetaFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("Failed to read manifest cache: %s", err)
+		}
+		return nil
+	}
+	if err := json.Unmarshal(mb, &c.meta); err != nil {
+		logrus.Warnf("Ignoring corrupted manifest cache %s: %s", dir, err)
+		return nil
+	}
+	if c.data, err = ioutil.ReadFile(filepath.Join(dir, manifestCacheFile)); err != nil {
+		logrus.Warnf("Ignoring incomplete manifest cache %s: %s", dir, err)
+		return nil
+	}
+	c.sig, err = ioutil.ReadFile(filepath.Join(dir, manifestCacheSigFile))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Ignoring incomplete manifest cache %s: %s", dir, err)
+		return nil
+	}
+	return &c
+}
+
+// storeCachedManifest writes a verified manifest to the cache. The
+// metadata is written last, so that an interrupted write leaves a stale
+// validator at worst, which verification on load then catches.
+func (a *App) storeCachedManifest(osVersion string, c *cachedManifest) error {
+	dir := a.manifestCachePath(osVersion)
+	// Nothing is written in dry-run mode nor by read-only commands, not
+	// even the cache
+	if dir == "" || a.Conf.DryRun || a.Conf.ManifestCacheReadOnly {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", dir)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestCacheFile), c.data, 0644); err != nil {
+		return err
+	}
+	if c.sig != nil {
+		if err := writeFileAtomic(filepath.Join(dir, manifestCacheSigFile), c.sig, 0644); err != nil {
+			return err
+		}
+	} else if err := os.Remove(filepath.Join(dir, manifestCacheSigFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c.meta.Fetched = time.Now().UTC().Format(time.RFC3339)
+	meta, err := json.Marshal(c.meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestCacheMetaFile), meta, 0644)
+}
+
+// verifyManifest checks the signature of a raw manifest fetched from url,
+// unless signature verification is disabled.
+func (a *App) verifyManifest(url string, data, sig []byte) error {
+	if a.Conf.NoVerifySig {
+		return nil
+	}
+	if sig == nil {
+		return errors.New("missing manifest signature")
+	}
+	if err := a.gpgVerify(url, bytes.NewReader(data), bytes.NewReader(sig)); err != nil {
+		return errors.Wrap(err, "gpg validation failed")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// newTestSigner generates a signing key and writes its armored public
+// keyring to path.
+func newTestSigner(t *testing.T, path string) *openpgp.Entity {
+	e, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Self-signs identities
+	if err := e.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// testSign returns an armored detached signature of data
+func testSign(t *testing.T, e *openpgp.Entity, data []byte) []byte {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, e, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestManifestCache(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyring := filepath.Join(tmpDir, "pubring.gpg")
+	signer := newTestSigner(t, keyring)
+	manif, err := ioutil.ReadFile("../testdata/package-manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := testSign(t, signer, manif)
+
+	var full, notModified int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/amd64-usr/9999.0.0/torcx_manifest.json":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			full++
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(manif)
+		case "/amd64-usr/9999.0.0/torcx_manifest.json.asc":
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	newApp := func() *App {
+		return &App{
+			Board: "amd64-usr",
+			Conf: Config{
+				GpgKeyringPath:   keyring,
+				ManifestCacheDir: filepath.Join(tmpDir, "cache"),
+				TorcxManifestURLs: []*template.Template{
+					template.Must(template.New("").Parse(ts.URL + "/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+				},
+			},
+			packageManifestCache: map[string]*PackageManifest{},
+		}
+	}
+	cacheDir := filepath.Join(tmpDir, "cache", "amd64-usr", "9999.0.0")
+
+	_, err = newApp().GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.Equal(1, full)
+	assert.Equal([]string{"meta.json", "torcx_manifest.json", "torcx_manifest.json.asc"}, listDir(t, cacheDir))
+
+	// Revalidated with a conditional request
+	m, err := newApp().GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.NotNil(m.findVersion("docker", "17.06"))
+	assert.Equal(1, full)
+	assert.Equal(1, notModified)
+
+	// A corrupted cache entry fails verification and is fetched again
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "torcx_manifest.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newApp().GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.Equal(2, full)
+	assert.Equal(2, notModified)
+
+	// Read-only commands don't populate the cache
+	ro := newApp()
+	ro.Conf.ManifestCacheDir = filepath.Join(tmpDir, "ro-cache")
+	ro.Conf.ManifestCacheReadOnly = true
+	_, err = ro.GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.Equal(3, full)
+	_, err = os.Stat(ro.Conf.ManifestCacheDir)
+	assert.True(os.IsNotExist(err))
+
+	// Unreachable bucket, the cache is used
+	ts.Close()
+	m, err = newApp().GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.NotNil(m.findVersion("docker", "17.06"))
+
+	// But not if it fails verification
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "torcx_manifest.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newApp().GetPackageManifest("9999.0.0")
+	assert.NotNil(err)
+}
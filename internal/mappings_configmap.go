@@ -0,0 +1,193 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// MappingsPriorityAnnotation sets the precedence of a runtime-mappings
+// ConfigMap when merging several of them; higher values win.
+const MappingsPriorityAnnotation = "tectonic-torcx.coreos.com/mappings-priority"
+
+// mappingsSource is the raw runtime mappings from a ConfigMap
+type mappingsSource struct {
+	name     string
+	priority int
+	data     string
+}
+
+// mappingsFromAPIServer connects to the APIServer and returns the raw
+// runtime mappings from the relevant ConfigMaps, highest precedence first.
+func (a *App) mappingsFromAPIServer() ([]mappingsSource, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build kubeconfig")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build kube client")
+	}
+
+	ns := a.Conf.MappingsNamespace
+	var sources []mappingsSource
+	err = retry(3, 10, func() error {
+		cmi := client.ConfigMaps(ns)
+		if cmi == nil {
+			return errors.Errorf("nil ConfigMapInterface for namespace %s", ns)
+		}
+		var e error
+		sources, e = a.fetchMappingsSources(cmi)
+		return e
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get runtime mappings ConfigMaps in %s", ns)
+	}
+	return sources, nil
+}
+
+// fetchMappingsSources gets the configured ConfigMap, plus the ones
+// matching the label selector if any. Without a selector, the configured
+// ConfigMap must exist.
+func (a *App) fetchMappingsSources(cmi v1core.ConfigMapInterface) ([]mappingsSource, error) {
+	name, key, selector := a.Conf.MappingsConfigMap, a.Conf.MappingsKey, a.Conf.MappingsSelector
+
+	cms := []v1.ConfigMap{}
+	if name != "" {
+		cm, err := cmi.Get(name, meta_v1.GetOptions{})
+		switch {
+		case err == nil && cm != nil:
+			cms = append(cms, *cm)
+		case selector != "" && k8serrors.IsNotFound(err):
+			logrus.Debugf("No ConfigMap %s, only using selector %q", name, selector)
+		case err != nil:
+			return nil, err
+		}
+	}
+	if selector != "" {
+		list, err := cmi.List(meta_v1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, cm := range list.Items {
+			if cm.Name != name {
+				cms = append(cms, cm)
+			}
+		}
+	}
+
+	sources := []mappingsSource{}
+	for _, cm := range cms {
+		data := cm.Data[key]
+		if data == "" {
+			if cm.Name == name && selector == "" {
+				return nil, errors.Errorf("missing entry %s/%s", name, key)
+			}
+			logrus.Warnf("Ignoring ConfigMap %s without entry %s", cm.Name, key)
+			continue
+		}
+		priority := 0
+		if p, ok := cm.Annotations[MappingsPriorityAnnotation]; ok {
+			var err error
+			if priority, err = strconv.Atoi(p); err != nil {
+				return nil, errors.Errorf("invalid %s annotation %q on ConfigMap %s", MappingsPriorityAnnotation, p, cm.Name)
+			}
+		}
+		logrus.Debugf("Got %s from ConfigMap %s/%s", key, cm.Namespace, cm.Name)
+		sources = append(sources, mappingsSource{name: cm.Name, priority: priority, data: data})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no runtime mappings found")
+	}
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		if sources[i].priority != sources[j].priority {
+			return sources[i].priority > sources[j].priority
+		}
+		return sources[i].name < sources[j].name
+	})
+	return sources, nil
+}
+
+// mergeMappingsSources parses runtime mappings from several sources,
+// highest precedence first.
+func mergeMappingsSources(sources []mappingsSource) (RuntimeMappings, error) {
+	if len(sources) == 1 {
+		return parseVersionManifest([]byte(sources[0].data))
+	}
+
+	merged := mergedMappings{}
+	for _, s := range sources {
+		m, err := parseVersionManifest([]byte(s.data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid runtime mappings in ConfigMap %s", s.name)
+		}
+		merged = append(merged, m)
+	}
+	return merged, nil
+}
+
+// mergedMappings are runtime mappings from several sources, highest
+// precedence first. Each source is asked in turn with its own rules (e.g.
+// V2 overrides before ranges), so that the first one with a matching rule
+// wins for a component, and the next ones are only used for the others.
+type mergedMappings []RuntimeMappings
+
+func (mm mergedMappings) VersionFor(haveName, haveVersion, wantName string) ([]string, error) {
+	var err error
+	for _, m := range mm {
+		var wv []string
+		if wv, err = m.VersionFor(haveName, haveVersion, wantName); err == nil {
+			return wv, nil
+		}
+	}
+	return nil, err
+}
+
+func (mm mergedMappings) componentsFor(haveName, haveVersion string) ([]string, error) {
+	var err error
+	names := []string{}
+	for _, m := range mm {
+		var cs []string
+		if cs, err = m.componentsFor(haveName, haveVersion); err == nil {
+			names = appendUnique(names, cs...)
+		}
+	}
+	if len(names) == 0 {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (mm mergedMappings) entries(haveName string) []mappingEntry {
+	entries := []mappingEntry{}
+	for _, m := range mm {
+		entries = append(entries, m.entries(haveName)...)
+	}
+	return entries
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testAPIServer serves ConfigMaps in namespace "torcx"; list requests
+// return the ConfigMaps named in selected.
+func testAPIServer(t *testing.T, cms map[string]map[string]interface{}, selected []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		prefix := "/api/v1/namespaces/torcx/configmaps"
+		var obj interface{}
+		switch {
+		case r.URL.Path == prefix && r.URL.Query().Get("labelSelector") == "torcx=mappings":
+			items := []interface{}{}
+			for _, name := range selected {
+				items = append(items, cms[name])
+			}
+			obj = map[string]interface{}{"kind": "ConfigMapList", "apiVersion": "v1", "items": items}
+		case filepath.Dir(r.URL.Path) == prefix && cms[filepath.Base(r.URL.Path)] != nil:
+			obj = cms[filepath.Base(r.URL.Path)]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			obj = map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}
+		}
+		if err := json.NewEncoder(w).Encode(obj); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+// writeTestKubeconfig writes a kubeconfig for the api-server at url
+func writeTestKubeconfig(t *testing.T, dir, url string) string {
+	path := filepath.Join(dir, "kubeconfig")
+	kc := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`, url)
+	if err := ioutil.WriteFile(path, []byte(kc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testConfigMap(name, priority, data string) map[string]interface{} {
+	meta := map[string]interface{}{"name": name, "namespace": "torcx"}
+	if priority != "" {
+		meta["annotations"] = map[string]string{MappingsPriorityAnnotation: priority}
+	}
+	return map[string]interface{}{
+		"kind":       "ConfigMap",
+		"apiVersion": "v1",
+		"metadata":   meta,
+		"data":       map[string]string{"mappings": data},
+	}
+}
+
+func TestMappingsFromAPIServer(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cms := map[string]map[string]interface{}{
+		"base": testConfigMap("base", "", `
+kind: VersionManifestV1
+versions:
+  k8s:
+    1.8:
+        docker: [ "1.12" ]
+        cni: [ "0.5" ]
+`),
+		"hotfix": testConfigMap("hotfix", "10", `
+kind: VersionManifestV2
+versions:
+  k8s:
+    - range: ">=1.8.3 <1.9.0"
+      docker: [ "17.03" ]
+`),
+		"empty": testConfigMap("empty", "20", ""),
+	}
+	ts := testAPIServer(t, cms, []string{"empty", "hotfix", "base"})
+	defer ts.Close()
+
+	kubeconfig := writeTestKubeconfig(t, tmpDir, ts.URL)
+	localPath := filepath.Join(tmpDir, "runtime-mappings.yaml")
+	if err := ioutil.WriteFile(localPath, []byte("kind: VersionManifestV1\nversions:\n  k8s:\n    1.8:\n        docker: [ \"local\" ]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newApp := func(c Config) *App {
+		c.Kubeconfig = kubeconfig
+		c.VersionManifestPath = localPath
+		c.MappingsNamespace = "torcx"
+		c.MappingsKey = "mappings"
+		c.SkipTorcxSetup = true
+		a, err := NewApp(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	versionFor := func(m RuntimeMappings, k8s, name string) []string {
+		v, err := m.VersionFor("k8s", k8s, name)
+		assert.Nil(err)
+		return v
+	}
+
+	// A single ConfigMap
+	a := newApp(Config{MappingsConfigMap: "base"})
+	m, err := a.GetVersionManifest(false)
+	assert.Nil(err)
+	assert.Equal([]string{"1.12"}, versionFor(m, "1.8.4", "docker"))
+
+	// The hook only reads the ConfigMap if configured to
+	m, err = a.GetVersionManifest(true)
+	assert.Nil(err)
+	assert.Equal([]string{"local"}, versionFor(m, "1.8.4", "docker"))
+	a.Conf.MappingsFromAPIServer = true
+	m, err = a.GetVersionManifest(true)
+	assert.Nil(err)
+	assert.Equal([]string{"1.12"}, versionFor(m, "1.8.4", "docker"))
+
+	// Merged ConfigMaps, by priority
+	a = newApp(Config{MappingsConfigMap: "base", MappingsSelector: "torcx=mappings"})
+	sources, err := a.mappingsFromAPIServer()
+	assert.Nil(err)
+	names := []string{}
+	for _, s := range sources {
+		names = append(names, s.name)
+	}
+	assert.Equal([]string{"hotfix", "base"}, names)
+
+	m, err = a.GetVersionManifest(false)
+	assert.Nil(err)
+	assert.Equal([]string{"17.03"}, versionFor(m, "1.8.4", "docker"))
+	assert.Equal([]string{"1.12"}, versionFor(m, "1.8.2", "docker"))
+	assert.Equal([]string{"0.5"}, versionFor(m, "1.8.4", "cni"))
+	names, err = m.componentsFor("k8s", "1.8.4")
+	assert.Nil(err)
+	assert.True(reflect.DeepEqual([]string{"cni", "docker"}, names))
+
+	// The named ConfigMap is optional with a selector
+	a = newApp(Config{MappingsConfigMap: "missing", MappingsSelector: "torcx=mappings"})
+	sources, err = a.mappingsFromAPIServer()
+	assert.Nil(err)
+	assert.Equal(2, len(sources))
+}
+
+func TestMergeMappingsSources(t *testing.T) {
+	assert := assert.New(t)
+
+	hotfix := `kind: VersionManifestV2
+versions:
+  k8s:
+    - range: ">=1.8.0 <1.9.0"
+      docker: ["17.03"]
+`
+	base := `kind: VersionManifestV2
+versions:
+  k8s:
+    - range: "1.8.4"
+      docker: ["1.12"]
+      cni: ["0.6"]
+    - range: ">=1.8.0 <1.9.0"
+      cni: ["0.5"]
+`
+	legacy := `kind: VersionManifestV1
+versions:
+  k8s:
+    "1.7":
+      docker: ["1.12"]
+`
+	m, err := mergeMappingsSources([]mappingsSource{
+		{name: "hotfix", priority: 10, data: hotfix},
+		{name: "base", data: base},
+		{name: "legacy", priority: -1, data: legacy},
+	})
+	assert.Nil(err)
+
+	// An override in a lower-priority source doesn't beat a range
+	wv, err := m.VersionFor("k8s", "1.8.4+coreos.0", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"17.03"}, wv)
+	// but applies to components the higher-priority one doesn't list
+	wv, err = m.VersionFor("k8s", "1.8.4+coreos.0", "cni")
+	assert.Nil(err)
+	assert.Equal([]string{"0.6"}, wv)
+	wv, err = m.VersionFor("k8s", "1.8.2", "cni")
+	assert.Nil(err)
+	assert.Equal([]string{"0.5"}, wv)
+	wv, err = m.VersionFor("k8s", "1.7.9", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"1.12"}, wv)
+	_, err = m.VersionFor("k8s", "1.9.0", "docker")
+	assert.NotNil(err)
+
+	names, err := m.componentsFor("k8s", "1.8.4")
+	assert.Nil(err)
+	assert.Equal([]string{"cni", "docker"}, names)
+	assert.Equal(4, len(m.entries("k8s")))
+
+	_, err = mergeMappingsSources([]mappingsSource{{name: "hotfix", data: hotfix}, {name: "bad", data: "kind: Other"}})
+	assert.NotNil(err)
+}
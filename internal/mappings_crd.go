@@ -0,0 +1,272 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Sources of runtime mappings on the api-server
+const (
+	// MappingsSourceConfigMap reads runtime mappings from ConfigMaps
+	MappingsSourceConfigMap = "configmap"
+	// MappingsSourceCRD reads runtime mappings from a TorcxRuntimeMapping
+	MappingsSourceCRD = "crd"
+)
+
+const (
+	// TorcxRuntimeMappingGroup is the API group of TorcxRuntimeMapping
+	TorcxRuntimeMappingGroup = "tectonic-torcx.coreos.com"
+	// TorcxRuntimeMappingVersion is the API version of TorcxRuntimeMapping
+	TorcxRuntimeMappingVersion = "v1alpha1"
+	// TorcxRuntimeMappingName is the default TorcxRuntimeMapping to use
+	TorcxRuntimeMappingName = "default"
+
+	torcxRuntimeMappingKind     = "TorcxRuntimeMapping"
+	torcxRuntimeMappingResource = "torcxruntimemappings"
+)
+
+// TorcxRuntimeMapping is a cluster-scoped custom resource holding runtime
+// mappings, as a typed alternative to the runtime-mappings ConfigMap. Its
+// status reports the versions each node picked.
+type TorcxRuntimeMapping struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TorcxRuntimeMappingSpec   `json:"spec"`
+	Status TorcxRuntimeMappingStatus `json:"status,omitempty"`
+}
+
+// TorcxRuntimeMappingSpec maps version ranges of a component (e.g. k8s)
+// to the ordered preferred versions of runtime components, with the same
+// semantics as a VersionManifestV2.
+type TorcxRuntimeMappingSpec struct {
+	Versions map[string][]TorcxRuntimeMappingRule `json:"versions"`
+}
+
+// TorcxRuntimeMappingRule lists the preferred versions of components, keyed
+// by name, for a range of versions of another one.
+type TorcxRuntimeMappingRule struct {
+	Range      string              `json:"range"`
+	Components map[string][]string `json:"components"`
+}
+
+// TorcxRuntimeMappingStatus is the latest resolution result of each node,
+// keyed by node name.
+type TorcxRuntimeMappingStatus struct {
+	Nodes map[string]TorcxRuntimeMappingNodeStatus `json:"nodes,omitempty"`
+}
+
+// TorcxRuntimeMappingNodeStatus describes the runtime components a node
+// picked. Fields are never omitted, so that a merge patch replaces them.
+type TorcxRuntimeMappingNodeStatus struct {
+	OSVersion     string `json:"osVersion"`
+	NextOSVersion string `json:"nextOSVersion"`
+	K8sVersion    string `json:"k8sVersion"`
+	// Where the kubernetes version was determined from
+	K8sVersionSource string                 `json:"k8sVersionSource"`
+	Components       []TorcxComponentStatus `json:"components"`
+	// Fallback versions picked instead of preferred ones, empty if none
+	Fallbacks  string `json:"fallbacks"`
+	LastUpdate string `json:"lastUpdate"`
+}
+
+// TorcxComponentStatus is the version of a runtime component picked for
+// some OS versions.
+type TorcxComponentStatus struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	OSVersions []string `json:"osVersions"`
+}
+
+// validMappingsSource returns true if source is known; empty means
+// MappingsSourceConfigMap.
+func validMappingsSource(source string) bool {
+	switch source {
+	case MappingsSourceConfigMap, MappingsSourceCRD, "":
+		return true
+	}
+	return false
+}
+
+// versionManifest validates the spec and converts it to a VersionManifestV2
+func (m *TorcxRuntimeMapping) versionManifest() (*VersionManifestV2, error) {
+	if len(m.Spec.Versions) == 0 {
+		return nil, errors.Errorf("%s %s has no versions", torcxRuntimeMappingKind, m.Name)
+	}
+
+	v2 := VersionManifestV2{
+		Kind:     versionManifestV2Kind,
+		Versions: map[string][]VersionRule{},
+	}
+	for haveName, rules := range m.Spec.Versions {
+		for i, r := range rules {
+			if len(r.Components) == 0 {
+				return nil, errors.Errorf("%s rule %d has no components", haveName, i)
+			}
+			for name, prefs := range r.Components {
+				if name == "" || len(prefs) == 0 {
+					return nil, errors.Errorf("%s rule %d has no versions for component %q", haveName, i, name)
+				}
+			}
+			v2.Versions[haveName] = append(v2.Versions[haveName], VersionRule{
+				Range: r.Range,
+				Wants: r.Components,
+			})
+		}
+	}
+	if err := v2.compile(); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s %s", torcxRuntimeMappingKind, m.Name)
+	}
+	return &v2, nil
+}
+
+// torcxRuntimeMappingPath returns the API path of a TorcxRuntimeMapping
+func torcxRuntimeMappingPath(name string) string {
+	return fmt.Sprintf("/apis/%s/%s/%s/%s", TorcxRuntimeMappingGroup, TorcxRuntimeMappingVersion, torcxRuntimeMappingResource, name)
+}
+
+// kubeRESTClient returns a client for raw api-server requests
+func (a *App) kubeRESTClient() (rest.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build kubeconfig")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build kube client")
+	}
+	return client.CoreV1().RESTClient(), nil
+}
+
+// mappingsFromCRD connects to the APIServer and returns the configured
+// TorcxRuntimeMapping.
+func (a *App) mappingsFromCRD() (*TorcxRuntimeMapping, error) {
+	rc, err := a.kubeRESTClient()
+	if err != nil {
+		return nil, err
+	}
+
+	name := a.Conf.MappingsResource
+	var data []byte
+	err = retry(3, 10, func() error {
+		var e error
+		data, e = rc.Get().AbsPath(torcxRuntimeMappingPath(name)).DoRaw()
+		return e
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s", torcxRuntimeMappingKind, name)
+	}
+
+	m := TorcxRuntimeMapping{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s %s", torcxRuntimeMappingKind, name)
+	}
+	logrus.Debugf("Got runtime mappings from %s %s", torcxRuntimeMappingKind, name)
+	return &m, nil
+}
+
+// nodeMappingStatus returns the status of this node for the runtime
+// components selected for install.
+func (a *App) nodeMappingStatus(sels []AddonSelection) TorcxRuntimeMappingNodeStatus {
+	st := TorcxRuntimeMappingNodeStatus{
+		OSVersion:        a.CurrentOSVersion,
+		NextOSVersion:    a.NextOSVersion,
+		K8sVersion:       a.K8sVersion,
+		K8sVersionSource: a.K8sVersionSource,
+		Components:       []TorcxComponentStatus{},
+		Fallbacks:        a.fallbackSummary(),
+		LastUpdate:       time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, sel := range sels {
+		st.Components = append(st.Components, TorcxComponentStatus{
+			Name:       sel.Name,
+			Version:    sel.Version,
+			OSVersions: sel.OSVersions,
+		})
+	}
+	sort.Slice(st.Components, func(i, j int) bool {
+		return st.Components[i].Name < st.Components[j].Name
+	})
+	return st
+}
+
+// WriteMappingStatus records the runtime components selected for this node
+// in the status of the TorcxRuntimeMapping, if it is the source of runtime
+// mappings. Nodes only patch their own entry, so that they do not conflict.
+// Without the status subresource, the object itself is only patched with
+// MappingsStatusInObject, as this requires nodes to be able to change the
+// spec.
+func (a *App) WriteMappingStatus(sels []AddonSelection) error {
+	if a.Conf.MappingsSource != MappingsSourceCRD || a.Conf.NodeName == "" {
+		return nil
+	}
+
+	name := a.Conf.MappingsResource
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": TorcxRuntimeMappingStatus{
+			Nodes: map[string]TorcxRuntimeMappingNodeStatus{
+				a.Conf.NodeName: a.nodeMappingStatus(sels),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if a.dryRun(ActionMappingStatus, name, a.Conf.NodeName) {
+		return nil
+	}
+
+	logrus.Infof("Writing node %s status to %s %s", a.Conf.NodeName, torcxRuntimeMappingKind, name)
+	rc, err := a.kubeRESTClient()
+	if err != nil {
+		return err
+	}
+
+	path := torcxRuntimeMappingPath(name)
+	noSubresource := false
+	err = retry(3, 10, func() error {
+		_, e := rc.Patch(types.MergePatchType).AbsPath(path, "status").Body(patch).DoRaw()
+		if k8serrors.IsNotFound(e) {
+			// Without the status subresource, status is part of the object
+			if !a.Conf.MappingsStatusInObject {
+				noSubresource = true
+				return nil
+			}
+			_, e = rc.Patch(types.MergePatchType).AbsPath(path).Body(patch).DoRaw()
+		}
+		return e
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update %s %s status", torcxRuntimeMappingKind, name)
+	}
+	if noSubresource {
+		return errors.Errorf("failed to update %s %s status: no status subresource", torcxRuntimeMappingKind, name)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTorcxRuntimeMapping = `{
+  "apiVersion": "tectonic-torcx.coreos.com/v1alpha1",
+  "kind": "TorcxRuntimeMapping",
+  "metadata": {"name": "default"},
+  "spec": {
+    "versions": {
+      "k8s": [
+        {"range": "1.8.4", "components": {"docker": ["17.03.2"]}},
+        {"range": ">=1.8.0 <1.9.0", "components": {"docker": ["17.03", "1.12"], "cni": ["0.5"]}}
+      ]
+    }
+  }
+}`
+
+func TestTorcxRuntimeMappingSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	m := TorcxRuntimeMapping{}
+	assert.Nil(json.Unmarshal([]byte(testTorcxRuntimeMapping), &m))
+	v2, err := m.versionManifest()
+	assert.Nil(err)
+
+	versions, err := v2.VersionFor("k8s", "1.8.4", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"17.03.2"}, versions)
+	versions, err = v2.VersionFor("k8s", "1.8.4", "cni")
+	assert.Nil(err)
+	assert.Equal([]string{"0.5"}, versions)
+	versions, err = v2.VersionFor("k8s", "1.8.1", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"17.03", "1.12"}, versions)
+
+	invalid := []TorcxRuntimeMappingSpec{
+		{},
+		{Versions: map[string][]TorcxRuntimeMappingRule{"k8s": {{Range: ">=1.8.0"}}}},
+		{Versions: map[string][]TorcxRuntimeMappingRule{"k8s": {{Range: ">=1.8.0", Components: map[string][]string{"docker": {}}}}}},
+		{Versions: map[string][]TorcxRuntimeMappingRule{"k8s": {{Range: "~1.8", Components: map[string][]string{"docker": {"17.03"}}}}}},
+		{Versions: map[string][]TorcxRuntimeMappingRule{"k8s": {{Range: ">=1.8.0", Components: map[string][]string{"docker": {">=bad"}}}}}},
+	}
+	for i, spec := range invalid {
+		_, err := (&TorcxRuntimeMapping{Spec: spec}).versionManifest()
+		assert.NotNil(err, "spec %d", i)
+	}
+}
+
+func TestTorcxRuntimeMappingAPI(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := "/apis/tectonic-torcx.coreos.com/v1alpha1/torcxruntimemappings/default"
+	statusSubresource := true
+	served := testTorcxRuntimeMapping
+	var patches []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == path:
+			w.Write([]byte(served))
+		case r.Method == "PATCH" && (r.URL.Path == path || (statusSubresource && r.URL.Path == path+"/status")):
+			assert.Equal("application/merge-patch+json", r.Header.Get("Content-Type"))
+			body, _ := ioutil.ReadAll(r.Body)
+			patches = append(patches, r.URL.Path+" "+string(body))
+			w.Write([]byte(testTorcxRuntimeMapping))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+		}
+	}))
+	defer ts.Close()
+
+	a, err := NewApp(Config{
+		Kubeconfig:          writeTestKubeconfig(t, tmpDir, ts.URL),
+		VersionManifestPath: filepath.Join(tmpDir, "missing.yaml"),
+		MappingsSource:      MappingsSourceCRD,
+		NodeName:            "node-1",
+		SkipTorcxSetup:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := a.GetVersionManifest(false)
+	assert.Nil(err)
+	versions, err := m.VersionFor("k8s", "1.8.4", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"17.03.2"}, versions)
+
+	a.CurrentOSVersion = "1520.5.0"
+	a.NextOSVersion = "1520.6.0"
+	a.K8sVersion = "v1.8.4+coreos.0"
+	sels := []AddonSelection{
+		{Name: "docker", Version: "17.03.2", OSVersions: []string{"1520.5.0", "1520.6.0"}},
+		{Name: "cni", Version: "0.5", OSVersions: []string{"1520.6.0"}},
+	}
+	assert.Nil(a.WriteMappingStatus(sels))
+	assert.Equal(1, len(patches))
+
+	var patch struct {
+		Status TorcxRuntimeMappingStatus `json:"status"`
+	}
+	assert.Nil(json.Unmarshal([]byte(patches[0][len(path+"/status "):]), &patch))
+	st := patch.Status.Nodes["node-1"]
+	assert.Equal("1520.5.0", st.OSVersion)
+	assert.Equal("1520.6.0", st.NextOSVersion)
+	assert.Equal("v1.8.4+coreos.0", st.K8sVersion)
+	assert.Equal([]TorcxComponentStatus{
+		{Name: "cni", Version: "0.5", OSVersions: []string{"1520.6.0"}},
+		{Name: "docker", Version: "17.03.2", OSVersions: []string{"1520.5.0", "1520.6.0"}},
+	}, st.Components)
+	assert.Contains(patches[0], `"fallbacks":""`)
+
+	// Without the status subresource, the object itself is only patched
+	// when opted in
+	statusSubresource = false
+	patches = nil
+	assert.NotNil(a.WriteMappingStatus(sels))
+	assert.Equal(0, len(patches))
+	a.Conf.MappingsStatusInObject = true
+	assert.Nil(a.WriteMappingStatus(sels))
+	assert.Equal(1, len(patches))
+	assert.Contains(patches[0], path+` {"status"`)
+
+	// Nothing is written in dry-run mode, nor without a node name
+	patches = nil
+	a.Conf.DryRun = true
+	assert.Nil(a.WriteMappingStatus(sels))
+	assert.Equal(1, len(a.Plan.Steps))
+	assert.Equal(ActionMappingStatus, a.Plan.Steps[0].Action)
+	a.Conf.DryRun = false
+	a.Conf.NodeName = ""
+	assert.Nil(a.WriteMappingStatus(sels))
+	assert.Equal(0, len(patches))
+
+	// An invalid TorcxRuntimeMapping falls back to the local mappings
+	served = `{"kind": "TorcxRuntimeMapping", "metadata": {"name": "default"}, "spec": {}}`
+	_, err = a.GetVersionManifest(false)
+	assert.NotNil(err)
+	a.Conf.VersionManifestPath = filepath.Join(tmpDir, "runtime-mappings.yaml")
+	if err := ioutil.WriteFile(a.Conf.VersionManifestPath, []byte("kind: VersionManifestV1\nversions:\n  k8s:\n    1.8:\n        docker: [ \"local\" ]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = a.GetVersionManifest(false)
+	assert.Nil(err)
+	versions, err = m.VersionFor("k8s", "1.8.4", "docker")
+	assert.Nil(err)
+	assert.Equal([]string{"local"}, versions)
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MappingsReport is the result of checking the runtime mappings against the
+// package manifests published for a board and a set of OS versions.
+type MappingsReport struct {
+	Board      string   `json:"board"`
+	OSVersions []string `json:"osVersions"`
+	// OS versions too old for torcx, which were not checked
+	Skipped []string `json:"skipped,omitempty"`
+	// Package manifests which could not be fetched, keyed by OS version
+	ManifestErrors map[string]string `json:"manifestErrors,omitempty"`
+
+	Entries []MappingsEntry `json:"entries"`
+}
+
+// MappingsEntry reports on the preferred versions of a component for a
+// kubernetes version (V1) or range (V2).
+type MappingsEntry struct {
+	K8s         string   `json:"k8s"`
+	Component   string   `json:"component"`
+	Preferences []string `json:"preferences"`
+	// Unparseable kubernetes version or preferences
+	Errors []string `json:"errors,omitempty"`
+	// Available versions matching the preferences, keyed by OS version
+	Available map[string][]string `json:"available"`
+	// Version which would be selected, keyed by OS version
+	Selected map[string]string `json:"selected"`
+	// OS versions for which no preference is available, i.e. which
+	// would hit NoVersionError
+	NoVersion []string `json:"noVersion,omitempty"`
+}
+
+// Problems returns the number of problems found
+func (r *MappingsReport) Problems() int {
+	n := len(r.ManifestErrors)
+	for _, e := range r.Entries {
+		n += len(e.Errors) + len(e.NoVersion)
+	}
+	return n
+}
+
+// String renders the report in a human-readable form
+func (r *MappingsReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Board %s, OS versions %s\n", r.Board, strings.Join(r.OSVersions, " "))
+	for _, e := range r.Entries {
+		fmt.Fprintf(&buf, "k8s %s, %s %v:\n", e.K8s, e.Component, e.Preferences)
+		for _, msg := range e.Errors {
+			fmt.Fprintf(&buf, "  error: %s\n", msg)
+		}
+		for _, osVersion := range r.OSVersions {
+			if selected, ok := e.Selected[osVersion]; ok {
+				fmt.Fprintf(&buf, "  %s: %s (available: %s)\n", osVersion, selected, strings.Join(e.Available[osVersion], " "))
+			}
+		}
+		for _, osVersion := range e.NoVersion {
+			fmt.Fprintf(&buf, "  %s: no version available\n", osVersion)
+		}
+	}
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(&buf, "Skipped OS versions too old for torcx: %s\n", strings.Join(r.Skipped, " "))
+	}
+	for _, osVersion := range r.OSVersions {
+		if msg, ok := r.ManifestErrors[osVersion]; ok {
+			fmt.Fprintf(&buf, "Failed to get package manifest for %s: %s\n", osVersion, msg)
+		}
+	}
+	fmt.Fprintf(&buf, "%d problem(s) found\n", r.Problems())
+	return buf.String()
+}
+
+// LintMappings checks the local runtime mappings against the package
+// manifests of the current board for each OS version, reporting which
+// preferred versions are available and which would be selected.
+func (a *App) LintMappings(osVersions []string) (*MappingsReport, error) {
+	m, err := a.lintVersionManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	r := MappingsReport{
+		Board:          a.Board,
+		ManifestErrors: map[string]string{},
+	}
+	manifests := map[string]*PackageManifest{}
+	for _, osVersion := range osVersions {
+		if shouldSkip(MinimumRemoteDocker, osVersion) {
+			r.Skipped = append(r.Skipped, osVersion)
+			continue
+		}
+		r.OSVersions = append(r.OSVersions, osVersion)
+		pm, err := a.GetPackageManifest(osVersion)
+		if err != nil {
+			logrus.Warnf("Could not get package manifest for %s: %s", osVersion, err)
+			r.ManifestErrors[osVersion] = err.Error()
+			continue
+		}
+		manifests[osVersion] = pm
+	}
+
+	for _, me := range m.entries("k8s") {
+		names := []string{}
+		for name := range me.wants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			r.Entries = append(r.Entries, lintMappingEntry(me.have, name, me.wants[name], r.OSVersions, manifests))
+		}
+	}
+	return &r, nil
+}
+
+// lintVersionManifest parses the local runtime mappings like
+// GetVersionManifest, except that V2 ranges and preferences are not
+// validated, so that invalid rules are reported individually instead of
+// rejecting the whole file.
+func (a *App) lintVersionManifest() (RuntimeMappings, error) {
+	path := a.Conf.VersionManifestPath
+	if path == "" {
+		return nil, errors.New("missing version manifest path")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read runtime mappings from %q", path)
+	}
+
+	header := struct {
+		Kind string `yaml:"kind"`
+	}{}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return nil, errors.Wrap(err, "failed to parse version manifest")
+	}
+	if header.Kind != versionManifestV2Kind {
+		return parseVersionManifest(data)
+	}
+	m := VersionManifestV2{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse version manifest")
+	}
+	return &m, nil
+}
+
+// lintMappingEntry checks the preferences for a component against the
+// manifests of each OS version
+func lintMappingEntry(k8s, name string, prefs []string, osVersions []string, manifests map[string]*PackageManifest) MappingsEntry {
+	e := MappingsEntry{
+		K8s:         k8s,
+		Component:   name,
+		Preferences: prefs,
+		Available:   map[string][]string{},
+		Selected:    map[string]string{},
+	}
+	if _, err := ParseVersionRange(k8s); err != nil {
+		e.Errors = append(e.Errors, fmt.Sprintf("invalid k8s version %q", k8s))
+	}
+
+	valid := []string{}
+	for _, pref := range prefs {
+		var err error
+		if isVersionConstraint(pref) {
+			_, err = ParseVersionRange(pref)
+		} else {
+			_, err = parseLooseVersion(pref)
+		}
+		if err != nil {
+			e.Errors = append(e.Errors, fmt.Sprintf("invalid %s preference %q", name, pref))
+			continue
+		}
+		valid = append(valid, pref)
+	}
+
+	for _, osVersion := range osVersions {
+		pm, ok := manifests[osVersion]
+		if !ok {
+			continue
+		}
+		available := []string{}
+		for _, pref := range valid {
+			if version := pm.resolveVersion(name, pref); version != "" {
+				available = appendUnique(available, version)
+			}
+		}
+		if len(available) == 0 {
+			e.NoVersion = append(e.NoVersion, osVersion)
+			continue
+		}
+		e.Available[osVersion] = available
+		e.Selected[osVersion] = available[0]
+	}
+	return e
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintMappings(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mappings := `
+kind: VersionManifestV1
+versions:
+  k8s:
+    1.7:
+        docker: [ "1.12" ]
+    1.8:
+        docker: [ "17.03", ">=1.12 <1.13", "17.x" ]
+    next:
+        docker: [ "17.09" ]
+`
+	path := filepath.Join(tmpDir, "runtime-mappings.yaml")
+	if err := ioutil.WriteFile(path, []byte(mappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := App{
+		Board: "amd64-usr",
+		Conf:  Config{VersionManifestPath: path},
+		packageManifestCache: map[string]*PackageManifest{
+			"9998.0.0": makeManifest([]string{"1.12"}),
+			"9999.0.0": makeManifest([]string{"17.03"}),
+		},
+	}
+
+	r, err := a.LintMappings([]string{"1500.0.0", "9998.0.0", "9999.0.0"})
+	assert.Nil(err)
+	assert.Equal([]string{"1500.0.0"}, r.Skipped)
+	assert.Equal([]string{"9998.0.0", "9999.0.0"}, r.OSVersions)
+	assert.Equal(3, len(r.Entries))
+
+	e := r.Entries[0]
+	assert.Equal("1.7", e.K8s)
+	assert.Equal(map[string]string{"9998.0.0": "1.12"}, e.Selected)
+	assert.Equal([]string{"9999.0.0"}, e.NoVersion)
+	assert.Empty(e.Errors)
+
+	e = r.Entries[1]
+	assert.Equal("1.8", e.K8s)
+	assert.Equal(map[string]string{"9998.0.0": "1.12", "9999.0.0": "17.03"}, e.Selected)
+	assert.Empty(e.NoVersion)
+	assert.Equal([]string{`invalid docker preference "17.x"`}, e.Errors)
+
+	e = r.Entries[2]
+	assert.Equal("next", e.K8s)
+	assert.Equal([]string{"9998.0.0", "9999.0.0"}, e.NoVersion)
+	assert.Equal([]string{`invalid k8s version "next"`}, e.Errors)
+
+	assert.Equal(5, r.Problems())
+	assert.True(strings.HasSuffix(r.String(), "5 problem(s) found\n"))
+	assert.Contains(r.String(), "  9999.0.0: 17.03 (available: 17.03)\n")
+
+	// Unreachable manifests are reported
+	r, err = a.LintMappings([]string{"9997.0.0"})
+	assert.Nil(err)
+	assert.Contains(r.ManifestErrors, "9997.0.0")
+	// Invalid V2 rules are reported individually
+	mappings = `
+kind: VersionManifestV2
+versions:
+  k8s:
+    - range: "1.8.4"
+      docker: [ "17.03" ]
+    - range: ">=1.8.0 <1.9.0"
+      docker: [ "17.03", ">=1.12 <>1.13", "17.x" ]
+    - range: ">=next"
+      docker: [ "17.09" ]
+`
+	if err := ioutil.WriteFile(path, []byte(mappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.GetVersionManifest(true)
+	assert.NotNil(err)
+
+	r, err = a.LintMappings([]string{"9998.0.0", "9999.0.0"})
+	assert.Nil(err)
+	assert.Equal(3, len(r.Entries))
+
+	e = r.Entries[0]
+	assert.Equal("1.8.4", e.K8s)
+	assert.Equal(map[string]string{"9999.0.0": "17.03"}, e.Selected)
+	assert.Empty(e.Errors)
+
+	e = r.Entries[1]
+	assert.Equal(">=1.8.0 <1.9.0", e.K8s)
+	assert.Equal(map[string]string{"9999.0.0": "17.03"}, e.Selected)
+	assert.Equal([]string{`invalid docker preference ">=1.12 <>1.13"`, `invalid docker preference "17.x"`}, e.Errors)
+
+	e = r.Entries[2]
+	assert.Equal(">=next", e.K8s)
+	assert.Equal([]string{`invalid k8s version ">=next"`}, e.Errors)
+}
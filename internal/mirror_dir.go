@@ -0,0 +1,153 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// dirSink writes artifacts to a directory, with the same layout as the
+// upstream bucket. Files are replaced atomically, so that the directory
+// can be served while being synced.
+type dirSink struct {
+	dir string
+}
+
+// NewDirSink returns a sink writing artifacts below dir
+func NewDirSink(dir string) ArtifactSink {
+	return &dirSink{dir: dir}
+}
+
+func (s *dirSink) Add(path string, r io.Reader, size int64) error {
+	dest := filepath.Join(s.dir, filepath.FromSlash(path))
+	destDir := filepath.Dir(dest)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", destDir)
+	}
+
+	tmp, err := ioutil.TempFile(destDir, "."+filepath.Base(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.CopyN(tmp, r, size); err != nil {
+		return errors.Wrapf(err, "failed to write %s", dest)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return errors.Wrapf(err, "failed to write %s", dest)
+	}
+	return syncDir(destDir)
+}
+
+func (s *dirSink) Has(path string, v *PackageVersion) bool {
+	ok, _ := v.validateFile(filepath.Join(s.dir, filepath.FromSlash(path)))
+	return ok
+}
+
+func (s *dirSink) Close() error {
+	return nil
+}
+
+// SyncMirror populates dir with the package manifests for every board and
+// OS version, plus the addons they provide for the runtime component
+// versions in the runtime mappings. Addons already present with the right hash are kept.
+func (a *App) SyncMirror(dir string, boards, osVersions []string) (*BundleIndex, error) {
+	index := BundleIndex{
+		Kind:      bundleIndexKind,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Origins:   []string{},
+		Manifests: []BundleManifest{},
+		Addons:    []BundleAddon{},
+	}
+	sink := NewDirSink(dir)
+
+	for _, board := range boards {
+		a.Board = board
+		if err := a.exportArtifacts(sink, osVersions, &index); err != nil {
+			return nil, errors.Wrapf(err, "failed to sync board %s", board)
+		}
+	}
+	return &index, sink.Close()
+}
+
+// MirrorOSVersions returns the OS versions with a package manifest for
+// board in a mirror (or bundle) directory, oldest first.
+func MirrorOSVersions(dir, board string) ([]string, error) {
+	boardDir := filepath.Join(dir, "manifests", board)
+	entries, err := ioutil.ReadDir(boardDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", boardDir)
+	}
+
+	versions := []*semver.Version{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(boardDir, e.Name(), "torcx_manifest.json")); err != nil {
+			continue
+		}
+		v, err := semver.NewVersion(e.Name())
+		if err != nil {
+			logrus.Debugf("Ignoring %s in %s: %s", e.Name(), boardDir, err)
+			continue
+		}
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+
+	osVersions := []string{}
+	for _, v := range versions {
+		osVersions = append(osVersions, v.String())
+	}
+	return osVersions, nil
+}
+
+// MirrorHandler serves a mirror directory with the upstream URL layout.
+// Only manifests, signatures and addons are served.
+func MirrorHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logrus.Debugf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") || strings.Contains(r.URL.Path, "/.") {
+			// No directory listings nor partial (hidden) files
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
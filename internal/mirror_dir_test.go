@@ -0,0 +1,126 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncAndServeMirror(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mappingsPath := filepath.Join(tmpDir, "runtime-mappings.yaml")
+	if err := ioutil.WriteFile(mappingsPath, []byte(testMappings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("docker addon\n")
+	var hits int
+	upstream := testUpstream(content, &hits)
+	defer upstream.Close()
+
+	a := App{Conf: Config{
+		NoVerifySig:         true,
+		VersionManifestPath: mappingsPath,
+		torcxStoreDir:       filepath.Join(tmpDir, "store"),
+		TorcxManifestURLs: []*template.Template{
+			template.Must(template.New("").Parse(upstream.URL + "/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+		},
+	}}
+
+	mirrorDir := filepath.Join(tmpDir, "mirror")
+	index, err := a.SyncMirror(mirrorDir, []string{"amd64-usr"}, []string{"9999.0.0"})
+	assert.Nil(err)
+	assert.Equal(1, len(index.Addons))
+	assert.Equal(1, hits)
+	assert.Equal([]string{"torcx_manifest.json"}, listDir(t, filepath.Join(mirrorDir, "manifests/amd64-usr/9999.0.0")))
+
+	// Up to date addons are not fetched again
+	_, err = a.SyncMirror(mirrorDir, []string{"amd64-usr"}, []string{"9999.0.0"})
+	assert.Nil(err)
+	assert.Equal(1, hits)
+
+	// Nodes use the mirror for both manifests and addons
+	mirror := httptest.NewServer(MirrorHandler(mirrorDir))
+	defer mirror.Close()
+	upstream.Close()
+
+	b := App{
+		Board: "amd64-usr",
+		Conf: Config{
+			NoVerifySig:   true,
+			torcxStoreDir: filepath.Join(tmpDir, "store"),
+			TorcxManifestURLs: []*template.Template{
+				template.Must(template.New("").Parse(mirror.URL + "/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+			},
+			URLRewrites: []URLRewrite{{From: upstream.URL + "/", To: mirror.URL + "/"}},
+		},
+		packageManifestCache: map[string]*PackageManifest{},
+	}
+	m, err := b.GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	loc, err := m.LocationFor("docker", "17.03")
+	assert.Nil(err)
+	path, err := b.FetchAddon(loc)
+	assert.Nil(err)
+	defer os.Remove(path)
+
+	// No listings
+	resp, err := http.Get(mirror.URL + "/manifests/")
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMirrorOSVersions(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, v := range []string{"1520.8.0", "1576.1.0", "1520.10.0", "partial"} {
+		dir := filepath.Join(tmpDir, "manifests", "amd64-usr", v)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, filepath.Join(dir, "torcx_manifest.json"))
+	}
+	if err := os.MkdirAll(filepath.Join(tmpDir, "manifests", "amd64-usr", "1600.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := MirrorOSVersions(tmpDir, "amd64-usr")
+	assert.Nil(err)
+	assert.Equal([]string{"1520.8.0", "1520.10.0", "1576.1.0"}, versions)
+
+	_, err = MirrorOSVersions(tmpDir, "arm64-usr")
+	assert.NotNil(err)
+}
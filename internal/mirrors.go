@@ -0,0 +1,146 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorCooldown is how long a failing mirror is tried after healthy ones
+var mirrorCooldown = 10 * time.Minute
+
+// URLRewrite maps a URL prefix to a mirror prefix, e.g.
+// "https://tectonic-torcx.release.core-os.net/" to
+// "https://mirror.internal/torcx/".
+type URLRewrite struct {
+	From string
+	To   string
+}
+
+// ParseURLRewrite parses a rewrite rule in the "from=to" form
+func ParseURLRewrite(rule string) (URLRewrite, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return URLRewrite{}, errors.Errorf("invalid URL rewrite %q, expected from=to", rule)
+	}
+	return URLRewrite{From: parts[0], To: parts[1]}, nil
+}
+
+// mirrorHealth tracks failures per mirror (scheme and host), so that
+// mirrors which recently failed are tried last.
+type mirrorHealth struct {
+	sync.Mutex
+	lastFailure map[string]time.Time
+}
+
+func newMirrorHealth() *mirrorHealth {
+	return &mirrorHealth{lastFailure: map[string]time.Time{}}
+}
+
+// mirrorKey returns the part of a URL identifying a mirror
+func mirrorKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (h *mirrorHealth) failed(rawURL string) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastFailure[mirrorKey(rawURL)] = time.Now()
+}
+
+func (h *mirrorHealth) succeeded(rawURL string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.lastFailure, mirrorKey(rawURL))
+}
+
+func (h *mirrorHealth) healthy(rawURL string) bool {
+	h.Lock()
+	defer h.Unlock()
+	last, ok := h.lastFailure[mirrorKey(rawURL)]
+	return !ok || time.Since(last) > mirrorCooldown
+}
+
+// order sorts urls so that healthy mirrors come first, otherwise
+// preserving the configured preference.
+func (h *mirrorHealth) order(urls []string) []string {
+	out := append([]string{}, urls...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return h.healthy(out[i]) && !h.healthy(out[j])
+	})
+	return out
+}
+
+// candidateURLs returns the URLs to try for a remote asset: every
+// configured rewrite matching it, in order, then the original URL.
+func (a *App) candidateURLs(rawURL string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	add := func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+
+	for _, rw := range a.Conf.URLRewrites {
+		if strings.HasPrefix(rawURL, rw.From) {
+			add(rw.To + strings.TrimPrefix(rawURL, rw.From))
+		}
+	}
+	add(rawURL)
+	return out
+}
+
+// tryMirrors calls fetch for each URL, healthy mirrors first, until one
+// succeeds. Failing mirrors are recorded so that later downloads try
+// them last.
+func (a *App) tryMirrors(urls []string, fetch func(url string) error) error {
+	if len(urls) == 0 {
+		return errors.New("no URL to fetch from")
+	}
+	if a.mirrors == nil {
+		a.mirrors = newMirrorHealth()
+	}
+
+	var errs []string
+	var lastErr error
+	for _, u := range a.mirrors.order(urls) {
+		err := fetch(u)
+		if err == nil {
+			a.mirrors.succeeded(u)
+			return nil
+		}
+		a.mirrors.failed(u)
+		errs = append(errs, err.Error())
+		lastErr = err
+		logrus.Warnf("Failed to fetch from %s: %s", u, err)
+	}
+	if len(errs) == 1 {
+		return lastErr
+	}
+	return errors.Errorf("all %d mirrors failed: %s", len(errs), strings.Join(errs, "; "))
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCandidateURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseURLRewrite("https://example.com/")
+	assert.NotNil(err)
+	rw, err := ParseURLRewrite("https://tectonic-torcx.release.core-os.net/=https://mirror.internal/torcx/")
+	assert.Nil(err)
+
+	a := App{Conf: Config{URLRewrites: []URLRewrite{
+		rw,
+		{From: "https://tectonic-torcx.release.core-os.net/pkgs/", To: "file:///srv/pkgs/"},
+		{From: "https://other.example.com/", To: "https://unused/"},
+	}}}
+
+	assert.Equal([]string{
+		"https://mirror.internal/torcx/pkgs/docker.tgz",
+		"file:///srv/pkgs/docker.tgz",
+		"https://tectonic-torcx.release.core-os.net/pkgs/docker.tgz",
+	}, a.candidateURLs("https://tectonic-torcx.release.core-os.net/pkgs/docker.tgz"))
+	assert.Equal([]string{"https://example.com/a"}, a.candidateURLs("https://example.com/a"))
+}
+
+func TestMirrorHealthOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newMirrorHealth()
+	urls := []string{"https://a/x", "https://b/x", "https://c/x"}
+	assert.Equal(urls, h.order(urls))
+
+	h.failed("https://a/y")
+	assert.Equal([]string{"https://b/x", "https://c/x", "https://a/x"}, h.order(urls))
+
+	h.succeeded("https://a/z")
+	assert.Equal(urls, h.order(urls))
+}
+
+func TestFetchAddonFailover(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	content := []byte("docker addon\n")
+	var badHits, goodHits int
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits++
+		w.Write([]byte("tampered"))
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits++
+		w.Write(content)
+	}))
+	defer good.Close()
+
+	m := makeRemoteManifest("17.03", good.URL+"/pkgs/docker:17.03.torcx.tgz", content)
+	a := App{Conf: Config{
+		torcxStoreDir: storeDir,
+		URLRewrites:   []URLRewrite{{From: good.URL + "/", To: bad.URL + "/mirror/"}},
+	}}
+	loc, err := m.LocationFor("docker", "17.03")
+	assert.Nil(err)
+
+	// The mirror serves a corrupted addon, the original URL is used instead
+	path, err := a.FetchAddon(loc)
+	assert.Nil(err)
+	defer os.Remove(path)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(content, data)
+	assert.Equal(1, badHits)
+	assert.Equal(1, goodHits)
+
+	// The failing mirror is now tried last
+	path2, err := a.FetchAddon(loc)
+	assert.Nil(err)
+	defer os.Remove(path2)
+	assert.Equal(1, badHits)
+	assert.Equal(2, goodHits)
+}
+
+func TestGetPackageManifestFallback(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+
+	manif, err := ioutil.ReadFile("../testdata/package-manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/secondary/amd64-usr/9999.0.0/torcx_manifest.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(manif)
+	}))
+	defer ts.Close()
+
+	a := App{
+		Board: "amd64-usr",
+		Conf: Config{
+			NoVerifySig: true,
+			TorcxManifestURLs: []*template.Template{
+				template.Must(template.New("").Parse(ts.URL + "/primary/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+				template.Must(template.New("").Parse("https://unreachable.invalid/{{.Board}}/{{.OSVersion}}/torcx_manifest.json")),
+			},
+			URLRewrites: []URLRewrite{{From: "https://unreachable.invalid/", To: ts.URL + "/secondary/"}},
+		},
+		packageManifestCache: map[string]*PackageManifest{},
+	}
+
+	m, err := a.GetPackageManifest("9999.0.0")
+	assert.Nil(err)
+	assert.NotNil(m.findVersion("docker", "17.06"))
+	assert.Equal(m, a.packageManifestCache["9999.0.0"])
+}
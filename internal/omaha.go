@@ -0,0 +1,186 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// coreosAppID is the Omaha application ID of Container Linux
+	coreosAppID = "{e96281a6-d1af-4bde-9a0a-97b76e56dc57}"
+	// omahaTimeout is the deadline for an Omaha update check
+	omahaTimeout = 30 * time.Second
+)
+
+var (
+	// updateConfPaths are the update_engine configuration files, later
+	// ones overriding earlier ones
+	updateConfPaths = []string{"/usr/share/coreos/update.conf", "/etc/coreos/update.conf"}
+	// machineIDPath identifies the node to the update server
+	machineIDPath = "/etc/machine-id"
+)
+
+// updateConf is the update server and group (channel) of the node
+type updateConf struct {
+	Server string
+	Group  string
+}
+
+// readUpdateConf reads the update_engine configuration, like update_engine
+// does. Missing files are skipped.
+func readUpdateConf() (updateConf, error) {
+	conf := updateConf{}
+	for _, path := range updateConfPaths {
+		env, err := readEnvFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return conf, errors.Wrapf(err, "failed to read %s", path)
+		}
+		if v := env["SERVER"]; v != "" {
+			conf.Server = v
+		}
+		if v := env["GROUP"]; v != "" {
+			conf.Group = v
+		}
+	}
+	if conf.Server == "" || conf.Group == "" {
+		return conf, errors.Errorf("no update SERVER and GROUP found in %s", strings.Join(updateConfPaths, ", "))
+	}
+	return conf, nil
+}
+
+// omahaRequest is an Omaha v3 update check
+type omahaRequest struct {
+	XMLName   xml.Name `xml:"request"`
+	Protocol  string   `xml:"protocol,attr"`
+	Version   string   `xml:"version,attr"`
+	IsMachine string   `xml:"ismachine,attr"`
+	OS        omahaOS  `xml:"os"`
+	App       omahaApp `xml:"app"`
+}
+
+type omahaOS struct {
+	Platform string `xml:"platform,attr"`
+	Version  string `xml:"version,attr"`
+	SP       string `xml:"sp,attr"`
+}
+
+type omahaApp struct {
+	AppID       string           `xml:"appid,attr"`
+	Version     string           `xml:"version,attr"`
+	Track       string           `xml:"track,attr"`
+	Board       string           `xml:"board,attr"`
+	MachineID   string           `xml:"machineid,attr,omitempty"`
+	UpdateCheck omahaUpdateCheck `xml:"updatecheck"`
+	Status      string           `xml:"status,attr,omitempty"`
+}
+
+type omahaUpdateCheck struct {
+	Status   string         `xml:"status,attr,omitempty"`
+	Manifest *omahaManifest `xml:"manifest,omitempty"`
+}
+
+type omahaManifest struct {
+	Version string `xml:"version,attr"`
+}
+
+// omahaResponse is the answer to an omahaRequest
+type omahaResponse struct {
+	XMLName xml.Name   `xml:"response"`
+	Apps    []omahaApp `xml:"app"`
+}
+
+// OmahaNextVersion asks the update server for the OS version it would
+// offer to this node, without downloading nor installing anything. It
+// returns an empty string if there is no update.
+func (a *App) OmahaNextVersion() (string, error) {
+	conf, err := readUpdateConf()
+	if err != nil {
+		return "", err
+	}
+	machineID, err := ioutil.ReadFile(machineIDPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to read machine-id")
+	}
+
+	req := omahaRequest{
+		Protocol:  "3.0",
+		Version:   "tectonic-torcx",
+		IsMachine: "1",
+		OS: omahaOS{
+			Platform: "CoreOS",
+			Version:  "Chateau",
+			SP:       a.CurrentOSVersion,
+		},
+		App: omahaApp{
+			AppID:     coreosAppID,
+			Version:   a.CurrentOSVersion,
+			Track:     conf.Group,
+			Board:     a.Board,
+			MachineID: strings.TrimSpace(string(machineID)),
+		},
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Debugf("Querying update server %s for %s updates", conf.Server, conf.Group)
+	client := http.Client{Timeout: omahaTimeout}
+	resp, err := client.Post(conf.Server, "text/xml", bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return "", errors.Wrap(err, "update check failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("update check failed: %s", resp.Status)
+	}
+
+	r := omahaResponse{}
+	if err := xml.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", errors.Wrap(err, "failed to parse update check response")
+	}
+	for _, app := range r.Apps {
+		if app.AppID != coreosAppID {
+			continue
+		}
+		if app.Status != "" && app.Status != "ok" {
+			return "", errors.Errorf("update check failed: app status %q", app.Status)
+		}
+		switch uc := app.UpdateCheck; uc.Status {
+		case "ok":
+			if uc.Manifest == nil || uc.Manifest.Version == "" {
+				return "", errors.New("update check response has no version")
+			}
+			return uc.Manifest.Version, nil
+		case "noupdate":
+			return "", nil
+		default:
+			return "", errors.Errorf("update check failed: status %q", uc.Status)
+		}
+	}
+	return "", errors.New("update check response has no Container Linux app")
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/stretchr/testify/assert"
+)
+
+// testOmahaServer is a local Omaha stand-in offering version to nodes of
+// the "beta" group, or nothing if version is empty.
+func testOmahaServer(t *testing.T, version *string, requests *[]omahaRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := omahaRequest{}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, req)
+
+		uc := `<updatecheck status="noupdate"></updatecheck>`
+		if *version != "" && req.App.Track == "beta" {
+			uc = fmt.Sprintf(`<updatecheck status="ok">
+      <urls><url codebase="https://update.release.core-os.net/amd64-usr/%[1]s/"></url></urls>
+      <manifest version="%[1]s">
+        <packages><package hash="x" name="update.gz" size="1000" required="false"></package></packages>
+      </manifest>
+    </updatecheck>`, *version)
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<response protocol="3.0" server="test">
+  <daystart elapsed_seconds="0"></daystart>
+  <app appid="%s" status="ok">
+    %s
+  </app>
+</response>`, req.App.AppID, uc)
+	}))
+}
+
+func TestOmahaNextVersion(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	offered := "1520.6.0"
+	requests := []omahaRequest{}
+	ts := testOmahaServer(t, &offered, &requests)
+	defer ts.Close()
+
+	// The default configuration, overridden by the node's
+	confPaths, idPath := updateConfPaths, machineIDPath
+	defer func() { updateConfPaths, machineIDPath = confPaths, idPath }()
+	updateConfPaths = []string{filepath.Join(tmpDir, "usr-update.conf"), filepath.Join(tmpDir, "etc-update.conf")}
+	machineIDPath = filepath.Join(tmpDir, "machine-id")
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(updateConfPaths[0], "SERVER=http://127.0.0.1:1/v1/update/\nGROUP=stable\n")
+	write(updateConfPaths[1], fmt.Sprintf("GROUP=beta\nSERVER=%s/v1/update/\n", ts.URL))
+	write(machineIDPath, "0123456789abcdef\n")
+
+	newApp := func(ueOperation string) *App {
+		return &App{
+			Board:            "amd64-usr",
+			CurrentOSVersion: "1520.5.0",
+			Conf: Config{
+				OmahaLookup:  true,
+				updateEngine: newFakeUpdateEngine(ueOperation, nil),
+			},
+		}
+	}
+
+	a := newApp(updateengine.UpdateStatusIdle)
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("1520.6.0", a.NextOSVersion)
+	assert.Equal(NextOSVersionOmaha, a.NextOSVersionSource)
+	assert.Equal(1, len(requests))
+	req := requests[0]
+	assert.Equal(coreosAppID, req.App.AppID)
+	assert.Equal("beta", req.App.Track)
+	assert.Equal("1520.5.0", req.App.Version)
+	assert.Equal("amd64-usr", req.App.Board)
+	assert.Equal("0123456789abcdef", req.App.MachineID)
+
+	// A staged update wins, without asking the update server
+	a = newApp(updateengine.UpdateStatusUpdatedNeedReboot)
+	a.Conf.updateEngine.(*fakeUpdateEngine).current.NewVersion = "1520.7.0"
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("1520.7.0", a.NextOSVersion)
+	assert.Equal(NextOSVersionUpdateEngine, a.NextOSVersionSource)
+	assert.Equal(1, len(requests))
+
+	// Disabled
+	a = newApp(updateengine.UpdateStatusIdle)
+	a.Conf.OmahaLookup = false
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("", a.NextOSVersion)
+	assert.Equal(1, len(requests))
+
+	// No update, or not a newer one
+	for _, offered = range []string{"", "1520.5.0", "1465.8.0"} {
+		a = newApp(updateengine.UpdateStatusIdle)
+		assert.Nil(a.GetNextOSVersion())
+		assert.Equal("", a.NextOSVersion, "offered %q", offered)
+	}
+
+	// Failures are not fatal
+	write(updateConfPaths[1], "GROUP=beta\n")
+	offered = "1520.6.0"
+	a = newApp(updateengine.UpdateStatusIdle)
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("", a.NextOSVersion)
+	_, err = a.OmahaNextVersion()
+	assert.NotNil(err)
+}
+
+func TestReadUpdateConf(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	confPaths := updateConfPaths
+	defer func() { updateConfPaths = confPaths }()
+	updateConfPaths = []string{filepath.Join(tmpDir, "usr-update.conf"), filepath.Join(tmpDir, "missing.conf")}
+	if err := ioutil.WriteFile(updateConfPaths[0], []byte("GROUP=stable\nSERVER=\"https://public.update.core-os.net/v1/update/\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := readUpdateConf()
+	assert.Nil(err)
+	assert.Equal(updateConf{Server: "https://public.update.core-os.net/v1/update/", Group: "stable"}, conf)
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/container-linux-update-operator/pkg/k8sutil"
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// OSUpdateStateFile is the default file where OS update progress is
+	// written
+	OSUpdateStateFile = "/var/lib/torcx/tectonic-os-update.json"
+	// OSUpdateProgressAnnotation is the node annotation mirroring OS update
+	// progress, as JSON
+	OSUpdateProgressAnnotation = "tectonic-torcx.coreos.com/os-update-progress"
+)
+
+// Results of an OS update
+const (
+	OSUpdateInProgress = "in-progress"
+	OSUpdateUpdated    = "updated"
+	OSUpdateUpToDate   = "up-to-date"
+	OSUpdateFailed     = "failed"
+)
+
+var (
+	// osUpdateLogInterval is how often progress within the same operation
+	// is logged
+	osUpdateLogInterval = 10 * time.Second
+	// osUpdateAnnotateInterval is how often progress within the same
+	// operation is mirrored to the node annotation
+	osUpdateAnnotateInterval = 30 * time.Second
+)
+
+// OSUpdateProgress is the latest known state of an OS update
+type OSUpdateProgress struct {
+	// The update_engine operation, e.g. UPDATE_STATUS_DOWNLOADING
+	Operation string `json:"operation" yaml:"operation"`
+	// Progress of the operation, between 0 and 1
+	Progress   float64 `json:"progress" yaml:"progress"`
+	NewVersion string  `json:"newVersion,omitempty" yaml:"newVersion,omitempty"`
+	// Size of the update payload, in bytes
+	NewSize int64 `json:"newSize,omitempty" yaml:"newSize,omitempty"`
+	// Update attempt, starting at 1 and increasing on retries
+	Attempt int `json:"attempt" yaml:"attempt"`
+
+	Started string `json:"started" yaml:"started"`
+	Updated string `json:"updated" yaml:"updated"`
+	// Time since the update started, in seconds
+	Elapsed int64 `json:"elapsed" yaml:"elapsed"`
+
+	// One of OSUpdateInProgress, OSUpdateUpdated, OSUpdateUpToDate,
+	// OSUpdateFailed
+	Result string `json:"result" yaml:"result"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// String renders the progress in a human-readable form
+func (p *OSUpdateProgress) String() string {
+	s := fmt.Sprintf("%s %.0f%%", p.Operation, p.Progress*100)
+	if p.NewSize > 0 {
+		s += fmt.Sprintf(" of %.1f MiB", float64(p.NewSize)/(1<<20))
+	}
+	if p.NewVersion != "" {
+		s += " for " + p.NewVersion
+	}
+	if p.Attempt > 1 {
+		s += fmt.Sprintf(", attempt %d", p.Attempt)
+	}
+	return s + fmt.Sprintf(", %s elapsed", time.Duration(p.Elapsed)*time.Second)
+}
+
+// osUpdateReporter surfaces the progress of an OS update in logs, in the
+// state file and, if possible, in a node annotation. Logs and annotations
+// are rate-limited, except on operation changes.
+type osUpdateReporter struct {
+	a        *App
+	progress OSUpdateProgress
+	started  time.Time
+
+	lastLog      time.Time
+	lastAnnotate time.Time
+	// nil if node annotations are not available
+	nodes v1core.NodeInterface
+}
+
+// newOSUpdateReporter starts reporting an OS update. The node annotation
+// is only written with a node name and an existing kubeconfig, as the
+// bootstrapper may run before the cluster is reachable.
+func (a *App) newOSUpdateReporter() *osUpdateReporter {
+	now := time.Now()
+	r := &osUpdateReporter{
+		a:       a,
+		started: now,
+		progress: OSUpdateProgress{
+			Attempt: 1,
+			Started: now.UTC().Format(time.RFC3339),
+			Result:  OSUpdateInProgress,
+		},
+	}
+
+	if a.Conf.NodeName == "" || a.Conf.Kubeconfig == "" {
+		return r
+	}
+	if _, err := os.Stat(a.Conf.Kubeconfig); err != nil {
+		logrus.Debugf("Not reporting OS update progress on node: %s", err)
+		return r
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
+	if err != nil {
+		logrus.Warnf("Not reporting OS update progress on node, failed to build kubeconfig: %s", err)
+		return r
+	}
+	// Progress reports must not hold the update back
+	config.Timeout = 10 * time.Second
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logrus.Warnf("Not reporting OS update progress on node, failed to build kube client: %s", err)
+		return r
+	}
+	r.nodes = client.CoreV1().Nodes()
+	return r
+}
+
+// update records a status received from update_engine
+func (r *osUpdateReporter) update(status updateengine.Status, attempt int) {
+	now := time.Now()
+	changed := status.CurrentOperation != r.progress.Operation || attempt != r.progress.Attempt
+
+	r.progress.Operation = status.CurrentOperation
+	r.progress.Progress = status.Progress
+	r.progress.NewVersion = status.NewVersion
+	r.progress.NewSize = status.NewSize
+	r.progress.Attempt = attempt
+	r.touch(now)
+
+	if changed || now.Sub(r.lastLog) >= osUpdateLogInterval {
+		logrus.Infof("OS update: %s", r.progress.String())
+		r.lastLog = now
+	}
+	r.write(changed || now.Sub(r.lastAnnotate) >= osUpdateAnnotateInterval)
+}
+
+// finish records the outcome of the update
+func (r *osUpdateReporter) finish(result string, err error) {
+	r.progress.Result = result
+	if err != nil {
+		r.progress.Error = err.Error()
+	}
+	r.touch(time.Now())
+	logrus.Infof("OS update %s after %s", result, time.Duration(r.progress.Elapsed)*time.Second)
+	r.write(true)
+}
+
+func (r *osUpdateReporter) touch(now time.Time) {
+	r.progress.Updated = now.UTC().Format(time.RFC3339)
+	r.progress.Elapsed = int64(now.Sub(r.started) / time.Second)
+}
+
+// write stores the progress in the state file, and in the node annotation
+// if annotate is true. Failures are only logged.
+func (r *osUpdateReporter) write(annotate bool) {
+	data, err := json.Marshal(r.progress)
+	if err != nil {
+		logrus.Warnf("Failed to encode OS update progress: %s", err)
+		return
+	}
+
+	if path := r.a.Conf.OSUpdateStateFile; path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			logrus.Warnf("Failed to write OS update state: %s", err)
+		} else if err := writeFileAtomic(path, data, 0644); err != nil {
+			logrus.Warnf("Failed to write OS update state: %s", err)
+		}
+	}
+
+	if annotate && r.nodes != nil {
+		r.lastAnnotate = time.Now()
+		annotations := map[string]string{OSUpdateProgressAnnotation: string(data)}
+		if err := k8sutil.SetNodeAnnotations(r.nodes, r.a.Conf.NodeName, annotations); err != nil {
+			logrus.Warnf("Failed to write OS update progress annotation: %s", err)
+		}
+	}
+}
+
+// ReadOSUpdateProgress returns the OS update progress from the state file,
+// or nil if there is none.
+func (a *App) ReadOSUpdateProgress() (*OSUpdateProgress, error) {
+	path := a.Conf.OSUpdateStateFile
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p := OSUpdateProgress{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return &p, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOSUpdateProgress(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// An api-server keeping the annotations of node-1
+	var mu sync.Mutex
+	annotations := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/api/v1/nodes/node-1" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+			return
+		}
+		if r.Method == "PUT" {
+			node := struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			}{}
+			assert.Nil(json.NewDecoder(r.Body).Decode(&node))
+			annotations = append(annotations, node.Metadata.Annotations[OSUpdateProgressAnnotation])
+		}
+		w.Write([]byte(`{"kind": "Node", "apiVersion": "v1", "metadata": {"name": "node-1", "annotations": {}}}`))
+	}))
+	defer ts.Close()
+
+	downloading := func(progress float64) updateengine.Status {
+		s := ueStatus(updateengine.UpdateStatusDownloading)
+		s.Progress = progress
+		s.NewSize = 300 << 20
+		return s
+	}
+	updated := ueStatus(updateengine.UpdateStatusUpdatedNeedReboot)
+	updated.NewVersion = "1520.6.0"
+	ue := newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, []updateengine.Status{
+		ueStatus(updateengine.UpdateStatusCheckingForUpdate),
+		downloading(0.1),
+		downloading(0.2),
+		downloading(0.3),
+		updated,
+	})
+
+	stateFile := filepath.Join(tmpDir, "state", "os-update.json")
+	a := &App{Conf: Config{
+		OSUpdateTimeout:   5 * time.Second,
+		OSUpdateStateFile: stateFile,
+		NodeName:          "node-1",
+		Kubeconfig:        writeTestKubeconfig(t, tmpDir, ts.URL),
+		updateEngine:      ue,
+	}}
+	assert.Nil(a.OSUpdate())
+
+	p, err := a.ReadOSUpdateProgress()
+	assert.Nil(err)
+	assert.Equal(OSUpdateUpdated, p.Result)
+	assert.Equal(updateengine.UpdateStatusUpdatedNeedReboot, p.Operation)
+	assert.Equal("1520.6.0", p.NewVersion)
+	assert.Equal(1, p.Attempt)
+	assert.Equal("", p.Error)
+
+	// Progress within the download is rate-limited, operation changes are not
+	mu.Lock()
+	assert.True(len(annotations) >= 4 && len(annotations) < 7, "%d annotations", len(annotations))
+	final := OSUpdateProgress{}
+	assert.Nil(json.Unmarshal([]byte(annotations[len(annotations)-1]), &final))
+	mu.Unlock()
+	assert.Equal(*p, final)
+
+	// Failures are recorded too, without a node annotation
+	a = &App{Conf: Config{
+		OSUpdateTimeout:       5 * time.Second,
+		OSUpdateStallTimeout:  50 * time.Millisecond,
+		OSUpdateStateFile:     stateFile,
+		OSUpdateFailurePolicy: OSUpdateContinue,
+		updateEngine:          newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil),
+	}}
+	assert.Nil(a.OSUpdate())
+	p, err = a.ReadOSUpdateProgress()
+	assert.Nil(err)
+	assert.Equal(OSUpdateFailed, p.Result)
+	assert.Contains(p.Error, "stalled")
+
+	// No state file
+	a.Conf.OSUpdateStateFile = filepath.Join(tmpDir, "missing.json")
+	p, err = a.ReadOSUpdateProgress()
+	assert.Nil(err)
+	assert.Nil(p)
+}
+
+func TestOSUpdateProgressString(t *testing.T) {
+	assert := assert.New(t)
+
+	p := OSUpdateProgress{
+		Operation:  updateengine.UpdateStatusDownloading,
+		Progress:   0.42,
+		NewSize:    300 << 20,
+		NewVersion: "1520.6.0",
+		Attempt:    2,
+		Elapsed:    150,
+	}
+	assert.Equal("UPDATE_STATUS_DOWNLOADING 42% of 300.0 MiB for 1520.6.0, attempt 2, 2m30s elapsed", p.String())
+}
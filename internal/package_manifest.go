@@ -19,6 +19,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/opencontainers/go-digest"
@@ -32,11 +34,24 @@ const (
 	ManifestURLTemplate = "https://tectonic-torcx.release.core-os.net/manifests/{{.Board}}/{{.OSVersion}}/torcx_manifest.json"
 
 	KIND_PACKAGE_MANIFEST = "torcx-package-list-v0"
+
+	// kindPackageManifestPrefix is common to all package manifest kinds,
+	// followed by the format version
+	kindPackageManifestPrefix = "torcx-package-list-v"
 )
 
+// manifestParsers maps known package manifest kinds to their parser
+var manifestParsers = map[string]func(json.RawMessage) (*PackageManifest, error){
+	KIND_PACKAGE_MANIFEST: parseManifestV0,
+}
+
+// latestManifestKind is the newest kind this version can parse. Manifests
+// of unknown newer kinds are parsed as this one.
+const latestManifestKind = KIND_PACKAGE_MANIFEST
+
 type packageManifestBox struct {
 	Kind  string          `json:"kind"`
-	Value PackageManifest `json:"value"`
+	Value json.RawMessage `json:"value"`
 }
 
 type PackageManifest struct {
@@ -45,33 +60,89 @@ type PackageManifest struct {
 
 type Package struct {
 	Name           string           `json:"name"`
-	DefaultVersion string           `json:"DefaultVersion"`
+	DefaultVersion string           `json:"defaultVersion"`
 	Versions       []PackageVersion `json:"versions"`
 }
 
 type PackageVersion struct {
-	Package   *Package
-	Version   string     `json:"version"`
-	Hash      string     `json:"hash"`
-	Locations []Location `json:"locations"`
+	Package *Package
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+	// SourcePackage is the OS package the addon was built from
+	SourcePackage string     `json:"sourcePackage,omitempty"`
+	Locations     []Location `json:"locations"`
 }
 
 type Location struct {
 	Version *PackageVersion
 	Path    string `json:"path"`
 	URL     string `json:"url"`
+	// Size is the size of the addon in bytes, if known
+	Size int64 `json:"size,omitempty"`
+	// Metadata holds optional free-form properties of this location: the
+	// "metadata" object, plus any other unknown key (e.g. "compression")
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// locationKeys are the location keys mapped to Location fields
+var locationKeys = map[string]bool{"path": true, "url": true, "size": true, "metadata": true}
+
+// UnmarshalJSON parses a location, collecting unknown keys into Metadata.
+// Entries of the "metadata" object take precedence.
+func (l *Location) UnmarshalJSON(data []byte) error {
+	// Same fields, without this method
+	type location Location
+	loc := location{}
+	if err := json.Unmarshal(data, &loc); err != nil {
+		return err
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		if locationKeys[strings.ToLower(k)] {
+			continue
+		}
+		if _, ok := loc.Metadata[k]; ok {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(v, &value); err != nil {
+			return err
+		}
+		if loc.Metadata == nil {
+			loc.Metadata = map[string]interface{}{}
+		}
+		loc.Metadata[k] = value
+	}
+
+	*l = Location(loc)
+	return nil
 }
 
-// LocationFor determines the optimal location for a desired torcx package,
-// given a specific docker version. It downloads and verifies the package manifest
-// for a given OS version, caching the parsed manifest for reuse.
+// GetPackageManifest downloads and verifies the package manifest for a
+// given OS version, caching the parsed manifest for reuse. URL templates
+// are tried in order, each preceded by its rewritten mirror URLs.
 func (a *App) GetPackageManifest(osVersion string) (*PackageManifest, error) {
 	manifest, ok := a.packageManifestCache[osVersion]
 	if ok {
 		return manifest, nil
 	}
 
-	if a.Conf.TorcxManifestURL == nil {
+	manifest, _, _, err := a.fetchPackageManifest(osVersion)
+	if err != nil {
+		return nil, err
+	}
+	a.packageManifestCache[osVersion] = manifest
+
+	return manifest, nil
+}
+
+// manifestURLs renders the package manifest URLs to try for an OS version
+func (a *App) manifestURLs(osVersion string) ([]string, error) {
+	if len(a.Conf.TorcxManifestURLs) == 0 {
 		return nil, errors.New("missing URL template")
 	}
 
@@ -79,49 +150,120 @@ func (a *App) GetPackageManifest(osVersion string) (*PackageManifest, error) {
 		Board, OSVersion string
 	}
 
-	var manifestURLB, manifestBuff, manifestSigB bytes.Buffer
-	if err := a.Conf.TorcxManifestURL.Execute(&manifestURLB, params{a.Board, osVersion}); err != nil {
-		return nil, errors.Wrap(err, "failed to render URL template")
+	urls := []string{}
+	for _, tmpl := range a.Conf.TorcxManifestURLs {
+		var manifestURLB bytes.Buffer
+		if err := tmpl.Execute(&manifestURLB, params{a.Board, osVersion}); err != nil {
+			return nil, errors.Wrap(err, "failed to render URL template")
+		}
+		urls = append(urls, a.candidateURLs(manifestURLB.String())...)
 	}
-	manifestURL := manifestURLB.String()
+	return urls, nil
+}
+
+// fetchPackageManifest fetches, verifies and parses the package manifest
+// for an OS version, trying every manifest URL in turn. It also returns
+// the raw manifest and its signature (nil if verification is disabled).
+// The on-disk cache is revalidated with conditional requests, and used
+// as a fallback if no URL can be reached.
+func (a *App) fetchPackageManifest(osVersion string) (*PackageManifest, []byte, []byte, error) {
+	urls, err := a.manifestURLs(osVersion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cached := a.loadCachedManifest(osVersion)
+	var manifest *PackageManifest
+	var fetched *cachedManifest
+	err = a.tryMirrors(urls, func(manifestURL string) error {
+		var err error
+		fetched, err = a.fetchSignedManifest(manifestURL, cached)
+		if err != nil {
+			return err
+		}
+		manifest, err = parseTorcxManifest(fetched.data)
+		return err
+	})
+	if err == nil {
+		if err := a.storeCachedManifest(osVersion, fetched); err != nil {
+			logrus.Warnf("Failed to cache package manifest: %s", err)
+		}
+		return manifest, fetched.data, fetched.sig, nil
+	}
+
+	if cached == nil {
+		return nil, nil, nil, err
+	}
+	logrus.Warnf("Failed to fetch package manifest for %s, using cached copy of %s fetched at %s: %s", osVersion, cached.meta.URL, cached.meta.Fetched, err)
+	if verr := a.verifyManifest(cached.meta.URL, cached.data, cached.sig); verr != nil {
+		return nil, nil, nil, errors.Wrapf(err, "cached package manifest is invalid (%s)", verr)
+	}
+	manifest, perr := parseTorcxManifest(cached.data)
+	if perr != nil {
+		return nil, nil, nil, errors.Wrapf(err, "cached package manifest is invalid (%s)", perr)
+	}
+	return manifest, cached.data, cached.sig, nil
+}
+
+// fetchSignedManifest fetches and verifies the package manifest at
+// manifestURL. The signature is fetched from the same mirror. If cached
+// was fetched from the same URL and is still current, it is returned
+// after verification instead.
+func (a *App) fetchSignedManifest(manifestURL string, cached *cachedManifest) (*cachedManifest, error) {
 	logrus.Debugf("GET %s", manifestURL)
 
+	var validators *cacheValidators
+	if cached != nil && cached.meta.URL == manifestURL {
+		validators = &cached.meta.cacheValidators
+	}
+
 	// Fetch the manifest and signature
-	if err := fetchURL(manifestURL, &manifestBuff); err != nil {
+	mb, fresh, notModified, err := a.fetchURLIf(manifestURL, validators)
+	if err != nil {
 		return nil, errors.Wrapf(err, "could not fetch package manifest at %s", manifestURL)
 	}
+	if notModified {
+		verr := a.verifyManifest(cached.meta.URL, cached.data, cached.sig)
+		if verr == nil {
+			logrus.Infof("Cached package manifest from %s is up to date", manifestURL)
+			return cached, nil
+		}
+		logrus.Warnf("Cached package manifest from %s is invalid, fetching it again: %s", manifestURL, verr)
+		mb, fresh, _, err = a.fetchURLIf(manifestURL, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch package manifest at %s", manifestURL)
+		}
+	}
+	c := cachedManifest{
+		meta: manifestCacheMeta{URL: manifestURL, cacheValidators: fresh},
+		data: mb,
+	}
 
 	// Optionally, fetch and check the signature
 	if a.Conf.NoVerifySig {
 		logrus.Warn("signature verification disabled, skipping fetch phase")
-	} else {
-		if err := fetchURL(manifestURL+".asc", &manifestSigB); err != nil {
-			return nil, errors.Wrapf(err, "could not fetch manifest signature at %s.asc", manifestURL)
-		}
-		if err := a.gpgVerify(bytes.NewReader(manifestBuff.Bytes()), &manifestSigB); err != nil {
-			return nil, errors.Wrap(err, "gpg validation failed")
-		}
+		return &c, nil
 	}
-
-	mb := manifestBuff.Bytes()
-	manifest, err := parseTorcxManifest(mb)
+	c.sig, err = a.fetchURL(manifestURL + ".asc")
 	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch manifest signature at %s.asc", manifestURL)
+	}
+	if err := a.verifyManifest(manifestURL, c.data, c.sig); err != nil {
 		return nil, err
 	}
-	a.packageManifestCache[osVersion] = manifest
-
-	return manifest, nil
+	return &c, nil
 }
 
 // LocationFor picks the best location for a given package + version
 // from a manifest. If the package or version doesn't exist, returns
 // nil. When multiple locations are present, it prefers ones with a
-// Path on disk, so fetching can be skipped.
+// Path on disk, so fetching can be skipped, then the first remote one.
+// Other remote locations are used as fallbacks by FetchAddon.
 func (m *PackageManifest) LocationFor(name, version string) (*Location, error) {
 	var pkg *Package
-	for _, p := range m.Packages {
-		if p.Name == name {
-			pkg = &p
+	for i := range m.Packages {
+		if m.Packages[i].Name == name {
+			pkg = &m.Packages[i]
 			break
 		}
 	}
@@ -129,22 +271,26 @@ func (m *PackageManifest) LocationFor(name, version string) (*Location, error) {
 		return nil, fmt.Errorf("OS does not include package %s", name)
 	}
 
-	for _, v := range pkg.Versions {
-		if v.Version == version {
-			var loc *Location
+	for i := range pkg.Versions {
+		v := &pkg.Versions[i]
+		if v.Version != version {
+			continue
+		}
 
-			// loop through locations, prefering on-disk
-			for _, l := range v.Locations {
-				if l.isTorcxStore() {
-					return &l, nil
-				} else {
-					loc = &l
-				}
+		// prefer on-disk, otherwise the first remote location
+		var loc *Location
+		for j := range v.Locations {
+			l := &v.Locations[j]
+			if l.isTorcxStore() {
+				return l, nil
 			}
-			if loc != nil {
-				return loc, nil
+			if loc == nil && l.URL != "" {
+				loc = l
 			}
 		}
+		if loc != nil {
+			return loc, nil
+		}
 	}
 	return nil, fmt.Errorf("Could not find version %s for package %s", version, name)
 }
@@ -172,11 +318,53 @@ func (v *PackageVersion) ValidateHash(inp io.Reader) (bool, error) {
 	return verifier.Verified(), nil
 }
 
+// validateFile checks if the file at path matches the package's
+// expected hash.
+func (v *PackageVersion) validateFile(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+
+	return v.ValidateHash(fp)
+}
+
+// findVersion returns a package version from the manifest, or nil
+// if not present
+func (m *PackageManifest) findVersion(name, version string) *PackageVersion {
+	for i := range m.Packages {
+		if m.Packages[i].Name != name {
+			continue
+		}
+		for j := range m.Packages[i].Versions {
+			if m.Packages[i].Versions[j].Version == version {
+				return &m.Packages[i].Versions[j]
+			}
+		}
+	}
+	return nil
+}
+
 // filename returns the expected filename on disk in the torcx store
 func (v *PackageVersion) filename() string {
 	return fmt.Sprintf("%s:%s.torcx.tgz", v.Package.Name, v.Version)
 }
 
+// size returns the expected size in bytes of this version's addon, or
+// 0 if no location declares it.
+func (v *PackageVersion) size() int64 {
+	for _, l := range v.Locations {
+		if l.Size > 0 {
+			return l.Size
+		}
+	}
+	return 0
+}
+
+// parseTorcxManifest parses a package manifest of any known kind. Newer
+// kinds are parsed as the latest known one, so that additive changes to
+// the format don't break existing nodes.
 func parseTorcxManifest(data []byte) (*PackageManifest, error) {
 	box := packageManifestBox{}
 
@@ -185,12 +373,82 @@ func parseTorcxManifest(data []byte) (*PackageManifest, error) {
 		return nil, errors.Wrap(err, "failed to parse manifest")
 	}
 
-	if box.Kind != KIND_PACKAGE_MANIFEST {
-		return nil, errors.New("Unexpected manifest kind " + box.Kind)
+	parse, ok := manifestParsers[box.Kind]
+	if !ok {
+		if !isNewerManifestKind(box.Kind) {
+			return nil, errors.New("Unexpected manifest kind " + box.Kind)
+		}
+		logrus.Warnf("Unknown manifest kind %s, parsing it as %s", box.Kind, latestManifestKind)
+		parse = manifestParsers[latestManifestKind]
+	}
+	if len(box.Value) == 0 {
+		return nil, errors.Errorf("manifest of kind %s has no value", box.Kind)
 	}
-	fillManifestBackrefs(&box.Value)
 
-	return &box.Value, nil
+	m, err := parse(box.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s manifest", box.Kind)
+	}
+	if err := validateManifest(m); err != nil {
+		return nil, errors.Wrap(err, "invalid manifest")
+	}
+	fillManifestBackrefs(m)
+
+	return m, nil
+}
+
+// isNewerManifestKind returns true if kind is a package manifest kind with
+// a format version above the latest known one.
+func isNewerManifestKind(kind string) bool {
+	if !strings.HasPrefix(kind, kindPackageManifestPrefix) {
+		return false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(kind, kindPackageManifestPrefix))
+	if err != nil {
+		return false
+	}
+	latest, _ := strconv.Atoi(strings.TrimPrefix(latestManifestKind, kindPackageManifestPrefix))
+	return version > latest
+}
+
+func parseManifestV0(value json.RawMessage) (*PackageManifest, error) {
+	m := PackageManifest{}
+	if err := json.Unmarshal(value, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// validateManifest checks that the fields required to select and verify
+// addons are present. Locations of an unknown type, with neither a path nor
+// a URL, are dropped.
+func validateManifest(m *PackageManifest) error {
+	for i := range m.Packages {
+		p := &m.Packages[i]
+		if p.Name == "" {
+			return errors.Errorf("package %d has no name", i)
+		}
+		for j := range p.Versions {
+			v := &p.Versions[j]
+			if v.Version == "" {
+				return errors.Errorf("package %s: version %d has no version", p.Name, j)
+			}
+			if v.Hash == "" {
+				return errors.Errorf("package %s: version %s has no hash", p.Name, v.Version)
+			}
+
+			locs := []Location{}
+			for _, l := range v.Locations {
+				if l.Path == "" && l.URL == "" {
+					logrus.Debugf("Ignoring unsupported location for %s:%s", p.Name, v.Version)
+					continue
+				}
+				locs = append(locs, l)
+			}
+			v.Locations = locs
+		}
+	}
+	return nil
 }
 
 func fillManifestBackrefs(m *PackageManifest) {
@@ -17,6 +17,8 @@ package internal
 import (
 	"bytes"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -92,3 +94,86 @@ func TestValidateHash(t *testing.T) {
 	assert.Nil(err)
 	assert.False(ok)
 }
+
+// TestManifestCorpus parses all manifests in the compatibility corpus;
+// those named "bad-*" must be rejected.
+func TestManifestCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	paths, err := filepath.Glob("../testdata/manifests/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(paths)
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := parseTorcxManifest(data)
+		if strings.HasPrefix(filepath.Base(path), "bad-") {
+			assert.NotNil(err, path)
+			continue
+		}
+		if !assert.Nil(err, path) {
+			continue
+		}
+		assert.NotEmpty(m.Packages, path)
+		for _, p := range m.Packages {
+			for _, v := range p.Versions {
+				assert.Equal(p.Name, v.Package.Name, path)
+				assert.NotEmpty(v.Locations, path)
+			}
+		}
+	}
+}
+
+func TestManifestFields(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../testdata/manifests/v0-full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseTorcxManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal("1.12", m.Packages[0].DefaultVersion)
+	v := m.findVersion("docker", "1.12")
+	assert.Equal("app-torcx/docker-1.12.6-r1", v.SourcePackage)
+	assert.Equal(int64(37425610), v.Locations[1].Size)
+	assert.Equal("us", v.Locations[1].Metadata["region"])
+	assert.Equal(int64(37425610), v.size())
+	assert.Equal(int64(42180215), m.findVersion("docker", "17.06").size())
+
+	// Unknown location types in newer kinds are dropped
+	data, err = ioutil.ReadFile("../testdata/manifests/v1-additive.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = parseTorcxManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("17.06", m.Packages[0].DefaultVersion)
+	v = m.findVersion("docker", "17.06")
+	assert.Equal(1, len(v.Locations))
+	l, err := m.LocationFor("docker", "17.06")
+	assert.Nil(err)
+	assert.Equal(int64(42180215), l.Size)
+	// Unknown location keys are exposed as metadata
+	assert.Equal(map[string]interface{}{"compression": "gzip"}, l.Metadata)
+}
+
+func TestIsNewerManifestKind(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(isNewerManifestKind(KIND_PACKAGE_MANIFEST))
+	assert.True(isNewerManifestKind("torcx-package-list-v1"))
+	assert.True(isNewerManifestKind("torcx-package-list-v12"))
+	assert.False(isNewerManifestKind("torcx-package-list-v"))
+	assert.False(isNewerManifestKind("torcx-profile-v1"))
+}
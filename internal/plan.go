@@ -0,0 +1,85 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Actions recorded in a dry-run plan
+const (
+	ActionOSUpdate            = "os-update"
+	ActionFetchAddon          = "fetch-addon"
+	ActionCopyToStore         = "copy-to-store"
+	ActionProfileNew          = "torcx-profile-new"
+	ActionProfileUseImage     = "torcx-profile-use-image"
+	ActionProfileSetNext      = "torcx-profile-set-next"
+	ActionRemoveStore         = "remove-store"
+	ActionQuarantine          = "quarantine"
+	ActionWriteKubeletEnv     = "write-kubelet-env"
+	ActionEnableDockerCleanup = "enable-docker-cleanup"
+	ActionReboot              = "reboot"
+	ActionNodeAnnotation      = "write-node-annotation"
+	ActionMappingStatus       = "write-mapping-status"
+	ActionResetOSUpdate       = "reset-os-update"
+)
+
+// PlanStep is a single side effect which would have been performed.
+type PlanStep struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan is the ordered list of side effects recorded in dry-run mode.
+type Plan struct {
+	Steps []PlanStep `json:"steps"`
+}
+
+// String renders the plan in a human-readable form
+func (p *Plan) String() string {
+	if len(p.Steps) == 0 {
+		return "No changes would be performed.\n"
+	}
+
+	var buf bytes.Buffer
+	for i, s := range p.Steps {
+		fmt.Fprintf(&buf, "%2d. %s %s", i+1, s.Action, s.Target)
+		if s.Detail != "" {
+			fmt.Fprintf(&buf, " (%s)", s.Detail)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// dryRun records a side effect in the plan if running in dry-run mode.
+// It returns true when the caller should skip actually performing it.
+func (a *App) dryRun(action, target, detail string) bool {
+	if !a.Conf.DryRun {
+		return false
+	}
+
+	logrus.Infof("dry-run: would %s %s", action, target)
+	a.Plan.Steps = append(a.Plan.Steps, PlanStep{
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+	return true
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// NodeStatus is a point-in-time report of the torcx-related state
+// of a node, as seen by this tool.
+type NodeStatus struct {
+	Board            string `json:"board" yaml:"board"`
+	CurrentOSVersion string `json:"currentOSVersion" yaml:"currentOSVersion"`
+	NextOSVersion    string `json:"nextOSVersion" yaml:"nextOSVersion"`
+	// Where the next OS version was determined from, if any
+	NextOSVersionSource string `json:"nextOSVersionSource,omitempty" yaml:"nextOSVersionSource,omitempty"`
+
+	K8sVersion       string `json:"k8sVersion" yaml:"k8sVersion"`
+	K8sVersionSource string `json:"k8sVersionSource" yaml:"k8sVersionSource"`
+
+	// Preferred docker versions, from runtime mappings
+	DockerVersions []string `json:"dockerVersions" yaml:"dockerVersions"`
+	// Docker version which would be selected, keyed by OS version
+	Selected map[string]string `json:"selected" yaml:"selected"`
+	// Preferred versions of all runtime components, from runtime mappings
+	RuntimeVersions map[string][]string `json:"runtimeVersions" yaml:"runtimeVersions"`
+	// Versions which would be selected, keyed by component then OS version
+	SelectedComponents map[string]map[string]string `json:"selectedComponents" yaml:"selectedComponents"`
+	// Fallback versions selected instead of preferred ones, keyed by package
+	Fallbacks map[string]VersionFallback `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty"`
+
+	Profiles ProfileStatus `json:"profiles" yaml:"profiles"`
+	// Images present in the torcx stores, keyed by OS version
+	Store map[string][]StoreEntry `json:"store" yaml:"store"`
+
+	// Latest OS update progress, from the state file
+	OSUpdate *OSUpdateProgress `json:"osUpdate,omitempty" yaml:"osUpdate,omitempty"`
+
+	// Non-fatal errors encountered while gathering the status
+	Errors []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+// ProfileStatus describes the torcx profiles on a node.
+type ProfileStatus struct {
+	Current     string   `json:"current" yaml:"current"`
+	CurrentPath string   `json:"currentPath" yaml:"currentPath"`
+	Next        string   `json:"next" yaml:"next"`
+	Available   []string `json:"available" yaml:"available"`
+}
+
+// StoreEntry is a single image found in a torcx store.
+type StoreEntry struct {
+	Name      string `json:"name" yaml:"name"`
+	Reference string `json:"reference" yaml:"reference"`
+	Filepath  string `json:"filepath" yaml:"filepath"`
+}
+
+// Status gathers the node state without any side effects. Failures in
+// single steps do not abort the process, but are reported in the result
+// so that partial information is still available for troubleshooting.
+// If localOnly is true, state is gathered like the pre-reboot hook does,
+// otherwise like the bootstrapper.
+func (a *App) Status(localOnly bool) *NodeStatus {
+	st := NodeStatus{
+		Selected:           map[string]string{},
+		SelectedComponents: map[string]map[string]string{},
+		Store:              map[string][]StoreEntry{},
+	}
+	addErr := func(err error) {
+		logrus.Debug(err)
+		st.Errors = append(st.Errors, err.Error())
+	}
+
+	envPath := installerEnvPath
+	if localOnly {
+		envPath = kubeletEnvPath
+	}
+	if err := a.GatherState(localOnly, envPath); err != nil {
+		addErr(err)
+	}
+	if err := a.GetNextOSVersion(); err != nil {
+		addErr(err)
+	}
+
+	if p, err := a.ReadOSUpdateProgress(); err != nil {
+		addErr(err)
+	} else {
+		st.OSUpdate = p
+	}
+
+	st.Board = a.Board
+	st.CurrentOSVersion = a.CurrentOSVersion
+	st.NextOSVersion = a.NextOSVersion
+	st.NextOSVersionSource = a.NextOSVersionSource
+	st.K8sVersion = a.K8sVersion
+	st.K8sVersionSource = a.K8sVersionSource
+	st.DockerVersions = a.RuntimeVersions["docker"]
+	st.RuntimeVersions = a.RuntimeVersions
+
+	if a.Board != "" {
+		for _, name := range a.componentNames() {
+			version, osVersions, err := a.PickVersion(name, a.RuntimeVersions[name])
+			if err != nil {
+				addErr(errors.Wrapf(err, "failed to pick %s version", name))
+			}
+			selected := map[string]string{}
+			for _, osVersion := range osVersions {
+				selected[osVersion] = version
+			}
+			st.SelectedComponents[name] = selected
+		}
+		if selected, ok := st.SelectedComponents["docker"]; ok {
+			st.Selected = selected
+		}
+		st.Fallbacks = a.Fallbacks
+	}
+
+	if a.Conf.SkipTorcxSetup {
+		return &st
+	}
+
+	if pl, err := a.torcx.ProfileList(); err != nil {
+		addErr(err)
+	} else {
+		if pl.UserProfileName != nil {
+			st.Profiles.Current = *pl.UserProfileName
+		}
+		if pl.CurrentProfilePath != nil {
+			st.Profiles.CurrentPath = *pl.CurrentProfilePath
+		}
+		if pl.NextProfileName != nil {
+			st.Profiles.Next = *pl.NextProfileName
+		}
+		st.Profiles.Available = pl.Profiles
+	}
+
+	for _, osVersion := range []string{a.CurrentOSVersion, a.NextOSVersion} {
+		if osVersion == "" {
+			continue
+		}
+		images, err := a.torcx.ImageList(osVersion, "")
+		if err != nil {
+			addErr(err)
+			continue
+		}
+		entries := []StoreEntry{}
+		for _, e := range images {
+			entries = append(entries, StoreEntry{
+				Name:      e.Name,
+				Reference: e.Reference,
+				Filepath:  e.Filepath,
+			})
+		}
+		st.Store[osVersion] = entries
+	}
+
+	return &st
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// quarantineDir is the directory, relative to the user store, where
+// corrupted store entries are moved. torcx ignores it, as it is not
+// named after an OS version.
+const quarantineDir = ".quarantine"
+
+// RepairStore checks the versioned user stores for the given OS versions,
+// removing temporary files left over by interrupted installs and
+// quarantining addons whose hash does not match the package manifest.
+// Addons not listed in the manifest are left untouched.
+func (a *App) RepairStore(osVersions ...string) error {
+	for _, osVersion := range osVersions {
+		if osVersion == "" || shouldSkip(MinimumRemoteDocker, osVersion) {
+			continue
+		}
+
+		manif, err := a.GetPackageManifest(osVersion)
+		if err != nil {
+			logrus.Warnf("Cannot check store for OS version %s: %s", osVersion, err)
+			continue
+		}
+
+		if err := a.repairVersionedStore(manif, osVersion); err != nil {
+			return errors.Wrapf(err, "failed to repair store for OS version %s", osVersion)
+		}
+	}
+	return nil
+}
+
+func (a *App) repairVersionedStore(manif *PackageManifest, osVersion string) error {
+	dir := filepath.Join(a.Conf.torcxStoreDir, osVersion)
+	logrus.Debugf("Checking store %s", dir)
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Leftovers from interrupted copyToStore
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), ".") && strings.Contains(e.Name(), ".torcx.tgz") {
+			p := filepath.Join(dir, e.Name())
+			if a.dryRun(ActionRemoveStore, p, "incomplete addon") {
+				continue
+			}
+			logrus.Infof("Removing incomplete addon %s", p)
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	images, err := scanStore(dir, "")
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		v := manif.findVersion(img.Name, img.Reference)
+		if v == nil {
+			logrus.Debugf("%s not in package manifest, not checking", img.Filepath)
+			continue
+		}
+
+		ok, err := v.validateFile(img.Filepath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		logrus.Warnf("Hash mismatch for %s, quarantining", img.Filepath)
+		if err := a.quarantine(img.Filepath, osVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves a store entry out of the way, keeping it for inspection
+func (a *App) quarantine(path, osVersion string) error {
+	dir := filepath.Join(a.Conf.torcxStoreDir, quarantineDir, osVersion)
+	dest := filepath.Join(dir, filepath.Base(path))
+	if a.dryRun(ActionQuarantine, path, "to "+dest) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", dir)
+	}
+	if err := os.Rename(path, dest); err != nil {
+		return errors.Wrapf(err, "failed to quarantine %s", path)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory, persisting renames and creations within it
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if err := fd.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync %s", dir)
+	}
+	return nil
+}
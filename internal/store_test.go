@@ -0,0 +1,118 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyToStore(t *testing.T) {
+	assert := assert.New(t)
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	content := []byte("docker addon\n")
+	src := filepath.Join(storeDir, "src.tgz")
+	if err := ioutil.WriteFile(src, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := App{Conf: Config{torcxStoreDir: storeDir}}
+	m := makeRemoteManifest("17.03", "https://example.net/docker.torcx.tgz", content)
+	v := &m.Packages[0].Versions[0]
+
+	err = a.copyToStore(src, v, "9999.0.0")
+	assert.Nil(err)
+	dest := filepath.Join(storeDir, "9999.0.0", "docker:17.03.torcx.tgz")
+	data, err := ioutil.ReadFile(dest)
+	assert.Nil(err)
+	assert.Equal(content, data)
+
+	// A mismatching source leaves the existing entry alone
+	if err := ioutil.WriteFile(src, []byte("truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = a.copyToStore(src, v, "9999.0.0")
+	assert.NotNil(err)
+	data, err = ioutil.ReadFile(dest)
+	assert.Nil(err)
+	assert.Equal(content, data)
+	assert.Equal([]string{"docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, "9999.0.0")))
+
+	// Missing source is an error
+	err = a.copyToStore(filepath.Join(storeDir, "missing"), v, "9999.0.0")
+	assert.NotNil(err)
+}
+
+func TestRepairStore(t *testing.T) {
+	assert := assert.New(t)
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	content := []byte("docker addon\n")
+	dir := filepath.Join(storeDir, "9999.0.0")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"docker:17.03.torcx.tgz":        []byte("docker"),
+		"docker:1.12.torcx.tgz":         []byte("unknown"),
+		".docker:17.03.torcx.tgz123456": []byte("partial"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := App{
+		Conf: Config{torcxStoreDir: storeDir},
+		packageManifestCache: map[string]*PackageManifest{
+			"9999.0.0": makeRemoteManifest("17.03", "https://example.net/docker.torcx.tgz", content),
+		},
+	}
+
+	// Dry-run only records the changes
+	a.Conf.DryRun = true
+	err = a.RepairStore("9999.0.0")
+	assert.Nil(err)
+	assert.Equal(3, len(listDir(t, dir)))
+	assert.Equal([]string{ActionRemoveStore, ActionQuarantine}, []string{a.Plan.Steps[0].Action, a.Plan.Steps[1].Action})
+
+	a.Conf.DryRun = false
+	err = a.RepairStore("9999.0.0", "")
+	assert.Nil(err)
+	assert.Equal([]string{"docker:1.12.torcx.tgz"}, listDir(t, dir))
+	assert.Equal([]string{"docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, quarantineDir, "9999.0.0")))
+
+	// A good entry is kept
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker:17.03.torcx.tgz"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = a.RepairStore("9999.0.0")
+	assert.Nil(err)
+	assert.Equal([]string{"docker:1.12.torcx.tgz", "docker:17.03.torcx.tgz"}, listDir(t, dir))
+}
@@ -16,6 +16,8 @@ package internal
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/pkg/errors"
@@ -28,6 +30,32 @@ const MinimumRemoteDocker = "1520.3.0"
 // This error is returned when there is no suitable package available to install.
 var NoVersionError = errors.New("No suitable version available")
 
+// Policies for when none of the preferred package versions is available
+const (
+	// FallbackFail returns NoVersionError
+	FallbackFail = "fail"
+	// FallbackOSDefault picks the default version shipped with the OS
+	FallbackOSDefault = "os-default"
+	// FallbackNewest picks the newest version within VersionFallbackRange
+	FallbackNewest = "newest"
+)
+
+// VersionFallback records that a fallback version was picked for a package
+type VersionFallback struct {
+	Policy  string `json:"policy" yaml:"policy"`
+	Version string `json:"version" yaml:"version"`
+}
+
+// validVersionFallback returns true if policy is known; empty means
+// FallbackFail.
+func validVersionFallback(policy string) bool {
+	switch policy {
+	case FallbackFail, FallbackOSDefault, FallbackNewest, "":
+		return true
+	}
+	return false
+}
+
 // PickVersion implements our version selection & fallback logic
 // Returns the desired package version and the OS versions for which to install
 // it. Returns NoVersionError if no suitable versions are available.
@@ -37,6 +65,8 @@ var NoVersionError = errors.New("No suitable version available")
 // Our update strategy is simple: we get a list of preferred packageVersions
 // (in other words, the list of docker versions supported by Kubernetes). Then,
 // pick the first one that is in the manifest for the "coming" OS version.
+// Preferences may also be version constraints, see resolveVersion.
+// If there is none, the fallback policy decides what to install instead.
 func (a *App) PickVersion(packageName string, packageVersions []string) (string, []string, error) {
 	logrus.Infof("Determining correct %s version", packageName)
 	if a.CurrentOSVersion == "" && a.NextOSVersion == "" {
@@ -68,14 +98,17 @@ func (a *App) PickVersion(packageName string, packageVersions []string) (string,
 		return "", nil, errors.Wrapf(err, "Could not get package manifest for %s", primaryOSVersion)
 	}
 	for _, v := range packageVersions {
-		loc, _ := pm.LocationFor(packageName, v)
-		if loc != nil {
-			packageVersion = v
+		if version := pm.resolveVersion(packageName, v); version != "" {
+			packageVersion = version
 			break
 		}
 	}
+	delete(a.Fallbacks, packageName)
 	if packageVersion == "" {
-		return "", nil, NoVersionError
+		packageVersion = a.fallbackVersion(pm, packageName, packageVersions, primaryOSVersion)
+		if packageVersion == "" {
+			return "", nil, NoVersionError
+		}
 	}
 
 	osVersions := []string{primaryOSVersion}
@@ -96,6 +129,118 @@ func (a *App) PickVersion(packageName string, packageVersions []string) (string,
 	return packageVersion, osVersions, nil
 }
 
+// isVersionConstraint returns true if a version preference is a
+// VersionRange rather than an exact version.
+func isVersionConstraint(pref string) bool {
+	return strings.ContainsAny(pref, "<>=! ")
+}
+
+// resolveVersion returns the version of a package available in the
+// manifest satisfying a preference, which is either an exact version or
+// a version constraint such as ">=17.03 <17.10" (the newest match wins).
+// It returns an empty string if there is none.
+func (m *PackageManifest) resolveVersion(name, pref string) string {
+	version := pref
+	if isVersionConstraint(pref) {
+		r, err := ParseVersionRange(pref)
+		if err != nil {
+			logrus.Warnf("Ignoring invalid %s version constraint %q: %s", name, pref, err)
+			return ""
+		}
+		version = m.newestVersion(name, r)
+	}
+	if version == "" {
+		return ""
+	}
+	if loc, _ := m.LocationFor(name, version); loc == nil {
+		return ""
+	}
+	return version
+}
+
+// fallbackVersion picks a version of a package available in pm according to
+// the fallback policy, when none of the preferred versions is, and records
+// the choice. It returns an empty string if there is no such version.
+func (a *App) fallbackVersion(pm *PackageManifest, name string, preferred []string, osVersion string) string {
+	policy := a.Conf.VersionFallback
+	var version string
+	switch policy {
+	case FallbackOSDefault:
+		version = pm.osDefaultVersion(name)
+	case FallbackNewest:
+		version = pm.newestVersion(name, a.Conf.VersionFallbackRange)
+	default:
+		return ""
+	}
+	if version == "" {
+		logrus.Warnf("No %s version available for OS version %s with fallback policy %s", name, osVersion, policy)
+		return ""
+	}
+
+	logrus.Warnf("None of the preferred %s versions %v available for OS version %s, falling back to %s (%s)",
+		name, preferred, osVersion, version, policy)
+	if a.Fallbacks == nil {
+		a.Fallbacks = map[string]VersionFallback{}
+	}
+	a.Fallbacks[name] = VersionFallback{Policy: policy, Version: version}
+	return version
+}
+
+// osDefaultVersion returns the default version of a package for this OS:
+// the manifest's defaultVersion if available, otherwise the version shipped
+// in the vendor store.
+func (m *PackageManifest) osDefaultVersion(name string) string {
+	for _, p := range m.Packages {
+		if p.Name != name {
+			continue
+		}
+		if p.DefaultVersion != "" && m.findVersion(name, p.DefaultVersion) != nil {
+			return p.DefaultVersion
+		}
+		for _, v := range p.Versions {
+			for _, l := range v.Locations {
+				if l.isTorcxStore() {
+					return v.Version
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// newestVersion returns the newest version of a package within r. Versions
+// which cannot be parsed are ignored.
+func (m *PackageManifest) newestVersion(name string, r VersionRange) string {
+	var newest string
+	var newestVer *semver.Version
+	for _, p := range m.Packages {
+		if p.Name != name {
+			continue
+		}
+		for _, v := range p.Versions {
+			ver, err := parseLooseVersion(v.Version)
+			if err != nil || !r.Contains(v.Version) {
+				continue
+			}
+			if newestVer == nil || newestVer.LessThan(*ver) {
+				newest, newestVer = v.Version, ver
+			}
+		}
+	}
+	return newest
+}
+
+// fallbackSummary describes the fallback versions picked, e.g.
+// "docker=1.12 (os-default)", or an empty string if there are none.
+func (a *App) fallbackSummary() string {
+	parts := []string{}
+	for name, f := range a.Fallbacks {
+		parts = append(parts, fmt.Sprintf("%s=%s (%s)", name, f.Version, f.Policy))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
 // FilterOsVersions removes versions of Container Linux that don't use torcx.
 func shouldSkip(minVersion string, version string) bool {
 	minVer, _ := semver.NewVersion(minVersion)
@@ -106,6 +106,86 @@ func TestStrategyPrimary(t *testing.T) {
 	assert.Equal(t, []string{"9999.0.0"}, osv, "os versions")
 }
 
+// Test that version constraints pick the newest matching version
+func TestStrategyConstraint(t *testing.T) {
+	m := makeManifest([]string{"1.12", "17.03.1", "17.03.2", "17.06"})
+	a := App{
+		Conf: Config{},
+		packageManifestCache: map[string]*PackageManifest{
+			"9998.0.0": m,
+		},
+		CurrentOSVersion: "9998.0.0",
+	}
+	pv, _, err := a.PickVersion("docker", []string{">=17.09", ">=17.03 <17.04", "1.12"})
+	assert.Nil(t, err)
+	assert.Equal(t, "17.03.2", pv)
+}
+
+// Test the fallback policies when no preferred version is available
+func TestStrategyFallback(t *testing.T) {
+	m := makeManifest([]string{"1.12", "17.09", "17.06"})
+	// Only 1.12 is shipped in the vendor store
+	for i := 1; i < 3; i++ {
+		m.Packages[0].Versions[i].Locations = m.Packages[0].Versions[i].Locations[1:]
+	}
+	r, err := ParseVersionRange("<17.07")
+	assert.Nil(t, err)
+
+	pick := func(policy string, r VersionRange) (string, error) {
+		a := App{
+			Conf: Config{VersionFallback: policy, VersionFallbackRange: r},
+			packageManifestCache: map[string]*PackageManifest{
+				"9998.0.0": m,
+			},
+			CurrentOSVersion: "9998.0.0",
+		}
+		pv, _, err := a.PickVersion("docker", []string{"17.03"})
+		if err == nil {
+			assert.Equal(t, VersionFallback{Policy: policy, Version: pv}, a.Fallbacks["docker"])
+			assert.Equal(t, "docker="+pv+" ("+policy+")", a.fallbackSummary())
+		}
+		return pv, err
+	}
+
+	_, err = pick(FallbackFail, nil)
+	assert.Equal(t, NoVersionError, err)
+	_, err = pick("", nil)
+	assert.Equal(t, NoVersionError, err)
+
+	pv, err := pick(FallbackOSDefault, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.12", pv)
+	// Without a defaultVersion, use the vendor store
+	m.Packages[0].DefaultVersion = ""
+	pv, err = pick(FallbackOSDefault, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.12", pv)
+
+	pv, err = pick(FallbackNewest, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "17.09", pv)
+	pv, err = pick(FallbackNewest, r)
+	assert.Nil(t, err)
+	assert.Equal(t, "17.06", pv)
+	r, _ = ParseVersionRange(">=18.0")
+	_, err = pick(FallbackNewest, r)
+	assert.Equal(t, NoVersionError, err)
+
+	// A preferred version clears the fallback
+	a := App{
+		Conf:                 Config{VersionFallback: FallbackNewest},
+		packageManifestCache: map[string]*PackageManifest{"9998.0.0": m},
+		CurrentOSVersion:     "9998.0.0",
+	}
+	_, _, err = a.PickVersion("docker", []string{"17.03"})
+	assert.Nil(t, err)
+	pv, _, err = a.PickVersion("docker", []string{"17.06"})
+	assert.Nil(t, err)
+	assert.Equal(t, "17.06", pv)
+	assert.Empty(t, a.Fallbacks)
+	assert.Equal(t, "", a.fallbackSummary())
+}
+
 func makeManifest(dockerVersions []string) *PackageManifest {
 	m := PackageManifest{
 		Packages: []Package{
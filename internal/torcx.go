@@ -15,15 +15,12 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"strings"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/pkg/errors"
@@ -32,30 +29,41 @@ import (
 
 const TORCX_STORE = "/var/lib/torcx/store"
 
-type profileList struct {
-	LowerProfileNames  []string `json:"lower_profile_names"`
-	UserProfileName    *string  `json:"user_profile_name"`
-	CurrentProfilePath *string  `json:"current_profile_path"`
-	NextProfileName    *string  `json:"next_profile_name"`
-	Profiles           []string `json:"profiles"`
-}
-type profileListBox struct {
-	Kind  string      `json:"kind"`
-	Value profileList `json:"value"`
+// InstallAddon fetches, verify and store an addon image
+func (a *App) InstallAddon(name string, reference string, osVersions []string) error {
+	return a.InstallAddons([]AddonSelection{{Name: name, Version: reference, OSVersions: osVersions}})
 }
 
-type imageEntry struct {
-	Name      string `json:"name"`
-	Reference string `json:"reference"`
-	Filepath  string `json:"filepath"`
-}
-type imageListBox struct {
-	Kind  string       `json:"kind"`
-	Value []imageEntry `json:"value"`
+// InstallAddons fetches, verifies and stores all selected addons, then adds
+// them to the profile together, so that a failure to fetch any of them
+// leaves the profile untouched.
+func (a *App) InstallAddons(sels []AddonSelection) error {
+	if len(sels) == 0 {
+		return nil
+	}
+	for _, s := range sels {
+		if err := a.storeAddon(s.Name, s.Version, s.OSVersions); err != nil {
+			return err
+		}
+	}
+	logrus.Debugf("fetch phase complete, adding to profile")
+
+	err := a.UseAddons(sels)
+	if err != nil {
+		return errors.Wrapf(err, "failed to enable addons")
+	}
+	for _, s := range sels {
+		if policyFor(s.Name).reboot {
+			a.RebootRequiredBy = appendUnique(a.RebootRequiredBy, s.Name)
+		}
+	}
+
+	return nil
 }
 
-// InstallAddon fetches, verify and store an addon image
-func (a *App) InstallAddon(name string, reference string, osVersions []string) error {
+// storeAddon fetches an addon into the store of each OS version, unless
+// already present.
+func (a *App) storeAddon(name string, reference string, osVersions []string) error {
 	logrus.Infof("Installing %s:%s for os versions %v", name, reference, osVersions)
 	for _, osVersion := range osVersions {
 		if a.AddonInStore(name, reference, osVersion) {
@@ -72,6 +80,9 @@ func (a *App) InstallAddon(name string, reference string, osVersions []string) e
 		if err != nil {
 			return err // should not happen, strategy caught this case
 		}
+		if loc.Version.SourcePackage != "" {
+			logrus.Debugf("%s:%s for os version %s is built from %s", name, reference, osVersion, loc.Version.SourcePackage)
+		}
 		if loc.Path != "" {
 			logrus.Debugf("Skipping osVersion %s, already in store", osVersion)
 			continue
@@ -82,34 +93,24 @@ func (a *App) InstallAddon(name string, reference string, osVersions []string) e
 			return errors.Wrapf(err, "failed to fetch addon")
 		}
 
-		err = a.copyToStore(path, name, reference, osVersion)
+		err = a.copyToStore(path, loc.Version, osVersion)
 		if err != nil {
 			return errors.Wrapf(err, "copy to store failed")
 		}
 	}
-	logrus.Debugf("fetch phase complete, adding to profile")
-
-	err := a.UseAddon(name, reference)
-	if err != nil {
-		return errors.Wrapf(err, "failed to enable addon")
-	}
-	a.DockerRequiresReboot = true
-
 	return nil
 }
 
 // AddonInStore returns true if the referenced addon is already
 // in the store
 func (a *App) AddonInStore(name, reference, osVersion string) bool {
-	il := imageListBox{}
-
-	a.torcxCmd(&il, []string{
-		"image", "list",
-		"-n", osVersion,
-		name,
-	})
+	images, err := a.torcx.ImageList(osVersion, name)
+	if err != nil {
+		logrus.Debugf("failed to list torcx images: %s", err)
+		return false
+	}
 
-	for _, entry := range il.Value {
+	for _, entry := range images {
 		if entry.Name == name && entry.Reference == reference {
 			return true
 		}
@@ -118,70 +119,138 @@ func (a *App) AddonInStore(name, reference, osVersion string) bool {
 	return false
 }
 
-// copyToStore moves an already downloaded addon to the store
-func (a *App) copyToStore(path, name, reference, osVersion string) error {
+// copyToStore moves an already downloaded addon to the store.
+// The addon is written to a temporary file in the destination directory,
+// validated against the package hash and synced, then atomically renamed
+// in place; a failure at any point never leaves a partial store entry.
+func (a *App) copyToStore(path string, v *PackageVersion, osVersion string) error {
+	destPath := a.storePath(v.Package.Name, v.Version, osVersion)
+	if a.Conf.DryRun {
+		src := path
+		if src == "" {
+			src = "downloaded addon"
+		}
+		a.dryRun(ActionCopyToStore, destPath, "from "+src)
+		return nil
+	}
+
 	srcfd, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer srcfd.Close()
 
-	if strings.HasPrefix(path, "/tmp/") {
+	// Only remove temporary downloads, not other stores' entries
+	if filepath.Dir(path) == filepath.Clean(os.TempDir()) {
 		defer os.Remove(path)
 	}
 
-	var destPath string
-	if err := os.MkdirAll(filepath.Join(a.Conf.torcxStoreDir, osVersion), 0755); err != nil {
-		return err
+	destDir := filepath.Dir(destPath)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create store %s", destDir)
 	}
-	if osVersion != "" {
-		destPath = fmt.Sprintf("%s/%s/%s:%s.torcx.tgz",
-			a.Conf.torcxStoreDir, osVersion, name, reference)
-	} else {
-		destPath = fmt.Sprintf("%s/%s:%s.torcx.tgz", a.Conf.torcxStoreDir, name, reference)
-	}
-	destfd, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0644)
+	tmpfd, err := ioutil.TempFile(destDir, "."+filepath.Base(destPath))
 	if err != nil {
-		return nil
+		return errors.Wrapf(err, "failed to create temporary file in %s", destDir)
 	}
-	defer destfd.Close()
+	// Clean up on failure; after a successful rename, this is a no-op
+	defer os.Remove(tmpfd.Name())
+	defer tmpfd.Close()
 	logrus.Debugf("copying to store: src %s dst %s", path, destPath)
 
-	if _, err := io.Copy(destfd, srcfd); err != nil {
+	ok, err := v.ValidateHash(io.TeeReader(srcfd, tmpfd))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("hash validation failed for %s", path)
+	}
+
+	if err := tmpfd.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmpfd.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync %s", tmpfd.Name())
+	}
+	if err := tmpfd.Close(); err != nil {
 		return err
 	}
+	if err := os.Rename(tmpfd.Name(), destPath); err != nil {
+		return errors.Wrapf(err, "failed to rename to %s", destPath)
+	}
 
-	return destfd.Sync()
+	return syncDir(destDir)
+}
+
+// storePath returns the path of an addon in the (versioned) user store
+func (a *App) storePath(name, reference, osVersion string) string {
+	if osVersion != "" {
+		return fmt.Sprintf("%s/%s/%s:%s.torcx.tgz",
+			a.Conf.torcxStoreDir, osVersion, name, reference)
+	}
+	return fmt.Sprintf("%s/%s:%s.torcx.tgz", a.Conf.torcxStoreDir, name, reference)
 }
 
 // UseAddon selects the addon for installation on next boot.
+func (a *App) UseAddon(name string, reference string) error {
+	return a.UseAddons([]AddonSelection{{Name: name, Version: reference}})
+}
+
+// UseAddons selects the addons for installation on next boot.
 // When run on a fresh machine, this will create a profile
 // of our choosing, otherwise will use the already-enabled version.
-func (a *App) UseAddon(name string, reference string) error {
+func (a *App) UseAddons(sels []AddonSelection) error {
 	profileName, err := a.profileName()
 	if err != nil {
 		return errors.Wrap(err, "could not determine / create torcx profile")
 	}
 
-	// Add this addon to the profile
-	err = a.torcxCmd(nil, []string{
-		"profile", "use-image",
-		"--allow=missing",
-		"--name", profileName,
-		name + ":" + reference,
-	})
+	if a.Conf.DryRun {
+		for _, s := range sels {
+			a.dryRun(ActionProfileUseImage, profileName, s.Name+":"+s.Version)
+		}
+		a.dryRun(ActionProfileSetNext, profileName, "")
+		return nil
+	}
+
+	// Add the addons to the profile, in a single write so that it is
+	// left untouched if any cannot be added
+	images, err := a.torcx.ProfileImages(profileName)
 	if err != nil {
-		return errors.Wrap(err, "could not add image to profile")
+		return errors.Wrap(err, "could not read profile")
+	}
+	images = withProfileImages(images, sels)
+	if err := a.torcx.ProfileSetImages(profileName, images); err != nil {
+		return errors.Wrap(err, "could not add images to profile")
 	}
 
-	err = a.torcxCmd(nil, []string{
-		"profile", "set-next", profileName})
+	err = a.torcx.ProfileSetNext(profileName)
 	if err != nil {
 		return errors.Wrap(err, "could not set-next profile")
 	}
 	return nil
 }
 
+// withProfileImages returns a copy of images where the references of the
+// selected addons are replaced, or added at the end.
+func withProfileImages(images []ImageEntry, sels []AddonSelection) []ImageEntry {
+	updated := append([]ImageEntry{}, images...)
+	for _, s := range sels {
+		found := false
+		for i := range updated {
+			if updated[i].Name == s.Name {
+				updated[i].Reference = s.Version
+				found = true
+				break
+			}
+		}
+		if !found {
+			updated = append(updated, ImageEntry{Name: s.Name, Reference: s.Version})
+		}
+	}
+	return updated
+}
+
 // TorcxGC removes versioned stores that we know we won't need.
 // All versioned stores older than a given version are removed.
 func (a *App) TorcxGC(minOSVersion string) error {
@@ -218,6 +287,9 @@ func (a *App) TorcxGC(minOSVersion string) error {
 		}
 
 		p := filepath.Join(a.Conf.torcxStoreDir, entry.Name())
+		if a.dryRun(ActionRemoveStore, p, "older than "+minOSVersion) {
+			continue
+		}
 		logrus.Debugf("Removing unneeded torcx store directory %s", p)
 		if err := os.RemoveAll(p); err != nil {
 			return errors.Wrap(err, "failed to remove old torcx addons")
@@ -232,55 +304,31 @@ func (a *App) TorcxGC(minOSVersion string) error {
 // a new profile. If there is alread an existing profile,
 // we should use that instead
 func (a *App) profileName() (string, error) {
-	plb := profileListBox{}
-	err := a.torcxCmd(&plb, []string{"profile", "list"})
+	pl, err := a.torcx.ProfileList()
 	if err != nil {
 		return "", err
 	}
 
 	// If the next-profile name isn't default, just use it
-	if plb.Value.NextProfileName != nil && *plb.Value.NextProfileName != "vendor" {
-		logrus.Debugf("non-default torcx profile %s already active, using", *plb.Value.NextProfileName)
-		return *plb.Value.NextProfileName, nil
+	if pl.NextProfileName != nil && *pl.NextProfileName != "vendor" {
+		logrus.Debugf("non-default torcx profile %s already active, using", *pl.NextProfileName)
+		return *pl.NextProfileName, nil
 	}
 
 	// Otherwise, create our profile if it doesn't exist
 	exists := false
-	for _, profileName := range plb.Value.Profiles {
+	for _, profileName := range pl.Profiles {
 		if profileName == a.Conf.ProfileName {
 			exists = true
 			break
 		}
 	}
-	if !exists {
+	if !exists && !a.dryRun(ActionProfileNew, a.Conf.ProfileName, "") {
 		logrus.Debugf("creating torcx profile %s", a.Conf.ProfileName)
-		err = a.torcxCmd(nil, []string{
-			"profile", "new",
-			"--name", a.Conf.ProfileName})
+		err = a.torcx.ProfileNew(a.Conf.ProfileName)
 		if err != nil {
 			return "", err
 		}
 	}
 	return a.Conf.ProfileName, nil
 }
-
-// torcxCmd executes a torcx command. If result is not nil, attempt to
-// json-unmarshal stdout in to the result
-func (a *App) torcxCmd(result interface{}, args []string) error {
-	logrus.Debug("executing: ", a.Conf.TorcxBin, " ", args)
-	cmd := exec.Command(a.Conf.TorcxBin, args...)
-
-	out, err := cmd.Output()
-	if err != nil {
-		switch e := err.(type) {
-		case *exec.ExitError:
-			logrus.Debugf("torcx exited with non-zero status code, stderr: %s", string(e.Stderr))
-		}
-		return err
-	}
-
-	if result != nil {
-		return json.Unmarshal(out, result)
-	}
-	return nil
-}
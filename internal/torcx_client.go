@@ -0,0 +1,169 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TorcxClient is the set of torcx operations needed to manage
+// profiles and to inspect stores.
+type TorcxClient interface {
+	// ProfileList returns the state of torcx profiles
+	ProfileList() (*ProfileList, error)
+	// ProfileNew creates a new, empty, user profile
+	ProfileNew(name string) error
+	// ProfileUseImage adds an image to a user profile, replacing any
+	// other reference for the same image name. The image does not
+	// need to be present in a store.
+	ProfileUseImage(profile, name, reference string) error
+	// ProfileSetImages replaces all images of a user profile at once
+	ProfileSetImages(profile string, images []ImageEntry) error
+	// ProfileSetNext selects the profile to apply on next boot
+	ProfileSetNext(profile string) error
+	// ProfileImages returns the images listed in a profile
+	ProfileImages(profile string) ([]ImageEntry, error)
+	// ImageList lists images available in the stores for a given
+	// OS version (or the current one, if empty), optionally filtered
+	// by image name.
+	ImageList(osVersion, name string) ([]ImageEntry, error)
+}
+
+// ProfileList is the state of torcx profiles, as reported by
+// `torcx profile list`
+type ProfileList struct {
+	LowerProfileNames  []string `json:"lower_profile_names"`
+	UserProfileName    *string  `json:"user_profile_name"`
+	CurrentProfilePath *string  `json:"current_profile_path"`
+	NextProfileName    *string  `json:"next_profile_name"`
+	Profiles           []string `json:"profiles"`
+}
+
+// ImageEntry is an image in a torcx store, as reported by
+// `torcx image list`
+type ImageEntry struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Filepath  string `json:"filepath"`
+}
+
+type profileListBox struct {
+	Kind  string      `json:"kind"`
+	Value ProfileList `json:"value"`
+}
+
+type imageListBox struct {
+	Kind  string       `json:"kind"`
+	Value []ImageEntry `json:"value"`
+}
+
+// torcxExec is a TorcxClient backed by the torcx binary
+type torcxExec struct {
+	bin string
+	// torcx has no command to show profile contents, those are read
+	// directly from disk
+	profiles *torcxNative
+}
+
+// newTorcxExec returns a TorcxClient executing the torcx binary at the
+// given path, after checking that it can be run.
+func newTorcxExec(bin string) (TorcxClient, error) {
+	t := &torcxExec{
+		bin:      bin,
+		profiles: newTorcxNative(""),
+	}
+	if err := t.run(nil, []string{"help"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *torcxExec) ProfileList() (*ProfileList, error) {
+	plb := profileListBox{}
+	if err := t.run(&plb, []string{"profile", "list"}); err != nil {
+		return nil, err
+	}
+	return &plb.Value, nil
+}
+
+func (t *torcxExec) ProfileNew(name string) error {
+	return t.run(nil, []string{
+		"profile", "new",
+		"--name", name})
+}
+
+func (t *torcxExec) ProfileUseImage(profile, name, reference string) error {
+	return t.run(nil, []string{
+		"profile", "use-image",
+		"--allow=missing",
+		"--name", profile,
+		name + ":" + reference,
+	})
+}
+
+// ProfileSetImages writes the profile directly, as torcx can only add
+// images one at a time.
+func (t *torcxExec) ProfileSetImages(profile string, images []ImageEntry) error {
+	return t.profiles.ProfileSetImages(profile, images)
+}
+
+func (t *torcxExec) ProfileSetNext(profile string) error {
+	return t.run(nil, []string{
+		"profile", "set-next", profile})
+}
+
+func (t *torcxExec) ProfileImages(profile string) ([]ImageEntry, error) {
+	return t.profiles.ProfileImages(profile)
+}
+
+func (t *torcxExec) ImageList(osVersion, name string) ([]ImageEntry, error) {
+	args := []string{"image", "list"}
+	if osVersion != "" {
+		args = append(args, "-n", osVersion)
+	}
+	if name != "" {
+		args = append(args, name)
+	}
+
+	il := imageListBox{}
+	if err := t.run(&il, args); err != nil {
+		return nil, err
+	}
+	return il.Value, nil
+}
+
+// run executes a torcx command. If result is not nil, attempt to
+// json-unmarshal stdout in to the result
+func (t *torcxExec) run(result interface{}, args []string) error {
+	logrus.Debug("executing: ", t.bin, " ", args)
+	cmd := exec.Command(t.bin, args...)
+
+	out, err := cmd.Output()
+	if err != nil {
+		switch e := err.(type) {
+		case *exec.ExitError:
+			logrus.Debugf("torcx exited with non-zero status code, stderr: %s", string(e.Stderr))
+		}
+		return err
+	}
+
+	if result != nil {
+		return json.Unmarshal(out, result)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// fakeTorcx is an in-process TorcxClient emulating torcx semantics.
+// Profiles are kept in memory, while images are looked up in real
+// store directories, so that addons written by the App are visible.
+type fakeTorcx struct {
+	// Unversioned stores, e.g. the vendor store
+	storeDirs []string
+	// The user store, holding versioned sub-stores
+	userStore string
+	// OS version used when none is specified
+	currentOSVersion string
+
+	lowerProfiles map[string][]ImageEntry
+	userProfiles  map[string][]ImageEntry
+	// The profile applied at boot, if any
+	currentProfile string
+	nextProfile    string
+	// Error returned by profile writes, if any
+	errProfileWrite error
+}
+
+func newFakeTorcx(userStore, currentOSVersion string) *fakeTorcx {
+	return &fakeTorcx{
+		userStore:        userStore,
+		currentOSVersion: currentOSVersion,
+		lowerProfiles: map[string][]ImageEntry{
+			"vendor": {{Name: "docker", Reference: "com.coreos.cl"}},
+		},
+		userProfiles: map[string][]ImageEntry{},
+		nextProfile:  "vendor",
+	}
+}
+
+func (f *fakeTorcx) ProfileList() (*ProfileList, error) {
+	pl := ProfileList{
+		LowerProfileNames: []string{},
+		Profiles:          []string{},
+	}
+	for name := range f.lowerProfiles {
+		pl.LowerProfileNames = append(pl.LowerProfileNames, name)
+		pl.Profiles = append(pl.Profiles, name)
+	}
+	for name := range f.userProfiles {
+		pl.Profiles = append(pl.Profiles, name)
+	}
+	sort.Strings(pl.LowerProfileNames)
+	sort.Strings(pl.Profiles)
+
+	if f.currentProfile != "" {
+		cur := f.currentProfile
+		curPath := "/run/torcx/profile.json"
+		pl.UserProfileName = &cur
+		pl.CurrentProfilePath = &curPath
+	}
+	next := f.nextProfile
+	pl.NextProfileName = &next
+
+	return &pl, nil
+}
+
+func (f *fakeTorcx) ProfileNew(name string) error {
+	if f.exists(name) {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+	f.userProfiles[name] = []ImageEntry{}
+	return nil
+}
+
+func (f *fakeTorcx) ProfileUseImage(profile, name, reference string) error {
+	images, ok := f.userProfiles[profile]
+	if !ok {
+		return fmt.Errorf("user profile %q not found", profile)
+	}
+
+	for i := range images {
+		if images[i].Name == name {
+			images[i].Reference = reference
+			return nil
+		}
+	}
+	f.userProfiles[profile] = append(images, ImageEntry{Name: name, Reference: reference})
+	return nil
+}
+
+func (f *fakeTorcx) ProfileSetImages(profile string, images []ImageEntry) error {
+	if _, ok := f.userProfiles[profile]; !ok {
+		return fmt.Errorf("user profile %q not found", profile)
+	}
+	if f.errProfileWrite != nil {
+		return f.errProfileWrite
+	}
+	f.userProfiles[profile] = append([]ImageEntry{}, images...)
+	return nil
+}
+
+func (f *fakeTorcx) ProfileSetNext(profile string) error {
+	if !f.exists(profile) {
+		return fmt.Errorf("profile %q not found", profile)
+	}
+	f.nextProfile = profile
+	return nil
+}
+
+func (f *fakeTorcx) ImageList(osVersion, name string) ([]ImageEntry, error) {
+	if osVersion == "" {
+		osVersion = f.currentOSVersion
+	}
+
+	dirs := append([]string{}, f.storeDirs...)
+	dirs = append(dirs, f.userStore, filepath.Join(f.userStore, osVersion))
+
+	images := []ImageEntry{}
+	for _, dir := range dirs {
+		entries, err := scanStore(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, entries...)
+	}
+	return images, nil
+}
+
+func (f *fakeTorcx) ProfileImages(profile string) ([]ImageEntry, error) {
+	if images, ok := f.userProfiles[profile]; ok {
+		return images, nil
+	}
+	if images, ok := f.lowerProfiles[profile]; ok {
+		return images, nil
+	}
+	return nil, fmt.Errorf("profile %q not found", profile)
+}
+
+// profileImages returns the images in a profile, for test assertions
+func (f *fakeTorcx) profileImages(profile string) []ImageEntry {
+	images, _ := f.ProfileImages(profile)
+	return images
+}
+
+func (f *fakeTorcx) exists(profile string) bool {
+	_, lower := f.lowerProfiles[profile]
+	_, user := f.userProfiles[profile]
+	return lower || user
+}
@@ -0,0 +1,423 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TorcxBackendExec drives torcx by executing its binary
+	TorcxBackendExec = "exec"
+	// TorcxBackendNative directly manipulates torcx on-disk files
+	TorcxBackendNative = "native"
+
+	// kindProfileManifestV0 is the kind of profiles written by us
+	kindProfileManifestV0 = "profile-manifest-v0"
+	// kindProfileManifestV1 is a newer profile kind, also understood
+	kindProfileManifestV1 = "profile-manifest-v1"
+	// vendorProfileName is the profile used when no next-profile is set
+	vendorProfileName = "vendor"
+)
+
+type profileImage struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Remote    string `json:"remote,omitempty"`
+}
+
+type profileManifest struct {
+	Images []profileImage `json:"images"`
+}
+
+type profileManifestBox struct {
+	Kind  string          `json:"kind"`
+	Value profileManifest `json:"value"`
+}
+
+// torcxNative is a TorcxClient which reads and writes torcx profiles
+// and scans stores directly, relying only on torcx on-disk formats.
+type torcxNative struct {
+	// Read-only profile directories, in increasing priority
+	lowerProfileDirs []string
+	// Directory holding user profiles
+	userProfileDir string
+	// File naming the profile to apply on next boot
+	nextProfilePath string
+	// Runtime metadata written by torcx at boot
+	metadataPath string
+	// Unversioned read-only stores, each possibly holding versioned sub-stores
+	lowerStoreDirs []string
+	// The user store, holding versioned sub-stores
+	userStoreDir string
+	// Returns the OS version to use when none is specified
+	currentOSVersion func() (string, error)
+}
+
+// newTorcxNative returns a native TorcxClient using the standard torcx
+// paths, with the user store at userStoreDir.
+func newTorcxNative(userStoreDir string) *torcxNative {
+	return &torcxNative{
+		lowerProfileDirs: []string{
+			"/usr/share/torcx/profiles",
+			"/usr/share/oem/torcx/profiles",
+		},
+		userProfileDir:  "/etc/torcx/profiles",
+		nextProfilePath: "/etc/torcx/next-profile",
+		metadataPath:    "/run/metadata/torcx",
+		lowerStoreDirs: []string{
+			"/usr/share/torcx/store",
+			"/usr/share/oem/torcx/store",
+		},
+		userStoreDir: userStoreDir,
+		currentOSVersion: func() (string, error) {
+			v, _, err := GetCurrentOSInfo()
+			return v, err
+		},
+	}
+}
+
+func (t *torcxNative) ProfileList() (*ProfileList, error) {
+	pl := ProfileList{
+		LowerProfileNames: []string{},
+		Profiles:          []string{},
+	}
+
+	seen := map[string]bool{}
+	for _, dir := range append(append([]string{}, t.lowerProfileDirs...), t.userProfileDir) {
+		names, err := listProfiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if !seen[n] {
+				seen[n] = true
+				pl.Profiles = append(pl.Profiles, n)
+			}
+		}
+	}
+	sort.Strings(pl.Profiles)
+
+	next, err := t.nextProfile()
+	if err != nil {
+		return nil, err
+	}
+	pl.NextProfileName = &next
+
+	// Runtime metadata is only present once torcx has run at boot
+	md, err := readEnvFile(t.metadataPath)
+	if err == nil {
+		if v := md["TORCX_LOWER_PROFILES"]; v != "" {
+			pl.LowerProfileNames = strings.Split(v, ":")
+		}
+		if v := md["TORCX_UPPER_PROFILE"]; v != "" {
+			pl.UserProfileName = &v
+		}
+		if v := md["TORCX_PROFILE_PATH"]; v != "" {
+			pl.CurrentProfilePath = &v
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read torcx metadata")
+	}
+
+	return &pl, nil
+}
+
+func (t *torcxNative) ProfileNew(name string) error {
+	if err := validProfileName(name); err != nil {
+		return err
+	}
+	pl, err := t.ProfileList()
+	if err != nil {
+		return err
+	}
+	for _, p := range pl.Profiles {
+		if p == name {
+			return errors.Errorf("profile %q already exists", name)
+		}
+	}
+
+	if err := os.MkdirAll(t.userProfileDir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create profiles directory")
+	}
+	return t.writeProfile(name, &profileManifestBox{
+		Kind:  kindProfileManifestV0,
+		Value: profileManifest{Images: []profileImage{}},
+	})
+}
+
+func (t *torcxNative) ProfileUseImage(profile, name, reference string) error {
+	if err := validProfileName(profile); err != nil {
+		return err
+	}
+	box, err := readProfile(filepath.Join(t.userProfileDir, profile+".json"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read user profile %q", profile)
+	}
+
+	found := false
+	for i := range box.Value.Images {
+		if box.Value.Images[i].Name == name {
+			box.Value.Images[i].Reference = reference
+			found = true
+			break
+		}
+	}
+	if !found {
+		box.Value.Images = append(box.Value.Images, profileImage{Name: name, Reference: reference})
+	}
+
+	return t.writeProfile(profile, box)
+}
+
+func (t *torcxNative) ProfileSetImages(profile string, images []ImageEntry) error {
+	if err := validProfileName(profile); err != nil {
+		return err
+	}
+	box, err := readProfile(filepath.Join(t.userProfileDir, profile+".json"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read user profile %q", profile)
+	}
+
+	// Keep remotes of unchanged images
+	previous := map[string]profileImage{}
+	for _, img := range box.Value.Images {
+		previous[img.Name] = img
+	}
+	box.Value.Images = []profileImage{}
+	for _, img := range images {
+		pi := profileImage{Name: img.Name, Reference: img.Reference}
+		if p, ok := previous[img.Name]; ok && p.Reference == img.Reference {
+			pi.Remote = p.Remote
+		}
+		box.Value.Images = append(box.Value.Images, pi)
+	}
+
+	return t.writeProfile(profile, box)
+}
+
+func (t *torcxNative) ProfileSetNext(profile string) error {
+	if err := validProfileName(profile); err != nil {
+		return err
+	}
+	pl, err := t.ProfileList()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, p := range pl.Profiles {
+		if p == profile {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("profile %q not found", profile)
+	}
+
+	logrus.Debugf("writing %s to %s", profile, t.nextProfilePath)
+	return writeFileAtomic(t.nextProfilePath, []byte(profile), 0644)
+}
+
+func (t *torcxNative) ProfileImages(profile string) ([]ImageEntry, error) {
+	if err := validProfileName(profile); err != nil {
+		return nil, err
+	}
+
+	// User profiles take precedence over lower ones with the same name
+	dirs := append([]string{t.userProfileDir}, t.lowerProfileDirs...)
+	for _, dir := range dirs {
+		box, err := readProfile(filepath.Join(dir, profile+".json"))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read profile %q", profile)
+		}
+
+		images := []ImageEntry{}
+		for _, img := range box.Value.Images {
+			images = append(images, ImageEntry{Name: img.Name, Reference: img.Reference})
+		}
+		return images, nil
+	}
+	return nil, errors.Errorf("profile %q not found", profile)
+}
+
+func (t *torcxNative) ImageList(osVersion, name string) ([]ImageEntry, error) {
+	if osVersion == "" {
+		v, err := t.currentOSVersion()
+		if err != nil {
+			return nil, err
+		}
+		osVersion = v
+	}
+
+	// Same lookup order as torcx: vendor, oem, then user stores
+	dirs := []string{}
+	for _, d := range append(append([]string{}, t.lowerStoreDirs...), t.userStoreDir) {
+		dirs = append(dirs, d, filepath.Join(d, osVersion))
+	}
+
+	images := []ImageEntry{}
+	for _, dir := range dirs {
+		entries, err := scanStore(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, entries...)
+	}
+	return images, nil
+}
+
+// nextProfile returns the name of the profile to apply on next boot
+func (t *torcxNative) nextProfile() (string, error) {
+	data, err := ioutil.ReadFile(t.nextProfilePath)
+	if os.IsNotExist(err) {
+		return vendorProfileName, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read next profile")
+	}
+
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return vendorProfileName, nil
+	}
+	return name, nil
+}
+
+// writeProfile atomically writes a user profile
+func (t *torcxNative) writeProfile(name string, box *profileManifestBox) error {
+	data, err := json.MarshalIndent(box, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(t.userProfileDir, name+".json")
+	logrus.Debugf("writing torcx profile %s", path)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// readProfile reads and parses a torcx profile manifest
+func readProfile(path string) (*profileManifestBox, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	box := profileManifestBox{}
+	if err := json.Unmarshal(data, &box); err != nil {
+		return nil, errors.Wrap(err, "failed to parse profile")
+	}
+	if box.Kind != kindProfileManifestV0 && box.Kind != kindProfileManifestV1 {
+		return nil, errors.Errorf("unexpected profile kind %q", box.Kind)
+	}
+	return &box, nil
+}
+
+// listProfiles returns the names of the profiles in a directory
+func listProfiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list profiles in %s", dir)
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return names, nil
+}
+
+// scanStore lists the images in a single store directory, optionally
+// filtered by name. A missing directory is an empty store.
+func scanStore(dir, name string) ([]ImageEntry, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list store %s", dir)
+	}
+
+	images := []ImageEntry{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".torcx.tgz") {
+			continue
+		}
+		ref := strings.SplitN(strings.TrimSuffix(e.Name(), ".torcx.tgz"), ":", 2)
+		if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+			continue
+		}
+		if name != "" && ref[0] != name {
+			continue
+		}
+		images = append(images, ImageEntry{
+			Name:      ref[0],
+			Reference: ref[1],
+			Filepath:  filepath.Join(dir, e.Name()),
+		})
+	}
+	return images, nil
+}
+
+func validProfileName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+		return errors.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the destination
+// directory, then renames it in place.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, "."+base)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
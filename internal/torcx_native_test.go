@@ -0,0 +1,155 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTorcxNative returns a native client rooted in a temporary directory
+func newTestTorcxNative(t *testing.T, root string) *torcxNative {
+	for _, d := range []string{"usr/share/torcx/profiles", "usr/share/torcx/store", "etc/torcx", "var/lib/torcx/store"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vendor := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "docker", "reference": "com.coreos.cl"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(root, "usr/share/torcx/profiles/vendor.json"), []byte(vendor), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &torcxNative{
+		lowerProfileDirs: []string{filepath.Join(root, "usr/share/torcx/profiles")},
+		userProfileDir:   filepath.Join(root, "etc/torcx/profiles"),
+		nextProfilePath:  filepath.Join(root, "etc/torcx/next-profile"),
+		metadataPath:     filepath.Join(root, "run/metadata/torcx"),
+		lowerStoreDirs:   []string{filepath.Join(root, "usr/share/torcx/store")},
+		userStoreDir:     filepath.Join(root, "var/lib/torcx/store"),
+		currentOSVersion: func() (string, error) { return "9998.0.0", nil },
+	}
+}
+
+func TestTorcxNativeProfiles(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	tn := newTestTorcxNative(t, root)
+
+	pl, err := tn.ProfileList()
+	assert.Nil(err)
+	assert.Equal([]string{"vendor"}, pl.Profiles)
+	assert.Equal("vendor", *pl.NextProfileName)
+	assert.Nil(pl.UserProfileName)
+
+	assert.NotNil(tn.ProfileNew("vendor"))
+	assert.NotNil(tn.ProfileUseImage("vendor", "docker", "17.03"))
+	assert.NotNil(tn.ProfileSetNext("missing"))
+
+	assert.Nil(tn.ProfileNew("tectonic"))
+	assert.Nil(tn.ProfileUseImage("tectonic", "docker", "1.12"))
+	assert.Nil(tn.ProfileUseImage("tectonic", "docker", "17.03"))
+	assert.Nil(tn.ProfileSetNext("tectonic"))
+
+	pl, err = tn.ProfileList()
+	assert.Nil(err)
+	assert.Equal([]string{"tectonic", "vendor"}, pl.Profiles)
+	assert.Equal("tectonic", *pl.NextProfileName)
+
+	box, err := readProfile(filepath.Join(root, "etc/torcx/profiles/tectonic.json"))
+	assert.Nil(err)
+	assert.Equal(kindProfileManifestV0, box.Kind)
+	assert.Equal([]profileImage{{Name: "docker", Reference: "17.03"}}, box.Value.Images)
+
+	images, err := tn.ProfileImages("tectonic")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "17.03"}}, images)
+
+	assert.NotNil(tn.ProfileSetImages("vendor", nil))
+	assert.Nil(tn.ProfileSetImages("tectonic", []ImageEntry{{Name: "cni", Reference: "0.6"}, {Name: "docker", Reference: "17.06"}}))
+	images, err = tn.ProfileImages("tectonic")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{{Name: "cni", Reference: "0.6"}, {Name: "docker", Reference: "17.06"}}, images)
+	assert.Nil(tn.ProfileSetImages("tectonic", []ImageEntry{{Name: "docker", Reference: "17.03"}}))
+	images, err = tn.ProfileImages("tectonic")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "17.03"}}, images)
+	images, err = tn.ProfileImages("vendor")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "com.coreos.cl"}}, images)
+	_, err = tn.ProfileImages("missing")
+	assert.NotNil(err)
+
+	next, err := ioutil.ReadFile(filepath.Join(root, "etc/torcx/next-profile"))
+	assert.Nil(err)
+	assert.Equal("tectonic", string(next))
+
+	// Runtime metadata, as written by torcx at boot
+	if err := os.MkdirAll(filepath.Join(root, "run/metadata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	md := "TORCX_LOWER_PROFILES=\"vendor\"\nTORCX_UPPER_PROFILE=\"tectonic\"\nTORCX_PROFILE_PATH=\"/run/torcx/profile.json\"\n"
+	if err := ioutil.WriteFile(tn.metadataPath, []byte(md), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pl, err = tn.ProfileList()
+	assert.Nil(err)
+	assert.Equal([]string{"vendor"}, pl.LowerProfileNames)
+	assert.Equal("tectonic", *pl.UserProfileName)
+	assert.Equal("/run/torcx/profile.json", *pl.CurrentProfilePath)
+}
+
+func TestTorcxNativeImageList(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	tn := newTestTorcxNative(t, root)
+
+	for _, d := range []string{"9998.0.0", "9999.0.0"} {
+		if err := os.MkdirAll(filepath.Join(tn.userStoreDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(t, filepath.Join(root, "usr/share/torcx/store/docker:1.12.torcx.tgz"))
+	touch(t, filepath.Join(tn.userStoreDir, "9998.0.0/docker:17.03.torcx.tgz"))
+	touch(t, filepath.Join(tn.userStoreDir, "9999.0.0/docker:17.06.torcx.tgz"))
+	touch(t, filepath.Join(tn.userStoreDir, "9999.0.0/other:1.torcx.tgz"))
+	touch(t, filepath.Join(tn.userStoreDir, "9999.0.0/garbage.tgz"))
+
+	images, err := tn.ImageList("", "docker")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{
+		{Name: "docker", Reference: "1.12", Filepath: filepath.Join(root, "usr/share/torcx/store/docker:1.12.torcx.tgz")},
+		{Name: "docker", Reference: "17.03", Filepath: filepath.Join(tn.userStoreDir, "9998.0.0/docker:17.03.torcx.tgz")},
+	}, images)
+
+	images, err = tn.ImageList("9999.0.0", "")
+	assert.Nil(err)
+	assert.Equal([]ImageEntry{
+		{Name: "docker", Reference: "1.12", Filepath: filepath.Join(root, "usr/share/torcx/store/docker:1.12.torcx.tgz")},
+		{Name: "docker", Reference: "17.06", Filepath: filepath.Join(tn.userStoreDir, "9999.0.0/docker:17.06.torcx.tgz")},
+		{Name: "other", Reference: "1", Filepath: filepath.Join(tn.userStoreDir, "9999.0.0/other:1.torcx.tgz")},
+	}, images)
+}
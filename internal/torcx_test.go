@@ -15,11 +15,16 @@
 package internal
 
 import (
+	"crypto/sha512"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,6 +61,240 @@ func TestTorcxGC(t *testing.T) {
 	assert.Equal(expected, actual)
 }
 
+func TestTorcxGCDryRun(t *testing.T) {
+	assert := assert.New(t)
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	dirs := []string{"101.0.0", "102.0.0"}
+	for _, d := range dirs {
+		if err := os.Mkdir(filepath.Join(storeDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := NewApp(Config{
+		torcxStoreDir: storeDir,
+		TorcxBin:      "/bin/true",
+		DryRun:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.TorcxGC("102.0.0")
+	assert.Nil(err)
+
+	assert.Equal([]string{"101.0.0/", "102.0.0/"}, listDir(t, storeDir))
+	expected := []PlanStep{
+		{
+			Action: ActionRemoveStore,
+			Target: filepath.Join(storeDir, "101.0.0"),
+			Detail: "older than 102.0.0",
+		},
+	}
+	assert.Equal(expected, a.Plan.Steps)
+}
+
+func TestInstallAddon(t *testing.T) {
+	assert := assert.New(t)
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	content := []byte("docker addon\n")
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	ft := newFakeTorcx(storeDir, "9998.0.0")
+	a, err := NewApp(Config{
+		torcxStoreDir: storeDir,
+		torcxClient:   ft,
+		ProfileName:   "tectonic",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := makeRemoteManifest("17.03", ts.URL+"/docker:17.03.torcx.tgz", content)
+	a.packageManifestCache["9999.0.0"] = m
+	a.packageManifestCache["9998.0.0"] = m
+
+	err = a.InstallAddon("docker", "17.03", []string{"9999.0.0", "9998.0.0"})
+	assert.Nil(err)
+	assert.Equal(1, fetches)
+	assert.Equal([]string{"docker"}, a.RebootRequiredBy)
+	assert.Equal([]string{"docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, "9999.0.0")))
+	assert.Equal([]string{"docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, "9998.0.0")))
+	assert.True(a.AddonInStore("docker", "17.03", "9999.0.0"))
+
+	pl, err := ft.ProfileList()
+	assert.Nil(err)
+	assert.Equal("tectonic", *pl.NextProfileName)
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "17.03"}}, ft.profileImages("tectonic"))
+
+	// Already in store, nothing to fetch again
+	err = a.InstallAddon("docker", "17.03", []string{"9999.0.0", "9998.0.0"})
+	assert.Nil(err)
+	assert.Equal(1, fetches)
+}
+
+// Test that several components are added to the profile together, and
+// that the profile is untouched if any of them can't be fetched
+func TestInstallAddons(t *testing.T) {
+	assert := assert.New(t)
+	defer withFastRetries(t)()
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	docker := []byte("docker addon\n")
+	cni := []byte("cni addon\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docker:17.03.torcx.tgz":
+			w.Write(docker)
+		case "/cni:0.6.torcx.tgz":
+			w.Write(cni)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	m := makeRemoteManifest("17.03", ts.URL+"/docker:17.03.torcx.tgz", docker)
+	m.Packages = append(m.Packages, Package{
+		Name: "cni",
+		Versions: []PackageVersion{
+			{
+				Version:   "0.6",
+				Hash:      fmt.Sprintf("sha512-%x", sha512.Sum512(cni)),
+				Locations: []Location{{URL: ts.URL + "/cni:0.6.torcx.tgz"}},
+			},
+			{
+				Version:   "0.7",
+				Hash:      "sha512-000",
+				Locations: []Location{{URL: ts.URL + "/cni:0.7.torcx.tgz"}},
+			},
+		},
+	})
+	fillManifestBackrefs(m)
+
+	ft := newFakeTorcx(storeDir, "9998.0.0")
+	a, err := NewApp(Config{
+		torcxStoreDir: storeDir,
+		torcxClient:   ft,
+		ProfileName:   "tectonic",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.CurrentOSVersion = "9998.0.0"
+	a.packageManifestCache["9998.0.0"] = m
+
+	a.RuntimeVersions = map[string][]string{
+		"docker": {"17.03"},
+		"cni":    {"0.7"},
+	}
+	sels, err := a.SelectAddons()
+	assert.Nil(err)
+	assert.Equal(2, len(sels))
+	assert.NotNil(a.InstallAddons(sels))
+	assert.Empty(ft.profileImages("tectonic"))
+	assert.Empty(a.RebootRequiredBy)
+
+	a.RuntimeVersions["cni"] = []string{"0.6"}
+	sels, err = a.SelectAddons()
+	assert.Nil(err)
+	assert.Equal([]AddonSelection{
+		{Name: "cni", Version: "0.6", OSVersions: []string{"9998.0.0"}},
+		{Name: "docker", Version: "17.03", OSVersions: []string{"9998.0.0"}},
+	}, sels)
+	assert.Nil(a.InstallAddons(sels))
+	assert.Equal([]string{"cni:0.6.torcx.tgz", "docker:17.03.torcx.tgz"}, listDir(t, filepath.Join(storeDir, "9998.0.0")))
+	assert.Equal([]string{"cni", "docker"}, a.RebootRequiredBy)
+
+	pl, err := ft.ProfileList()
+	assert.Nil(err)
+	assert.Equal("tectonic", *pl.NextProfileName)
+	assert.Equal([]ImageEntry{{Name: "cni", Reference: "0.6"}, {Name: "docker", Reference: "17.03"}}, ft.profileImages("tectonic"))
+
+	// A failed profile write leaves the profile untouched
+	ft.userProfiles["tectonic"] = []ImageEntry{{Name: "docker", Reference: "1.12"}}
+	ft.errProfileWrite = errors.New("read-only filesystem")
+	a.RebootRequiredBy = nil
+	assert.NotNil(a.InstallAddons(sels))
+	assert.Equal([]ImageEntry{{Name: "docker", Reference: "1.12"}}, ft.profileImages("tectonic"))
+	assert.Empty(a.RebootRequiredBy)
+	ft.errProfileWrite = nil
+
+	// A missing component fails selection
+	a.RuntimeVersions["rkt"] = []string{"1.28"}
+	_, err = a.SelectAddons()
+	assert.NotNil(err)
+}
+
+// Test that an already customized profile is kept
+func TestUseAddonExistingProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	ft := newFakeTorcx("", "9998.0.0")
+	ft.userProfiles["custom"] = []ImageEntry{
+		{Name: "docker", Reference: "1.12"},
+		{Name: "other", Reference: "1"},
+	}
+	ft.nextProfile = "custom"
+
+	a := App{
+		Conf:  Config{ProfileName: "tectonic"},
+		torcx: ft,
+	}
+
+	err := a.UseAddon("docker", "17.03")
+	assert.Nil(err)
+
+	pl, err := ft.ProfileList()
+	assert.Nil(err)
+	assert.Equal("custom", *pl.NextProfileName)
+	assert.Equal([]string{"custom", "vendor"}, pl.Profiles)
+	expected := []ImageEntry{
+		{Name: "docker", Reference: "17.03"},
+		{Name: "other", Reference: "1"},
+	}
+	assert.Equal(expected, ft.profileImages("custom"))
+}
+
+// makeRemoteManifest returns a manifest with a single remote docker addon
+func makeRemoteManifest(version, url string, content []byte) *PackageManifest {
+	m := PackageManifest{
+		Packages: []Package{
+			{
+				Name: "docker",
+				Versions: []PackageVersion{
+					{
+						Version:   version,
+						Hash:      fmt.Sprintf("sha512-%x", sha512.Sum512(content)),
+						Locations: []Location{{URL: url}},
+					},
+				},
+			},
+		},
+	}
+
+	fillManifestBackrefs(&m)
+	return &m
+}
+
 func touch(t *testing.T, path string) {
 	f, err := os.Create(path)
 	if err != nil {
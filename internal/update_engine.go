@@ -16,29 +16,113 @@ package internal
 
 import (
 	"io/ioutil"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/godbus/dbus"
 )
 
-// Avoid a race condition where this chan gets closed / gc'd while another
-// G still has an outstanding message by declaring this global
-var statusCh chan updateengine.Status
-
 const (
 	// OsReleaseFile contains the default path to the os-release file
 	OsReleaseFile = "/usr/lib/os-release"
 )
 
+// Policies when an OS update fails or times out
+const (
+	// OSUpdateFail fails the bootstrap
+	OSUpdateFail = "fail"
+	// OSUpdateContinue continues on the current OS version
+	OSUpdateContinue = "continue"
+)
+
+// Sources of the next OS version
+const (
+	// NextOSVersionUpdateEngine is an update staged by update_engine
+	NextOSVersionUpdateEngine = "update_engine"
+	// NextOSVersionOmaha is the version offered by the update server
+	NextOSVersionOmaha = "omaha"
+)
+
+// osUpdateRetryPause is the pause before triggering an update again, after
+// an error
+var osUpdateRetryPause = 10 * time.Second
+
+// UpdateEngine is the interface to update_engine, as implemented by its
+// D-Bus client.
+type UpdateEngine interface {
+	GetStatus() (updateengine.Status, error)
+	AttemptUpdate() error
+	// ReceiveStatuses sends the current status, then status updates,
+	// until stop is closed
+	ReceiveStatuses(rcvr chan updateengine.Status, stop <-chan struct{})
+	// ResetStatus abandons a staged update, which must then be
+	// downloaded again
+	ResetStatus() error
+	Close() error
+}
+
+// dbusUpdateEngine adds the methods missing from the vendored D-Bus client
+type dbusUpdateEngine struct {
+	*updateengine.Client
+}
+
+// ResetStatus calls update_engine's ResetStatus method on a dedicated
+// connection, as the client does not expose its own.
+func (dbusUpdateEngine) ResetStatus() error {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Auth([]dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}); err != nil {
+		return err
+	}
+	if err := conn.Hello(); err != nil {
+		return err
+	}
+	obj := conn.Object("com.coreos.update1", dbus.ObjectPath("/com/coreos/update1"))
+	return obj.Call("com.coreos.update1.Manager.ResetStatus", 0).Err
+}
+
+// connectUpdateEngine returns a client to update_engine, to be closed
+// after use.
+func (a *App) connectUpdateEngine() (UpdateEngine, error) {
+	if a.Conf.updateEngine != nil {
+		return a.Conf.updateEngine, nil
+	}
+	ue, err := updateengine.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to update-engine")
+	}
+	return dbusUpdateEngine{ue}, nil
+}
+
+// validOSUpdateFailurePolicy returns true if policy is known; empty means
+// OSUpdateFail.
+func validOSUpdateFailurePolicy(policy string) bool {
+	switch policy {
+	case OSUpdateFail, OSUpdateContinue, "":
+		return true
+	}
+	return false
+}
+
+// osReleasePath is the os-release file to read, overridden in tests
+var osReleasePath = OsReleaseFile
+
 // GetCurrentOSInfo gets the current OS version and the board
 func GetCurrentOSInfo() (string, string, error) {
-	logrus.Debug("reading current OS version + board from " + OsReleaseFile)
-	osr, err := ioutil.ReadFile(OsReleaseFile)
+	logrus.Debug("reading current OS version + board from " + osReleasePath)
+	osr, err := ioutil.ReadFile(osReleasePath)
 	if err != nil {
 		return "", "", errors.Wrap(err, "could not read os-release file")
 	}
@@ -89,9 +173,9 @@ func coreosBoardFallback() string {
 // without changing anything.
 func (a *App) GetNextOSVersion() error {
 	logrus.Debug("Requesting next OS version")
-	ue, err := updateengine.New()
+	ue, err := a.connectUpdateEngine()
 	if err != nil {
-		return errors.Wrapf(err, "failed to connect to update-engine")
+		return err
 	}
 	defer ue.Close()
 
@@ -103,100 +187,213 @@ func (a *App) GetNextOSVersion() error {
 	if status.CurrentOperation == updateengine.UpdateStatusUpdatedNeedReboot {
 		logrus.Infof("Next OS version is %s", status.NewVersion)
 		a.NextOSVersion = status.NewVersion
-	} else {
-		logrus.Debugf("update_engine status is %s, cannot determine next version", status.CurrentOperation)
+		a.NextOSVersionSource = NextOSVersionUpdateEngine
+		return nil
+	}
+	logrus.Debugf("update_engine status is %s, cannot determine next version", status.CurrentOperation)
+
+	if a.Conf.OmahaLookup {
+		a.lookupNextOSVersion()
 	}
 	return nil
 }
 
+// lookupNextOSVersion sets the next OS version to the one the update
+// server would offer, if newer. This is best-effort, failures are only
+// logged.
+func (a *App) lookupNextOSVersion() {
+	version, err := a.OmahaNextVersion()
+	if err != nil {
+		logrus.Warnf("Failed to look up next OS version: %s", err)
+		return
+	}
+	if version == "" {
+		logrus.Debug("Update server has no update")
+		return
+	}
+
+	next, err := parseLooseVersion(version)
+	if err != nil {
+		logrus.Warnf("Ignoring next OS version from update server: %s", err)
+		return
+	}
+	if current, err := parseLooseVersion(a.CurrentOSVersion); err == nil && !current.LessThan(*next) {
+		logrus.Debugf("Ignoring OS version %s offered by update server, not newer than %s", version, a.CurrentOSVersion)
+		return
+	}
+	logrus.Infof("Next OS version is %s, as offered by the update server", version)
+	a.NextOSVersion = version
+	a.NextOSVersionSource = NextOSVersionOmaha
+}
+
 // OSUpdate triggers the update engine to update and waits
 // for it to finish
 func (a *App) OSUpdate() error {
+	if a.dryRun(ActionOSUpdate, "update_engine", "a reboot follows if an update is found") {
+		// Still report an already staged update, if any
+		return a.GetNextOSVersion()
+	}
+
 	logrus.Infof("Updating node OS")
-	var err error
+	rep := a.newOSUpdateReporter()
 
-	// Connect to ue dbus api
-	ue, err := updateengine.New()
+	ue, err := a.connectUpdateEngine()
 	if err != nil {
-		return errors.Wrap(err, "Failed to connect to update-engine")
+		return a.osUpdateFailed(rep, err)
 	}
 	defer ue.Close()
 
+	return a.updateOS(ue, rep)
+}
+
+// updateOS triggers an update and waits for it to finish, applying the
+// failure policy if it does not.
+func (a *App) updateOS(ue UpdateEngine, rep *osUpdateReporter) error {
 	logrus.Info("Triggering OS update")
 	// Trigger check for update. This is non-blocking
 	if err := ue.AttemptUpdate(); err != nil {
-		return errors.Wrap(err, "failed to trigger update")
+		return a.osUpdateFailed(rep, errors.Wrap(err, "failed to trigger update"))
 	}
 
 	logrus.Debug("Waiting for update to finish")
-	if err := a.waitForUpdate(ue); err != nil {
-		return errors.Wrap(err, "failed to wait for update to complete")
+	if err := a.waitForUpdate(ue, rep); err != nil {
+		return a.osUpdateFailed(rep, errors.Wrap(err, "failed to wait for update to complete"))
 	}
 
+	if a.OSRequiresReboot {
+		rep.finish(OSUpdateUpdated, nil)
+	} else {
+		rep.finish(OSUpdateUpToDate, nil)
+	}
 	return nil
 }
 
-// waitForUpdate watches the status channel and waits until
-// it seems complete.
-func (a *App) waitForUpdate(ue *updateengine.Client) error {
-	statusCh = make(chan updateengine.Status, 10)
+// osUpdateFailed reports a failed update and returns err, unless the
+// failure policy is to continue without an OS update.
+func (a *App) osUpdateFailed(rep *osUpdateReporter, err error) error {
+	rep.finish(OSUpdateFailed, err)
+	if a.Conf.OSUpdateFailurePolicy == OSUpdateContinue {
+		logrus.Warnf("Continuing without OS update: %s", err)
+		return nil
+	}
+	return err
+}
+
+// waitForUpdate watches the status channel and waits until the update
+// is complete, or there is none. Error events are retried up to
+// Conf.OSUpdateRetries times. It fails if the update takes longer than
+// Conf.OSUpdateTimeout overall, or if update_engine stays in the same
+// state without progress for Conf.OSUpdateStallTimeout. Statuses are
+// passed on to rep.
+func (a *App) waitForUpdate(ue UpdateEngine, rep *osUpdateReporter) error {
+	statusCh := make(chan updateengine.Status, 10)
 	stopCh := make(chan struct{})
 	var wg sync.WaitGroup
 
+	wg.Add(1)
 	go func() {
-		// use a waitgroup to fix a fun race condition where both
-		// stopch and the client are closed, causing a panic
-		wg.Add(1)
+		defer wg.Done()
 		ue.ReceiveStatuses(statusCh, stopCh)
-		wg.Done()
 	}()
-
-	// Manually send the current status on the channel as a "start" marker
-	firstStatus, err := ue.GetStatus()
-	if err != nil {
+	defer func() {
 		close(stopCh)
-		return errors.Wrap(err, "failed to get status")
-	}
-
-	firstStatus.NewSize = -1 // hack
-	statusCh <- firstStatus
+		// The receiver may be blocked sending a status, drain the
+		// channel until it returns
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for {
+			select {
+			case <-statusCh:
+			case <-done:
+				return
+			}
+		}
+	}()
 
-	flushed := false
-loop:
-	for status := range statusCh {
+	var deadline <-chan time.Time
+	if a.Conf.OSUpdateTimeout > 0 {
+		t := time.NewTimer(a.Conf.OSUpdateTimeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	var stall <-chan time.Time
+	var stallTimer *time.Timer
+	if a.Conf.OSUpdateStallTimeout > 0 {
+		stallTimer = time.NewTimer(a.Conf.OSUpdateStallTimeout)
+		defer stallTimer.Stop()
+		stall = stallTimer.C
+	}
 
-		// The updateengine client starts queueing statuses as soon as
-		// the connection is opened. Flush the channel until our manual
-		// status is received. This is so we ignore any old errors.
-		if !flushed && status.NewSize != -1 {
-			flushed = true
-			continue
+	// Statuses queued before the update was triggered may be stale, so an
+	// idle update_engine only means there is no update once it started
+	// checking.
+	started, errored := false, false
+	retries := 0
+	last := updateengine.Status{}
+	for {
+		var status updateengine.Status
+		select {
+		case status = <-statusCh:
+		case <-deadline:
+			return errors.Errorf("timed out after %s, update_engine status is %s", a.Conf.OSUpdateTimeout, last.CurrentOperation)
+		case <-stall:
+			return errors.Errorf("update_engine stalled in %s for %s", last.CurrentOperation, a.Conf.OSUpdateStallTimeout)
 		}
 
+		// Any change of state or progress resets the stall timer
+		if stallTimer != nil && (status.CurrentOperation != last.CurrentOperation || status.Progress != last.Progress) {
+			if !stallTimer.Stop() {
+				<-stallTimer.C
+			}
+			stallTimer.Reset(a.Conf.OSUpdateStallTimeout)
+		}
+		last = status
 		logrus.Debug("current status: ", status.CurrentOperation, " ", status.NewVersion)
+		rep.update(status, retries+1)
 
 		switch status.CurrentOperation {
 		case updateengine.UpdateStatusCheckingForUpdate, updateengine.UpdateStatusUpdateAvailable, updateengine.UpdateStatusDownloading, updateengine.UpdateStatusVerifying, updateengine.UpdateStatusFinalizing:
 			// pass; update still in progress
+			started = true
 
 		case updateengine.UpdateStatusUpdatedNeedReboot:
 			// Update complete, reboot time
 			logrus.Info("Update successful! Next version is ", status.NewVersion)
 			a.NextOSVersion = status.NewVersion
 			a.OSRequiresReboot = true
-			break loop
+			return nil
 
 		case updateengine.UpdateStatusIdle:
+			if errored {
+				// update_engine is done reporting the error
+				if retries >= a.Conf.OSUpdateRetries {
+					return errors.Errorf("update failed after %d attempt(s)", retries+1)
+				}
+				retries++
+				logrus.Warnf("Update failed, retrying (%d/%d)", retries, a.Conf.OSUpdateRetries)
+				time.Sleep(osUpdateRetryPause)
+				if err := ue.AttemptUpdate(); err != nil {
+					return errors.Wrap(err, "failed to trigger update")
+				}
+				started, errored = false, false
+				continue
+			}
+			if !started {
+				logrus.Debug("Ignoring idle status from before the update check")
+				continue
+			}
 			// already up to date, no reboot needed
 			logrus.Info("No update available")
-			break loop
+			return nil
 
 		case updateengine.UpdateStatusReportingErrorEvent:
-			// TODO: determine if we care about errors
+			if started {
+				logrus.Warn("update_engine reported an error")
+				errored = true
+			}
 		}
 	}
-
-	close(stopCh)
-	wg.Wait()
-	return nil
 }
@@ -0,0 +1,221 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/godbus/dbus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBus is a private dbus-daemon, standing in for the system bus
+type testBus struct {
+	cmd     *exec.Cmd
+	dir     string
+	address string
+}
+
+// startTestBus starts a private message bus, and points clients of the
+// system bus to it until stopped. The test is skipped if dbus-daemon is
+// not available.
+func startTestBus(t *testing.T) *testBus {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found, skipping D-Bus tests")
+	}
+	dir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &testBus{dir: dir}
+	b.cmd = exec.Command(daemon, "--session", "--nofork", "--print-address", "--address=unix:path="+filepath.Join(dir, "bus"))
+	stdout, err := b.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("failed to start dbus-daemon: %s", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		b.stop()
+		t.Fatalf("failed to read bus address: %s", err)
+	}
+	b.address = strings.TrimSpace(line)
+	os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", b.address)
+	return b
+}
+
+func (b *testBus) stop() {
+	os.Unsetenv("DBUS_SYSTEM_BUS_ADDRESS")
+	b.cmd.Process.Kill()
+	b.cmd.Wait()
+	os.RemoveAll(b.dir)
+}
+
+// fakeUpdateEngineService serves com.coreos.update1 on a bus. Each
+// triggered update replays the next script as StatusUpdate signals.
+type fakeUpdateEngineService struct {
+	conn *dbus.Conn
+
+	mu       sync.Mutex
+	current  updateengine.Status
+	scripts  [][]updateengine.Status
+	attempts int
+}
+
+func newFakeUpdateEngineService(t *testing.T, address, current string, scripts ...[]updateengine.Status) *fakeUpdateEngineService {
+	conn, err := dbus.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Auth([]dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+
+	s := &fakeUpdateEngineService{
+		conn:    conn,
+		current: ueStatus(current),
+		scripts: scripts,
+	}
+	if err := conn.Export(s, "/com/coreos/update1", "com.coreos.update1.Manager"); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName("com.coreos.update1", dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		t.Fatalf("failed to own com.coreos.update1: %v", err)
+	}
+	return s
+}
+
+func (s *fakeUpdateEngineService) GetStatus() (int64, float64, string, string, int64, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.current
+	return st.LastCheckedTime, st.Progress, st.CurrentOperation, st.NewVersion, st.NewSize, nil
+}
+
+func (s *fakeUpdateEngineService) AttemptUpdate() *dbus.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts < len(s.scripts) {
+		go s.replay(s.scripts[s.attempts])
+	}
+	s.attempts++
+	return nil
+}
+
+func (s *fakeUpdateEngineService) ResetStatus() *dbus.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = ueStatus(updateengine.UpdateStatusIdle)
+	return nil
+}
+
+func (s *fakeUpdateEngineService) replay(script []updateengine.Status) {
+	for _, st := range script {
+		time.Sleep(time.Millisecond)
+		s.mu.Lock()
+		s.current = st
+		s.mu.Unlock()
+		s.conn.Emit("/com/coreos/update1", "com.coreos.update1.Manager.StatusUpdate",
+			st.LastCheckedTime, st.Progress, st.CurrentOperation, st.NewVersion, st.NewSize)
+	}
+}
+
+func TestUpdateEngineDBus(t *testing.T) {
+	assert := assert.New(t)
+	pause := osUpdateRetryPause
+	osUpdateRetryPause = 0
+	defer func() { osUpdateRetryPause = pause }()
+
+	bus := startTestBus(t)
+	defer bus.stop()
+
+	checking := ueStatus(updateengine.UpdateStatusCheckingForUpdate)
+	updated := ueStatus(updateengine.UpdateStatusUpdatedNeedReboot)
+	updated.NewVersion = "1520.6.0"
+	failure := []updateengine.Status{
+		checking,
+		ueStatus(updateengine.UpdateStatusReportingErrorEvent),
+		ueStatus(updateengine.UpdateStatusIdle),
+	}
+	update := []updateengine.Status{
+		checking,
+		ueStatus(updateengine.UpdateStatusUpdateAvailable),
+		ueStatus(updateengine.UpdateStatusDownloading),
+		ueStatus(updateengine.UpdateStatusVerifying),
+		ueStatus(updateengine.UpdateStatusFinalizing),
+		updated,
+	}
+	svc := newFakeUpdateEngineService(t, bus.address, updateengine.UpdateStatusIdle, failure, update)
+	defer svc.conn.Close()
+
+	newApp := func() *App {
+		a, err := NewApp(Config{
+			SkipTorcxSetup:       true,
+			OSUpdateTimeout:      10 * time.Second,
+			OSUpdateStallTimeout: 5 * time.Second,
+			OSUpdateRetries:      1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	// Hook, nothing staged yet
+	a := newApp()
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("", a.NextOSVersion)
+
+	// Bootstrap OS upgrade, after an error
+	a = newApp()
+	assert.Nil(a.OSUpdate())
+	assert.Equal("1520.6.0", a.NextOSVersion)
+	assert.True(a.OSRequiresReboot)
+	assert.Equal(2, svc.attempts)
+
+	// Hook, with the update staged
+	a = newApp()
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("1520.6.0", a.NextOSVersion)
+
+	// Hook, abandoning the staged update
+	assert.Nil(a.ResetOSUpdate())
+	a = newApp()
+	assert.Nil(a.GetNextOSVersion())
+	assert.Equal("", a.NextOSVersion)
+}
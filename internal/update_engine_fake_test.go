@@ -0,0 +1,112 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+)
+
+// fakeUpdateEngine is an in-process UpdateEngine replaying scripted
+// statuses. Each triggered update replays the next script, if any.
+// Statuses queued at creation are received first, like D-Bus signals
+// emitted before an update is triggered.
+type fakeUpdateEngine struct {
+	mu      sync.Mutex
+	current updateengine.Status
+	scripts [][]updateengine.Status
+	// Number of triggered updates
+	attempts int
+	// Number of reset staged updates
+	resets int
+	// Pause before each scripted status
+	interval time.Duration
+
+	signals chan updateengine.Status
+}
+
+func newFakeUpdateEngine(current string, queued []updateengine.Status, scripts ...[]updateengine.Status) *fakeUpdateEngine {
+	f := &fakeUpdateEngine{
+		current:  ueStatus(current),
+		scripts:  scripts,
+		interval: time.Millisecond,
+		signals:  make(chan updateengine.Status, 100),
+	}
+	for _, s := range queued {
+		f.signals <- s
+	}
+	return f
+}
+
+// ueStatus returns an update_engine status for an operation
+func ueStatus(op string) updateengine.Status {
+	return updateengine.Status{CurrentOperation: op}
+}
+
+func (f *fakeUpdateEngine) GetStatus() (updateengine.Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current, nil
+}
+
+func (f *fakeUpdateEngine) AttemptUpdate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.attempts < len(f.scripts) {
+		go f.replay(f.scripts[f.attempts])
+	}
+	f.attempts++
+	return nil
+}
+
+func (f *fakeUpdateEngine) replay(script []updateengine.Status) {
+	for _, s := range script {
+		time.Sleep(f.interval)
+		f.mu.Lock()
+		f.current = s
+		f.mu.Unlock()
+		f.signals <- s
+	}
+}
+
+func (f *fakeUpdateEngine) ResetStatus() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.current = ueStatus(updateengine.UpdateStatusIdle)
+	f.resets++
+	return nil
+}
+
+func (f *fakeUpdateEngine) Close() error {
+	return nil
+}
+
+// ReceiveStatuses behaves like the D-Bus client: it sends the current
+// status, then signals until stopped.
+func (f *fakeUpdateEngine) ReceiveStatuses(rcvr chan updateengine.Status, stop <-chan struct{}) {
+	st, _ := f.GetStatus()
+	rcvr <- st
+
+	for {
+		select {
+		case <-stop:
+			return
+		case s := <-f.signals:
+			rcvr <- s
+		}
+	}
+}
@@ -16,7 +16,9 @@ package internal
 
 import (
 	"testing"
+	"time"
 
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,3 +38,95 @@ COREOS_BOARD="amd64-usr"`
 	assert.Equal("1662.0.0", parseOSRelease(inp, "VERSION_ID"))
 	assert.Equal("amd64-usr", parseOSRelease(inp, "COREOS_BOARD"))
 }
+
+func TestWaitForUpdate(t *testing.T) {
+	assert := assert.New(t)
+	pause := osUpdateRetryPause
+	osUpdateRetryPause = 0
+	defer func() { osUpdateRetryPause = pause }()
+
+	checking := ueStatus(updateengine.UpdateStatusCheckingForUpdate)
+	idle := ueStatus(updateengine.UpdateStatusIdle)
+	failed := ueStatus(updateengine.UpdateStatusReportingErrorEvent)
+	updated := ueStatus(updateengine.UpdateStatusUpdatedNeedReboot)
+	updated.NewVersion = "1520.6.0"
+	downloading := func(progress float64) updateengine.Status {
+		s := ueStatus(updateengine.UpdateStatusDownloading)
+		s.Progress = progress
+		return s
+	}
+	update := []updateengine.Status{
+		checking,
+		ueStatus(updateengine.UpdateStatusUpdateAvailable),
+		downloading(0.5),
+		downloading(1),
+		ueStatus(updateengine.UpdateStatusVerifying),
+		ueStatus(updateengine.UpdateStatusFinalizing),
+		updated,
+	}
+	failure := []updateengine.Status{checking, failed, idle}
+
+	run := func(c Config, ue *fakeUpdateEngine) (*App, error) {
+		if c.OSUpdateTimeout == 0 {
+			c.OSUpdateTimeout = 5 * time.Second
+		}
+		c.updateEngine = ue
+		a := &App{Conf: c}
+		return a, a.OSUpdate()
+	}
+
+	// Stale idle and error statuses are ignored
+	ue := newFakeUpdateEngine(updateengine.UpdateStatusIdle, []updateengine.Status{failed, idle}, update)
+	a, err := run(Config{}, ue)
+	assert.Nil(err)
+	assert.Equal("1520.6.0", a.NextOSVersion)
+	assert.True(a.OSRequiresReboot)
+
+	// No update available
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, []updateengine.Status{idle}, []updateengine.Status{checking, idle})
+	a, err = run(Config{}, ue)
+	assert.Nil(err)
+	assert.Equal("", a.NextOSVersion)
+	assert.False(a.OSRequiresReboot)
+
+	// Update already staged
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusUpdatedNeedReboot, nil)
+	a, err = run(Config{}, ue)
+	assert.Nil(err)
+	assert.True(a.OSRequiresReboot)
+
+	// Errors are retried
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, failure, update)
+	a, err = run(Config{OSUpdateRetries: 1}, ue)
+	assert.Nil(err)
+	assert.True(a.OSRequiresReboot)
+	assert.Equal(2, ue.attempts)
+
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, failure, failure, update)
+	_, err = run(Config{OSUpdateRetries: 1}, ue)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "update failed after 2 attempt(s)")
+	assert.Equal(2, ue.attempts)
+
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, failure)
+	a, err = run(Config{OSUpdateFailurePolicy: OSUpdateContinue}, ue)
+	assert.Nil(err)
+	assert.False(a.OSRequiresReboot)
+
+	// Stalled in a phase
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, []updateengine.Status{checking, downloading(0.1)})
+	_, err = run(Config{OSUpdateStallTimeout: 50 * time.Millisecond}, ue)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "stalled in UPDATE_STATUS_DOWNLOADING")
+
+	// Progress resets stall detection, until the overall timeout
+	slow := []updateengine.Status{checking}
+	for i := 1; i <= 100; i++ {
+		slow = append(slow, downloading(float64(i)/100))
+	}
+	ue = newFakeUpdateEngine(updateengine.UpdateStatusIdle, nil, slow)
+	ue.interval = 10 * time.Millisecond
+	_, err = run(Config{OSUpdateTimeout: 200 * time.Millisecond, OSUpdateStallTimeout: 50 * time.Millisecond}, ue)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "timed out")
+}
@@ -0,0 +1,268 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/container-linux-update-operator/pkg/k8sutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// OSUpdateBlockedAnnotation is the node annotation recording, as JSON, why
+// the staged OS update is blocked; empty if it is not.
+const OSUpdateBlockedAnnotation = "tectonic-torcx.coreos.com/os-update-blocked"
+
+// ErrOSUpdateBlocked is returned when the staged OS update is blocked by
+// the pre-reboot gate.
+var ErrOSUpdateBlocked = errors.New("OS update blocked")
+
+// OSCompatibility reports whether a version of every runtime component is
+// available for an OS version.
+type OSCompatibility struct {
+	CurrentOSVersion string                   `json:"currentOSVersion"`
+	OSVersion        string                   `json:"osVersion"`
+	K8sVersion       string                   `json:"k8sVersion"`
+	Components       []ComponentCompatibility `json:"components"`
+	// Whether the staged update was reset, when blocked
+	Reset bool   `json:"reset,omitempty"`
+	Time  string `json:"time"`
+}
+
+// ComponentCompatibility is the version of a runtime component which would
+// be installed for an OS version, or the reason why there is none.
+type ComponentCompatibility struct {
+	Name      string   `json:"name"`
+	Preferred []string `json:"preferred"`
+	Version   string   `json:"version,omitempty"`
+	// The fallback policy which picked Version, if not preferred
+	Fallback string `json:"fallback,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Blocked returns true if a runtime component has no suitable version
+func (c *OSCompatibility) Blocked() bool {
+	for _, cc := range c.Components {
+		if cc.Version == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the report in a human-readable form
+func (c *OSCompatibility) String() string {
+	if c.OSVersion == "" {
+		return "No OS update staged.\n"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "OS version %s (from %s), Kubernetes %s:\n", c.OSVersion, c.CurrentOSVersion, c.K8sVersion)
+	for _, cc := range c.Components {
+		switch {
+		case cc.Version == "":
+			fmt.Fprintf(&buf, "  %s: BLOCKED, %s\n", cc.Name, cc.Reason)
+		case cc.Fallback != "":
+			fmt.Fprintf(&buf, "  %s: %s (fallback %s)\n", cc.Name, cc.Version, cc.Fallback)
+		default:
+			fmt.Fprintf(&buf, "  %s: %s\n", cc.Name, cc.Version)
+		}
+	}
+	if c.Blocked() {
+		buf.WriteString("OS update is blocked.\n")
+	}
+	return buf.String()
+}
+
+// CheckOSCompatibility determines, for each runtime component, the version
+// which would be installed for osVersion, like PickVersion does.
+func (a *App) CheckOSCompatibility(osVersion string) (*OSCompatibility, error) {
+	c := &OSCompatibility{
+		CurrentOSVersion: a.CurrentOSVersion,
+		OSVersion:        osVersion,
+		K8sVersion:       a.K8sVersion,
+		Components:       []ComponentCompatibility{},
+		Time:             time.Now().UTC().Format(time.RFC3339),
+	}
+	// Without torcx, the OS only ships its own runtime
+	if osVersion == "" || shouldSkip(MinimumRemoteDocker, osVersion) {
+		return c, nil
+	}
+
+	pm, err := a.GetPackageManifest(osVersion)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get package manifest for %s", osVersion)
+	}
+	// Fallbacks are recorded on a copy, as this is only a check
+	check := *a
+	check.Fallbacks = nil
+	for _, name := range a.componentNames() {
+		prefs := a.RuntimeVersions[name]
+		cc := ComponentCompatibility{Name: name, Preferred: prefs}
+		for _, v := range prefs {
+			if version := pm.resolveVersion(name, v); version != "" {
+				cc.Version = version
+				break
+			}
+		}
+		if cc.Version == "" {
+			if version := check.fallbackVersion(pm, name, prefs, osVersion); version != "" {
+				cc.Version = version
+				cc.Fallback = a.Conf.VersionFallback
+			} else {
+				policy := a.Conf.VersionFallback
+				if policy == "" {
+					policy = FallbackFail
+				}
+				cc.Reason = fmt.Sprintf("none of the preferred versions %v is available, with fallback policy %s", prefs, policy)
+			}
+		}
+		c.Components = append(c.Components, cc)
+	}
+	return c, nil
+}
+
+// CheckNextOS determines the node state like the pre-reboot hook does, and
+// checks compatibility with osVersion, or the next OS version if empty.
+func (a *App) CheckNextOS(osVersion string) (*OSCompatibility, error) {
+	if err := a.GatherState(true, kubeletEnvPath); err != nil {
+		return nil, err
+	}
+	if osVersion == "" {
+		if err := a.GetNextOSVersion(); err != nil {
+			return nil, err
+		}
+		osVersion = a.NextOSVersion
+	}
+	return a.CheckOSCompatibility(osVersion)
+}
+
+// GateOSUpdate blocks the staged OS update if a runtime component has no
+// suitable version for it: the reason is recorded in a node annotation,
+// the staged update is reset if configured to, and ErrOSUpdateBlocked is
+// returned so that the completion annotation is not written and the node
+// is not rebooted. Otherwise, a previous block is cleared. Versions only
+// offered by the update server (see OmahaNextVersion) are not staged, so
+// they are not gated.
+func (a *App) GateOSUpdate() error {
+	if a.NextOSVersion == "" || a.NextOSVersionSource != NextOSVersionUpdateEngine {
+		a.clearBlockedAnnotation()
+		return nil
+	}
+	c, err := a.CheckOSCompatibility(a.NextOSVersion)
+	if err != nil {
+		return err
+	}
+	if !c.Blocked() {
+		logrus.Infof("Runtime components are available for OS version %s", a.NextOSVersion)
+		a.clearBlockedAnnotation()
+		return nil
+	}
+
+	for _, cc := range c.Components {
+		if cc.Version == "" {
+			logrus.Errorf("No %s version for OS version %s: %s", cc.Name, a.NextOSVersion, cc.Reason)
+		}
+	}
+	if a.Conf.GateResetUpdate {
+		if err := a.ResetOSUpdate(); err != nil {
+			logrus.Warnf("Failed to reset OS update: %s", err)
+		} else {
+			c.Reset = true
+		}
+	}
+	if a.Conf.NodeName == "" {
+		logrus.Warn("No node name, not recording blocked OS update")
+	} else if err := a.writeBlockedAnnotation(c); err != nil {
+		logrus.Warnf("Failed to record blocked OS update: %s", err)
+	}
+	return errors.Wrapf(ErrOSUpdateBlocked, "no compatible runtime for OS version %s", a.NextOSVersion)
+}
+
+// ResetOSUpdate asks update_engine to abandon the staged update, so that
+// the node boots the current OS version again.
+func (a *App) ResetOSUpdate() error {
+	if a.dryRun(ActionResetOSUpdate, "update_engine", a.NextOSVersion) {
+		return nil
+	}
+
+	logrus.Warnf("Resetting staged OS update to %s", a.NextOSVersion)
+	ue, err := a.connectUpdateEngine()
+	if err != nil {
+		return err
+	}
+	defer ue.Close()
+
+	if err := ue.ResetStatus(); err != nil {
+		return errors.Wrap(err, "failed to reset update-engine status")
+	}
+	return nil
+}
+
+// clearBlockedAnnotation removes the record of a previously blocked OS
+// update from the node, if any.
+func (a *App) clearBlockedAnnotation() {
+	if a.Conf.NodeName == "" {
+		return
+	}
+	if err := a.writeBlockedAnnotation(nil); err != nil {
+		logrus.Warnf("Failed to clear blocked OS update: %s", err)
+	}
+}
+
+// writeBlockedAnnotation records a blocked OS update on the node, or
+// removes the record if c is nil.
+func (a *App) writeBlockedAnnotation(c *OSCompatibility) error {
+	detail := "delete " + OSUpdateBlockedAnnotation
+	var data []byte
+	if c != nil {
+		var err error
+		if data, err = json.Marshal(c); err != nil {
+			return err
+		}
+		detail = fmt.Sprintf("%s=%s", OSUpdateBlockedAnnotation, data)
+	}
+	if a.dryRun(ActionNodeAnnotation, a.Conf.NodeName, detail) {
+		return nil
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to build kubeconfig")
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to build kube client")
+	}
+
+	nodes := client.CoreV1().Nodes()
+	err = retry(3, 10, func() error {
+		if c == nil {
+			return k8sutil.DeleteNodeAnnotations(nodes, a.Conf.NodeName, []string{OSUpdateBlockedAnnotation})
+		}
+		return k8sutil.SetNodeAnnotations(nodes, a.Conf.NodeName, map[string]string{OSUpdateBlockedAnnotation: string(data)})
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to set node annotation")
+	}
+	return nil
+}
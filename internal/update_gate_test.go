@@ -0,0 +1,135 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/coreos/container-linux-update-operator/pkg/updateengine"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOSCompatibility(t *testing.T) {
+	assert := assert.New(t)
+
+	newApp := func(policy string) *App {
+		return &App{
+			Conf: Config{VersionFallback: policy},
+			packageManifestCache: map[string]*PackageManifest{
+				"9998.0.0": makeManifest([]string{"1.12", "17.03"}),
+				"9999.0.0": makeManifest([]string{"17.09"}),
+			},
+			CurrentOSVersion: "9998.0.0",
+			K8sVersion:       "1.8.2",
+			RuntimeVersions:  map[string][]string{"docker": {"17.03", "1.12"}},
+		}
+	}
+
+	a := newApp("")
+	c, err := a.CheckOSCompatibility("9998.0.0")
+	assert.Nil(err)
+	assert.False(c.Blocked())
+	assert.Equal([]ComponentCompatibility{{Name: "docker", Preferred: []string{"17.03", "1.12"}, Version: "17.03"}}, c.Components)
+
+	c, err = a.CheckOSCompatibility("9999.0.0")
+	assert.Nil(err)
+	assert.True(c.Blocked())
+	assert.Equal("", c.Components[0].Version)
+	assert.Contains(c.Components[0].Reason, "fallback policy fail")
+	assert.Contains(c.String(), "docker: BLOCKED")
+
+	// Fallbacks are compatible
+	a = newApp(FallbackNewest)
+	c, err = a.CheckOSCompatibility("9999.0.0")
+	assert.Nil(err)
+	assert.False(c.Blocked())
+	assert.Equal("17.09", c.Components[0].Version)
+	assert.Equal(FallbackNewest, c.Components[0].Fallback)
+	// Checking doesn't record fallbacks in the App
+	assert.Nil(a.Fallbacks)
+
+	// Nothing to check without torcx, or without an update
+	c, err = a.CheckOSCompatibility("1400.0.0")
+	assert.Nil(err)
+	assert.False(c.Blocked())
+	assert.Empty(c.Components)
+	c, err = a.CheckOSCompatibility("")
+	assert.Nil(err)
+	assert.Equal("No OS update staged.\n", c.String())
+}
+
+func TestGateOSUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	ue := newFakeUpdateEngine(updateengine.UpdateStatusUpdatedNeedReboot, nil)
+	a := &App{
+		Conf: Config{
+			DryRun:          true,
+			NodeName:        "node1",
+			GateResetUpdate: true,
+			updateEngine:    ue,
+		},
+		packageManifestCache: map[string]*PackageManifest{
+			"9999.0.0": makeManifest([]string{"17.09"}),
+		},
+		CurrentOSVersion:    "9998.0.0",
+		NextOSVersion:       "9999.0.0",
+		NextOSVersionSource: NextOSVersionUpdateEngine,
+		RuntimeVersions:     map[string][]string{"docker": {"17.03"}},
+	}
+
+	// Dry-run: nothing is reset, the annotation is only planned
+	err := a.GateOSUpdate()
+	assert.Equal(ErrOSUpdateBlocked, errors.Cause(err))
+	assert.Equal(0, ue.resets)
+	assert.Equal(ActionResetOSUpdate, a.Plan.Steps[0].Action)
+	assert.Equal(ActionNodeAnnotation, a.Plan.Steps[1].Action)
+	detail := strings.TrimPrefix(a.Plan.Steps[1].Detail, OSUpdateBlockedAnnotation+"=")
+	c := OSCompatibility{}
+	assert.Nil(json.Unmarshal([]byte(detail), &c))
+	assert.Equal("9999.0.0", c.OSVersion)
+	assert.True(c.Reset)
+	assert.True(c.Blocked())
+
+	// The staged update is reset, the annotation fails without a kubeconfig
+	a.Conf.DryRun = false
+	a.Conf.Kubeconfig = "/nonexistent"
+	assert.Equal(ErrOSUpdateBlocked, errors.Cause(a.GateOSUpdate()))
+	assert.Equal(1, ue.resets)
+	st, _ := ue.GetStatus()
+	assert.Equal(updateengine.UpdateStatusIdle, st.CurrentOperation)
+
+	// Compatible, or no update staged: the block is cleared
+	a.Conf.DryRun = true
+	a.Plan.Steps = nil
+	a.RuntimeVersions["docker"] = []string{"17.09"}
+	assert.Nil(a.GateOSUpdate())
+	a.RuntimeVersions["docker"] = []string{"17.03"}
+	// Only offered by the update server, nothing to reset
+	a.Conf.DryRun = false
+	a.NextOSVersionSource = NextOSVersionOmaha
+	assert.Nil(a.GateOSUpdate())
+	a.Conf.DryRun = true
+	a.NextOSVersion = ""
+	assert.Nil(a.GateOSUpdate())
+	assert.Equal(1, ue.resets)
+	assert.Equal(2, len(a.Plan.Steps))
+	for _, s := range a.Plan.Steps {
+		assert.Equal(PlanStep{Action: ActionNodeAnnotation, Target: "node1", Detail: "delete " + OSUpdateBlockedAnnotation}, s)
+	}
+}
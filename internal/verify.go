@@ -0,0 +1,247 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Results of a store entry verification
+const (
+	VerifyOK       = "ok"
+	VerifyMismatch = "mismatch"
+	VerifyMissing  = "missing"
+	VerifyUnknown  = "unknown"
+	VerifyRepaired = "repaired"
+)
+
+// StoreCheck is the verification result for a single image
+// referenced by a profile, for a given OS version.
+type StoreCheck struct {
+	OSVersion string `json:"osVersion"`
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Path      string `json:"path,omitempty"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// VerifyReport collects the results of a store verification
+type VerifyReport struct {
+	Profiles []string     `json:"profiles"`
+	Checks   []StoreCheck `json:"checks"`
+}
+
+// Failed returns true if some entries are still corrupted or missing
+func (r *VerifyReport) Failed() bool {
+	for _, c := range r.Checks {
+		if c.Result == VerifyMismatch || c.Result == VerifyMissing {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify determines the OS versions on this node, then verifies the
+// torcx stores for them. See VerifyStore.
+func (a *App) Verify(repair bool) (*VerifyReport, error) {
+	var err error
+	a.CurrentOSVersion, a.Board, err = GetCurrentOSInfo()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.GetNextOSVersion(); err != nil {
+		return nil, err
+	}
+
+	return a.VerifyStore(repair)
+}
+
+// VerifyStore hashes every user store entry referenced by the active and
+// next torcx profiles, in the versioned stores of the current and next OS
+// versions, against the signed package manifest of that OS version. If repair is true, mismatching and missing
+// entries are fetched again. An error is returned if any entry is still
+// corrupted or missing at the end.
+func (a *App) VerifyStore(repair bool) (*VerifyReport, error) {
+	report := VerifyReport{
+		Profiles: []string{},
+		Checks:   []StoreCheck{},
+	}
+
+	pl, err := a.torcx.ProfileList()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list torcx profiles")
+	}
+	if pl.UserProfileName != nil {
+		report.Profiles = append(report.Profiles, *pl.UserProfileName)
+	}
+	if pl.NextProfileName != nil && (pl.UserProfileName == nil || *pl.NextProfileName != *pl.UserProfileName) {
+		report.Profiles = append(report.Profiles, *pl.NextProfileName)
+	}
+
+	images := []ImageEntry{}
+	seen := map[string]bool{}
+	for _, profile := range report.Profiles {
+		pImages, err := a.torcx.ProfileImages(profile)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range pImages {
+			key := img.Name + ":" + img.Reference
+			if !seen[key] {
+				seen[key] = true
+				images = append(images, img)
+			}
+		}
+	}
+
+	for _, osVersion := range []string{a.CurrentOSVersion, a.NextOSVersion} {
+		if osVersion == "" || shouldSkip(MinimumRemoteDocker, osVersion) {
+			continue
+		}
+		manif, err := a.GetPackageManifest(osVersion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get package manifest for %s", osVersion)
+		}
+
+		for _, img := range images {
+			check := a.verifyImage(manif, osVersion, img)
+			if repair && (check.Result == VerifyMismatch || check.Result == VerifyMissing) {
+				if err := a.repairImage(manif, osVersion, img, check.Path); err != nil {
+					check.Error = err.Error()
+				} else {
+					check.Result = VerifyRepaired
+					check.Error = ""
+				}
+			}
+
+			switch check.Result {
+			case VerifyMismatch, VerifyMissing:
+				logrus.Errorf("Store entry %s:%s for OS version %s is %s", img.Name, img.Reference, osVersion, check.Result)
+			case VerifyUnknown:
+				logrus.Warnf("Store entry %s:%s for OS version %s cannot be verified: %s", img.Name, img.Reference, osVersion, check.Error)
+			default:
+				logrus.Infof("Store entry %s:%s for OS version %s is %s", img.Name, img.Reference, osVersion, check.Result)
+			}
+			report.Checks = append(report.Checks, check)
+		}
+	}
+
+	if report.Failed() {
+		return &report, errors.New("torcx store verification failed")
+	}
+	return &report, nil
+}
+
+// verifyImage checks a single profile image in the stores for an OS version
+func (a *App) verifyImage(manif *PackageManifest, osVersion string, img ImageEntry) StoreCheck {
+	check := StoreCheck{
+		OSVersion: osVersion,
+		Name:      img.Name,
+		Reference: img.Reference,
+	}
+
+	entries, err := a.torcx.ImageList(osVersion, img.Name)
+	if err != nil {
+		check.Result = VerifyUnknown
+		check.Error = err.Error()
+		return check
+	}
+
+	found := false
+	for _, e := range entries {
+		if e.Reference != img.Reference {
+			continue
+		}
+		found = true
+		// Vendor stores are on the verified, read-only /usr partition
+		if !a.inUserStore(e.Filepath) {
+			continue
+		}
+		// Only the store of this OS version is checked against its manifest
+		if filepath.Dir(e.Filepath) != filepath.Join(a.Conf.torcxStoreDir, osVersion) {
+			logrus.Debugf("%s is not in the store for OS version %s, not checking", e.Filepath, osVersion)
+			continue
+		}
+		check.Path = e.Filepath
+
+		v := manif.findVersion(img.Name, img.Reference)
+		if v == nil {
+			check.Result = VerifyUnknown
+			check.Error = "not in package manifest"
+			return check
+		}
+		ok, err := v.validateFile(e.Filepath)
+		if err != nil {
+			check.Result = VerifyUnknown
+			check.Error = err.Error()
+			return check
+		}
+		if !ok {
+			check.Result = VerifyMismatch
+			return check
+		}
+	}
+
+	if !found {
+		// Only images we know how to fetch should be there
+		if manif.findVersion(img.Name, img.Reference) == nil {
+			check.Result = VerifyUnknown
+			check.Error = "not in package manifest"
+			return check
+		}
+		check.Result = VerifyMissing
+		return check
+	}
+
+	check.Result = VerifyOK
+	return check
+}
+
+// repairImage quarantines a corrupted store entry (if any), then fetches
+// the addon again.
+func (a *App) repairImage(manif *PackageManifest, osVersion string, img ImageEntry, path string) error {
+	if path != "" {
+		if err := a.quarantine(path, osVersion); err != nil {
+			return err
+		}
+	}
+
+	loc, err := manif.LocationFor(img.Name, img.Reference)
+	if err != nil {
+		return err
+	}
+	if loc.Path != "" {
+		// Available in the vendor store, nothing to fetch
+		return nil
+	}
+
+	logrus.Infof("Fetching %s:%s again for OS version %s", img.Name, img.Reference, osVersion)
+	fetched, err := a.FetchAddon(loc)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch addon")
+	}
+	return a.copyToStore(fetched, loc.Version, osVersion)
+}
+
+// inUserStore returns true if path is within the user store
+func (a *App) inUserStore(path string) bool {
+	rel, err := filepath.Rel(a.Conf.torcxStoreDir, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
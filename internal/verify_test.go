@@ -0,0 +1,120 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyStore(t *testing.T) {
+	assert := assert.New(t)
+	storeDir, err := ioutil.TempDir("", ".torcx-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	// The same reference is built differently for each OS version
+	content := map[string][]byte{
+		"9998.0.0": []byte("docker addon for 9998\n"),
+		"9999.0.0": []byte("docker addon for 9999\n"),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content[filepath.Base(filepath.Dir(r.URL.Path))])
+	}))
+	defer ts.Close()
+
+	for ver, data := range map[string][]byte{"9999.0.0": content["9999.0.0"], "9998.0.0": []byte("tampered")} {
+		if err := os.MkdirAll(filepath.Join(storeDir, ver), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(storeDir, ver, "docker:17.03.torcx.tgz"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unversioned store entries are not checked against any OS version
+	if err := ioutil.WriteFile(filepath.Join(storeDir, "docker:17.03.torcx.tgz"), content["9999.0.0"], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := newFakeTorcx(storeDir, "9998.0.0")
+	ft.userProfiles["tectonic"] = []ImageEntry{{Name: "docker", Reference: "17.03"}}
+	ft.currentProfile = "tectonic"
+	ft.nextProfile = "tectonic"
+
+	a := App{
+		Conf:             Config{torcxStoreDir: storeDir},
+		CurrentOSVersion: "9998.0.0",
+		NextOSVersion:    "9999.0.0",
+		packageManifestCache: map[string]*PackageManifest{
+			"9998.0.0": makeRemoteManifest("17.03", ts.URL+"/9998.0.0/docker:17.03.torcx.tgz", content["9998.0.0"]),
+			"9999.0.0": makeRemoteManifest("17.03", ts.URL+"/9999.0.0/docker:17.03.torcx.tgz", content["9999.0.0"]),
+		},
+		torcx: ft,
+	}
+
+	report, err := a.VerifyStore(false)
+	assert.NotNil(err)
+	assert.Equal([]string{"tectonic"}, report.Profiles)
+	assert.Equal([]StoreCheck{
+		{
+			OSVersion: "9998.0.0",
+			Name:      "docker",
+			Reference: "17.03",
+			Path:      filepath.Join(storeDir, "9998.0.0", "docker:17.03.torcx.tgz"),
+			Result:    VerifyMismatch,
+		},
+		{
+			OSVersion: "9999.0.0",
+			Name:      "docker",
+			Reference: "17.03",
+			Path:      filepath.Join(storeDir, "9999.0.0", "docker:17.03.torcx.tgz"),
+			Result:    VerifyOK,
+		},
+	}, report.Checks)
+
+	report, err = a.VerifyStore(true)
+	assert.Nil(err)
+	assert.Equal(VerifyRepaired, report.Checks[0].Result)
+	data, err := ioutil.ReadFile(filepath.Join(storeDir, "9998.0.0", "docker:17.03.torcx.tgz"))
+	assert.Nil(err)
+	assert.Equal(content["9998.0.0"], data)
+	_, err = os.Stat(filepath.Join(storeDir, "docker:17.03.torcx.tgz"))
+	assert.Nil(err)
+
+	report, err = a.VerifyStore(false)
+	assert.Nil(err)
+	assert.False(report.Failed())
+
+	// A missing entry is fetched again
+	for _, p := range []string{filepath.Join(storeDir, "docker:17.03.torcx.tgz"), filepath.Join(storeDir, "9999.0.0", "docker:17.03.torcx.tgz")} {
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err = a.VerifyStore(false)
+	assert.NotNil(err)
+	assert.Equal(VerifyMissing, report.Checks[1].Result)
+	report, err = a.VerifyStore(true)
+	assert.Nil(err)
+	assert.Equal(VerifyRepaired, report.Checks[1].Result)
+}
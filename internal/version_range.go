@@ -0,0 +1,134 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/pkg/errors"
+)
+
+// VersionRange is a set of constraints on package versions, such as
+// ">=17.03 <17.10". A version is in range if it satisfies all of them;
+// an empty range contains any version.
+type VersionRange []versionConstraint
+
+type versionConstraint struct {
+	op      string
+	raw     string
+	version semver.Version
+}
+
+// versionOps are the supported constraint operators, longest first
+var versionOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseVersionRange parses whitespace-separated constraints, each an
+// operator (one of >=, <=, >, <, =, !=) followed by a version. A bare
+// version means "=".
+func ParseVersionRange(s string) (VersionRange, error) {
+	r := VersionRange{}
+	for _, field := range strings.Fields(s) {
+		op := "="
+		for _, o := range versionOps {
+			if strings.HasPrefix(field, o) {
+				op = o
+				break
+			}
+		}
+		raw := strings.TrimPrefix(field, op)
+		v, err := parseLooseVersion(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid version range %q", s)
+		}
+		r = append(r, versionConstraint{op, raw, *v})
+	}
+	return r, nil
+}
+
+// Contains returns true if version satisfies all constraints. Versions
+// which cannot be parsed are never in a non-empty range. Prerelease or
+// edition suffixes (e.g. "-ce") are ignored, unless the constraint has one:
+// "1.8.0-ce" is not in "<1.8.0".
+func (r VersionRange) Contains(version string) bool {
+	if len(r) == 0 {
+		return true
+	}
+	v, err := parseLooseVersion(version)
+	if err != nil {
+		return false
+	}
+	release := *v
+	release.PreRelease = ""
+	for _, c := range r {
+		cmp := v.Compare(c.version)
+		if c.version.PreRelease == "" {
+			cmp = release.Compare(c.version)
+		}
+		ok := false
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the range in the form accepted by ParseVersionRange
+func (r VersionRange) String() string {
+	parts := []string{}
+	for _, c := range r {
+		parts = append(parts, c.op+c.raw)
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseLooseVersion parses package versions such as "1.12" or "17.03.2-ce"
+// as semver, with missing components set to zero and leading zeros ignored.
+func parseLooseVersion(s string) (*semver.Version, error) {
+	s = strings.TrimPrefix(s, "v")
+	pre := ""
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s, pre = s[:i], s[i:]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, errors.Errorf("invalid version %q", s)
+	}
+	nums := []string{"0", "0", "0"}
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid version %q", s)
+		}
+		nums[i] = strconv.FormatInt(n, 10)
+	}
+	return semver.NewVersion(strings.Join(nums, ".") + pre)
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionRange(t *testing.T) {
+	assert := assert.New(t)
+
+	r, err := ParseVersionRange(">=17.03 <17.10 !=17.05")
+	assert.Nil(err)
+	assert.Equal(">=17.03 <17.10 !=17.05", r.String())
+	assert.True(r.Contains("17.03"))
+	assert.True(r.Contains("17.06.2"))
+	assert.True(r.Contains("17.09.1-ce"))
+	assert.False(r.Contains("17.05"))
+	assert.False(r.Contains("17.10"))
+	assert.False(r.Contains("1.12"))
+	assert.False(r.Contains("latest"))
+
+	r, err = ParseVersionRange("1.12")
+	assert.Nil(err)
+	assert.True(r.Contains("1.12.0"))
+	assert.False(r.Contains("1.13"))
+
+	// Prerelease suffixes only count if the constraint has one
+	r, err = ParseVersionRange(">=1.7.0 <1.8.0")
+	assert.Nil(err)
+	assert.True(r.Contains("1.7.11-ce"))
+	assert.False(r.Contains("1.8.0-ce"))
+	assert.False(r.Contains("1.8.0-rc.1"))
+	r, err = ParseVersionRange("<1.8.0-rc.2")
+	assert.Nil(err)
+	assert.True(r.Contains("1.8.0-rc.1"))
+	assert.False(r.Contains("1.8.0"))
+
+	r, err = ParseVersionRange("")
+	assert.Nil(err)
+	assert.True(r.Contains("anything"))
+
+	_, err = ParseVersionRange(">=17.x")
+	assert.NotNil(err)
+	_, err = ParseVersionRange("1.2.3.4")
+	assert.NotNil(err)
+}
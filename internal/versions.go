@@ -17,15 +17,13 @@ package internal
 import (
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strings"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -33,16 +31,56 @@ const (
 	CluoRuntimeMappings = "/etc/runtime-mappings.yaml"
 	// InstallerRuntimeMappings is the default path for bootstrapper runtime-mappings (installer file)
 	InstallerRuntimeMappings = "/etc/kubernetes/installer/runtime-mappings.yaml"
-	// versionManifestKind is the current type for the runtime-mappings YAML object
+	// versionManifestKind is the original type for the runtime-mappings YAML object
 	versionManifestKind = "VersionManifestV1"
-	// configMapNamespace is the default namespace for runtime-mappings ConfigMap
-	configMapNamespace = "tectonic-system"
-	// configMapName is the default name for the runtime-mappings ConfigMap
-	configMapName = "tectonic-torcx-runtime-mappings"
-	// configMapKey is the default object/key in the runtime-mappings ConfigMap
-	configMapKey = "runtime-mappings.yaml"
+	// versionManifestV2Kind is the runtime-mappings type with version ranges
+	versionManifestV2Kind = "VersionManifestV2"
+	// ConfigMapNamespace is the default namespace for runtime-mappings ConfigMap
+	ConfigMapNamespace = "tectonic-system"
+	// ConfigMapName is the default name for the runtime-mappings ConfigMap
+	ConfigMapName = "tectonic-torcx-runtime-mappings"
+	// ConfigMapKey is the default object/key in the runtime-mappings ConfigMap
+	ConfigMapKey = "runtime-mappings.yaml"
 )
 
+// RuntimeMappings maps versions of a component (e.g. k8s) to the ordered
+// list of preferred versions of another one (e.g. docker). Preferences are
+// either exact versions or VersionRange constraints.
+type RuntimeMappings interface {
+	// VersionFor returns the preferred versions of wantName for version
+	// haveVersion of haveName. The returned value will never be empty if
+	// error is nil.
+	VersionFor(haveName, haveVersion, wantName string) ([]string, error)
+
+	// componentsFor returns the sorted names of all components with
+	// preferred versions for version haveVersion of haveName.
+	componentsFor(haveName, haveVersion string) ([]string, error)
+
+	// entries returns all the entries for haveName, in order
+	entries(haveName string) []mappingEntry
+}
+
+// mappingEntry is a single entry of runtime mappings: the preferred
+// versions of components for a version (V1) or range (V2) of another.
+type mappingEntry struct {
+	have  string
+	wants map[string][]string
+}
+
+// allVersions returns all preferences for each component, for any version
+// of haveName, without duplicates.
+func allVersions(m RuntimeMappings, haveName string) map[string][]string {
+	versions := map[string][]string{}
+	for _, e := range m.entries(haveName) {
+		for name, wv := range e.wants {
+			versions[name] = appendUnique(versions[name], wv...)
+		}
+	}
+	return versions
+}
+
+// VersionManifest is a VersionManifestV1, mapping major.minor versions to
+// exact preferred versions.
 type VersionManifest struct {
 	Kind     string         `yaml:"kind"`
 	Versions map[string]Dep `yaml:"versions"`
@@ -50,30 +88,75 @@ type VersionManifest struct {
 
 type Dep map[string]map[string][]string
 
-// VersionFor parses the version manifest file and returns the list of preferred
-// package versions for a given k8s version. The returned value will never be
+// RuntimeVersionsFor parses the version manifest file and returns the list
+// of preferred versions of every runtime component listed for a given k8s
+// version, keyed by component name. The returned value will never be
 // empty if error is nil.
-func (a *App) VersionFor(localOnly bool, name, k8sVersion string) ([]string, error) {
-	// TODO(lucab): consider caching this manifest if we grow to
-	// more components other than docker.
+func (a *App) RuntimeVersionsFor(localOnly bool, k8sVersion string) (map[string][]string, error) {
 	m, err := a.GetVersionManifest(localOnly)
 	if err != nil {
 		return nil, err
 	}
 	// The k8s version is something like "v1.6.7+coreos.0"
-	// Trim it to "1.6"
 	k8sVersion = strings.TrimLeft(k8sVersion, "v")
-	ver, err := semver.NewVersion(k8sVersion)
-	if err != nil {
+	if _, err := semver.NewVersion(k8sVersion); err != nil {
 		return nil, errors.Wrap(err, "failed to parse k8s version")
 	}
-	k8sVersion = fmt.Sprintf("%d.%d", ver.Major, ver.Minor)
 
-	return m.VersionFor("k8s", k8sVersion, name)
+	names, err := m.componentsFor("k8s", k8sVersion)
+	if err != nil {
+		return nil, err
+	}
+	versions := map[string][]string{}
+	for _, name := range names {
+		versions[name], err = m.VersionFor("k8s", k8sVersion, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
 }
 
-// VersionFor is the actual version lookup logic.
+// VersionFor is the actual version lookup logic. Full versions are
+// trimmed to "major.minor", e.g. "1.6.7+coreos.0" to "1.6".
 func (m *VersionManifest) VersionFor(haveName, haveVersion, wantName string) ([]string, error) {
+	hv, err := m.depsFor(haveName, haveVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	wv, ok := hv[wantName]
+	if !ok || len(wv) == 0 {
+		return nil, fmt.Errorf("Version manifest for %s version %s doesn't specify %s", haveName, haveVersion, wantName)
+	}
+	return wv, nil
+}
+
+func (m *VersionManifest) componentsFor(haveName, haveVersion string) ([]string, error) {
+	hv, err := m.depsFor(haveName, haveVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name, wv := range hv {
+		if len(wv) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Version manifest for %s version %s doesn't specify any component", haveName, haveVersion)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// depsFor returns the entries for a major.minor version of haveName
+func (m *VersionManifest) depsFor(haveName, haveVersion string) (map[string][]string, error) {
+	if ver, err := parseLooseVersion(haveVersion); err == nil {
+		haveVersion = fmt.Sprintf("%d.%d", ver.Major, ver.Minor)
+	}
+
 	// Try and find the package + version
 	h, ok := m.Versions[haveName]
 	if !ok {
@@ -84,44 +167,92 @@ func (m *VersionManifest) VersionFor(haveName, haveVersion, wantName string) ([]
 	if !ok {
 		return nil, fmt.Errorf("Version manifest has no entries for %s version %s", haveName, haveVersion)
 	}
+	return hv, nil
+}
 
-	wv, ok := hv[wantName]
-	if !ok || len(wv) == 0 {
-		return nil, fmt.Errorf("Version manifest for %s version %s doesn't specify %s", haveName, haveVersion, wantName)
+func (m *VersionManifest) entries(haveName string) []mappingEntry {
+	haveVersions := []string{}
+	for k := range m.Versions[haveName] {
+		haveVersions = append(haveVersions, k)
 	}
-	return wv, nil
+	sort.Strings(haveVersions)
+
+	entries := []mappingEntry{}
+	for _, k := range haveVersions {
+		entries = append(entries, mappingEntry{have: k, wants: m.Versions[haveName][k]})
+	}
+	return entries
 }
 
-// Parse and quickly validate the yaml version manifest
-func parseVersionManifest(data []byte) (*VersionManifest, error) {
-	m := VersionManifest{}
-	err := yaml.Unmarshal(data, &m)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse version manifest")
+// appendUnique appends the values not already in list
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
 	}
+	return list
+}
 
-	if m.Kind != versionManifestKind {
-		return nil, fmt.Errorf("did not understand version kind %s", m.Kind)
+// Parse and quickly validate the yaml version manifest, of any known kind
+func parseVersionManifest(data []byte) (RuntimeMappings, error) {
+	header := struct {
+		Kind string `yaml:"kind"`
+	}{}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return nil, errors.Wrap(err, "failed to parse version manifest")
 	}
 
-	return &m, nil
+	switch header.Kind {
+	case versionManifestKind:
+		m := VersionManifest{}
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, errors.Wrap(err, "failed to parse version manifest")
+		}
+		return &m, nil
+	case versionManifestV2Kind:
+		return parseVersionManifestV2(data)
+	}
+	return nil, fmt.Errorf("did not understand version kind %s", header.Kind)
 }
 
 // GetVersionManifest parses the version manifest file supplied by the user.
-func (a *App) GetVersionManifest(localOnly bool) (*VersionManifest, error) {
+func (a *App) GetVersionManifest(localOnly bool) (RuntimeMappings, error) {
 	path := a.Conf.VersionManifestPath
 	if path == "" {
 		return nil, errors.New("missing version manifest path")
 	}
 
-	// Conditionally try ConfigMap from api-server first (bootstrapper only)
-	if !localOnly {
-		logrus.Debug("Querying api-server for runtime mappings ConfigMap")
-		manifest, err := a.versionManifestFromAPIServer()
-		if err == nil {
-			return parseVersionManifest([]byte(manifest))
+	// Conditionally try ConfigMap or TorcxRuntimeMapping from api-server
+	// first (bootstrapper, or hook if configured to)
+	if !localOnly || a.Conf.MappingsFromAPIServer {
+		if a.Conf.MappingsSource == MappingsSourceCRD {
+			logrus.Debugf("Querying api-server for runtime mappings %s", torcxRuntimeMappingKind)
+			m, err := a.mappingsFromCRD()
+			if err == nil {
+				var vm *VersionManifestV2
+				if vm, err = m.versionManifest(); err == nil {
+					return vm, nil
+				}
+				logrus.Warnf("Ignoring invalid %s: %s", torcxRuntimeMappingKind, err)
+			} else {
+				logrus.Warnf("Failed to query api-server for %s: %s", torcxRuntimeMappingKind, err)
+			}
+		} else {
+			logrus.Debug("Querying api-server for runtime mappings ConfigMap")
+			sources, err := a.mappingsFromAPIServer()
+			if err == nil {
+				return mergeMappingsSources(sources)
+			}
+			logrus.Warnf("Failed to query api-server for ConfigMap: %s", err)
 		}
-		logrus.Warnf("Failed to query api-server for ConfigMap: %s", err)
 	}
 
 	// Source mappings from local file
@@ -132,40 +263,3 @@ func (a *App) GetVersionManifest(localOnly bool) (*VersionManifest, error) {
 
 	return parseVersionManifest(data)
 }
-
-// versionManifestFromAPIServer connects to the APIServer and determines
-// runtime mappings from the relevant ConfigMap.
-func (a *App) versionManifestFromAPIServer() (string, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", a.Conf.Kubeconfig)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to build kubeconfig")
-	}
-
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to build kube client")
-	}
-
-	var versionManifest string
-	err = retry(3, 10, func() error {
-		cmi := client.ConfigMaps(configMapNamespace)
-		if cmi == nil {
-			return errors.Errorf("nil ConfigMapInterface for namespace %s", configMapNamespace)
-		}
-		cm, e := cmi.Get(configMapName, meta_v1.GetOptions{})
-		if e != nil {
-			return e
-		}
-		if cm == nil || cm.Data[configMapKey] == "" {
-			return errors.Errorf("missing entry %s/%s", configMapName, configMapKey)
-		}
-		versionManifest = cm.Data[configMapKey]
-		return nil
-	})
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to get ConfigMap %s/%s", configMapNamespace, configMapName)
-	}
-	logrus.Debugf("Got %s from ConfigMap %s/%s", configMapKey, configMapNamespace, configMapName)
-
-	return versionManifest, nil
-}
@@ -68,4 +68,103 @@ versions:
 	if err == nil {
 		t.Fatal("expected err, got nil")
 	}
+
+	names, err := m.componentsFor("k8s", "1.8.4+coreos.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"docker"}, names) {
+		t.Fatalf("componentsFor: got %v", names)
+	}
+}
+
+func TestVersionForV2(t *testing.T) {
+	manifestData := `
+kind: VersionManifestV2
+versions:
+  k8s:
+    - range: ">=1.8.3 <1.9.0"
+      docker: [ "17.03", ">=1.12 <1.13" ]
+    - range: "1.8.4"
+      docker: [ "17.03.2" ]
+    - range: ">=1.8.0 <1.8.3"
+      docker: [ "1.12" ]
+      rkt: [ "1.28" ]
+    - range: ">=1.6.0 <1.9.0"
+      rkt: [ "1.25" ]
+`
+
+	m, err := parseVersionManifest([]byte(manifestData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want string
+		out  []string
+		err  bool
+	}{
+		{in: "1.8.3", out: []string{"17.03", ">=1.12 <1.13"}},
+		{in: "1.8.5+coreos.0", out: []string{"17.03", ">=1.12 <1.13"}},
+		{in: "1.8.4+coreos.0", out: []string{"17.03.2"}},
+		{in: "1.8.2", out: []string{"1.12"}},
+		{in: "1.8.2", want: "rkt", out: []string{"1.28"}},
+		{in: "1.8.3", want: "rkt", out: []string{"1.25"}},
+		{in: "1.7.0", err: true},
+		{in: "1.9.0", err: true},
+		{in: "latest", err: true},
+	} {
+		want := tc.want
+		if want == "" {
+			want = "docker"
+		}
+		actual, err := m.VersionFor("k8s", tc.in, want)
+		if err != nil && !tc.err {
+			t.Fatalf("VersionFor(%s): unexpected error %s", tc.in, err)
+		}
+		if err == nil && tc.err {
+			t.Fatalf("VersionFor(%s): expected error, got none", tc.in)
+		}
+
+		if !reflect.DeepEqual(tc.out, actual) {
+			t.Fatalf("VersionFor(%s), got %v expected %v", tc.in, actual, tc.out)
+		}
+	}
+
+	all := allVersions(m, "k8s")
+	expected := map[string][]string{
+		"docker": {"17.03", ">=1.12 <1.13", "17.03.2", "1.12"},
+		"rkt":    {"1.28", "1.25"},
+	}
+	if !reflect.DeepEqual(expected, all) {
+		t.Fatalf("allVersions: got %v", all)
+	}
+
+	for _, tc := range []struct {
+		in  string
+		out []string
+	}{
+		{in: "1.8.2", out: []string{"docker", "rkt"}},
+		{in: "1.8.4", out: []string{"docker", "rkt"}},
+		{in: "1.7.0", out: []string{"rkt"}},
+		{in: "1.9.0"},
+	} {
+		actual, err := m.componentsFor("k8s", tc.in)
+		if (err != nil) != (tc.out == nil) {
+			t.Fatalf("componentsFor(%s): unexpected error %v", tc.in, err)
+		}
+		if !reflect.DeepEqual(tc.out, actual) {
+			t.Fatalf("componentsFor(%s), got %v expected %v", tc.in, actual, tc.out)
+		}
+	}
+
+	_, err = parseVersionManifest([]byte("kind: VersionManifestV2\nversions:\n  k8s:\n    - range: \">=1.x\"\n      docker: [ \"1.12\" ]\n"))
+	if err == nil {
+		t.Fatal("expected err, got nil")
+	}
+	_, err = parseVersionManifest([]byte("kind: VersionManifestV3\n"))
+	if err == nil {
+		t.Fatal("expected err, got nil")
+	}
 }
@@ -0,0 +1,155 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// VersionManifestV2 maps version ranges of a component to the ordered
+// preferred versions of others, e.g.
+//
+//	kind: VersionManifestV2
+//	versions:
+//	  k8s:
+//	    - range: "1.8.4"
+//	      docker: ["17.03.2"]
+//	    - range: ">=1.8.3 <1.9.0"
+//	      docker: ["17.03", ">=1.12 <1.13"]
+//	    - range: ">=1.8.0 <1.8.3"
+//	      docker: ["1.12"]
+//
+// Rules with an exact version are patch-level overrides, which take
+// precedence over ranges. Other rules are tried in order, the first one
+// matching and listing the wanted component wins.
+type VersionManifestV2 struct {
+	Kind     string                   `yaml:"kind"`
+	Versions map[string][]VersionRule `yaml:"versions"`
+}
+
+// VersionRule lists the preferred versions of components, keyed by name,
+// for a range of versions of another one.
+type VersionRule struct {
+	Range string              `yaml:"range"`
+	Wants map[string][]string `yaml:",inline"`
+
+	haveRange VersionRange
+}
+
+// exact returns true if the rule matches a single version
+func (r *VersionRule) exact() bool {
+	return len(r.haveRange) == 1 && r.haveRange[0].op == "="
+}
+
+func parseVersionManifestV2(data []byte) (*VersionManifestV2, error) {
+	m := VersionManifestV2{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse version manifest")
+	}
+	if err := m.compile(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// compile parses and validates the version ranges of all rules
+func (m *VersionManifestV2) compile() error {
+	for haveName, rules := range m.Versions {
+		for i := range rules {
+			r := &rules[i]
+			hr, err := ParseVersionRange(r.Range)
+			if err != nil {
+				return errors.Wrapf(err, "%s rule %d", haveName, i)
+			}
+			r.haveRange = hr
+			for wantName, prefs := range r.Wants {
+				for _, pref := range prefs {
+					if !isVersionConstraint(pref) {
+						continue
+					}
+					if _, err := ParseVersionRange(pref); err != nil {
+						return errors.Wrapf(err, "%s rule %d, %s", haveName, i, wantName)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// VersionFor returns the preferred versions of wantName from the first
+// matching override, otherwise from the first matching range.
+func (m *VersionManifestV2) VersionFor(haveName, haveVersion, wantName string) ([]string, error) {
+	rules, ok := m.Versions[haveName]
+	if !ok {
+		return nil, fmt.Errorf("Version manifest has no versions for %s", haveName)
+	}
+	if _, err := parseLooseVersion(haveVersion); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s version", haveName)
+	}
+
+	for _, overrides := range []bool{true, false} {
+		for i := range rules {
+			r := &rules[i]
+			if r.exact() != overrides || !r.haveRange.Contains(haveVersion) {
+				continue
+			}
+			if wv := r.Wants[wantName]; len(wv) > 0 {
+				return wv, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Version manifest for %s version %s doesn't specify %s", haveName, haveVersion, wantName)
+}
+
+func (m *VersionManifestV2) componentsFor(haveName, haveVersion string) ([]string, error) {
+	rules, ok := m.Versions[haveName]
+	if !ok {
+		return nil, fmt.Errorf("Version manifest has no versions for %s", haveName)
+	}
+	if _, err := parseLooseVersion(haveVersion); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s version", haveName)
+	}
+
+	names := []string{}
+	for i := range rules {
+		r := &rules[i]
+		if !r.haveRange.Contains(haveVersion) {
+			continue
+		}
+		for name, wv := range r.Wants {
+			if len(wv) > 0 {
+				names = appendUnique(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Version manifest has no entries for %s version %s", haveName, haveVersion)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *VersionManifestV2) entries(haveName string) []mappingEntry {
+	entries := []mappingEntry{}
+	for _, r := range m.Versions[haveName] {
+		entries = append(entries, mappingEntry{have: r.Range, wants: r.Wants})
+	}
+	return entries
+}